@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//
+// Admin API for managing the server, enabled by setting an admin token.
+// Requests authenticate with the header "Authorization: Bearer <token>".
+//
+
+func adminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.GetHeader("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+type watchRequest struct {
+	Thread   string `json:"thread"`   // Thread ID or URL.
+	Interval string `json:"interval"` // Duration such as "30m".
+	Duration string `json:"duration"` // Duration such as "48h".
+}
+
+func routeAdminGetWatchlist(c *gin.Context) {
+	entries, err := queryWatchlist()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entries)
+}
+
+func routeAdminPostWatchlist(c *gin.Context) {
+	req := watchRequest{Interval: "30m", Duration: "48h"}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	link, urlErr := readThreadUrl(req.Thread)
+	if urlErr {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid thread"})
+		return
+	}
+	interval, err := time.ParseDuration(req.Interval)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := addWatch(link.ThreadId, link.Sub, interval, duration, time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"thread_id": link.ThreadId})
+}
+
+func routeAdminDeleteWatchlist(c *gin.Context) {
+	removed, err := removeWatch(c.Param("threadid"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not on watchlist"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type followRequest struct {
+	Sub         string   `json:"sub"`
+	Listings    []string `json:"listings"`
+	MinScore    int64    `json:"min_score"`
+	MinComments int64    `json:"min_comments"`
+	Flairs      []string `json:"flairs"`
+	MinAge      string   `json:"min_age"` // Durations such as "1h".
+	MaxAge      string   `json:"max_age"`
+	Interval    string   `json:"interval"`
+}
+
+func routeAdminGetFollows(c *gin.Context) {
+	follows, err := queryFollows("")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, follows)
+}
+
+func routeAdminPostFollows(c *gin.Context) {
+	req := followRequest{Listings: []string{"new"}, MinAge: "0s", MaxAge: "0s", Interval: "10m"}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	durations := []time.Duration{}
+	for _, d := range []string{req.MinAge, req.MaxAge, req.Interval} {
+		parsed, err := time.ParseDuration(d)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		durations = append(durations, parsed)
+	}
+	f := Follow{
+		Sub:         req.Sub,
+		Listings:    req.Listings,
+		MinScore:    req.MinScore,
+		MinComments: req.MinComments,
+		Flairs:      req.Flairs,
+		MinAge:      int64(durations[0].Seconds()),
+		MaxAge:      int64(durations[1].Seconds()),
+		Interval:    int64(durations[2].Seconds()),
+	}
+	if err := addFollow(f, time.Now()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"sub": f.Sub})
+}
+
+func routeAdminDeleteFollows(c *gin.Context) {
+	removed, err := removeFollow(c.Param("sub"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not followed"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+type webhookRequest struct {
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"` // Generated if empty.
+}
+
+func routeAdminGetWebhooks(c *gin.Context) {
+	hooks, err := queryWebhooks()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, hooks)
+}
+
+func routeAdminPostWebhooks(c *gin.Context) {
+	req := webhookRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, secret, err := addWebhook(req.Url, req.Events, req.Secret, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"id": id, "secret": secret})
+}
+
+func routeAdminDeleteWebhooks(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	removed, err := removeWebhook(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such webhook"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func routeAdminGetDeadDeliveries(c *gin.Context) {
+	deliveries, err := queryDeadDeliveries()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, deliveries)
+}
+
+func routeAdminRetryDelivery(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	retried, err := retryDelivery(id, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !retried {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no such dead delivery"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func routeAdminDeleteThread(c *gin.Context) {
+	removed, err := takedownThread(c.Param("threadid"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !removed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not archived"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func adminRoutes(r *gin.Engine, token string) {
+	admin := r.Group("/api/admin", adminAuth(token))
+	admin.GET("/watchlist", routeAdminGetWatchlist)
+	admin.POST("/watchlist", routeAdminPostWatchlist)
+	admin.DELETE("/watchlist/:threadid", routeAdminDeleteWatchlist)
+	admin.GET("/follows", routeAdminGetFollows)
+	admin.POST("/follows", routeAdminPostFollows)
+	admin.DELETE("/follows/:sub", routeAdminDeleteFollows)
+	admin.GET("/webhooks", routeAdminGetWebhooks)
+	admin.POST("/webhooks", routeAdminPostWebhooks)
+	admin.DELETE("/webhooks/:id", routeAdminDeleteWebhooks)
+	admin.GET("/webhooks/dead", routeAdminGetDeadDeliveries)
+	admin.POST("/webhooks/dead/:id/retry", routeAdminRetryDelivery)
+	admin.DELETE("/threads/:threadid", routeAdminDeleteThread)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilmari-h/bettit/media"
+	"github.com/tidwall/gjson"
+)
+
+// Comments nested deeper than this are not archived.
+const MAX_COMMENT_DEPTH = 100
+
+//
+// In-memory representation of a thread built by the fetch phase of the
+// archive pipeline and committed to the database by the write phase.
+//
+
+// A single page returned by the Reddit API. The top level page of a thread has
+// an empty FromReply, continuation pages hang off the comment they continue.
+type ThreadPage struct {
+	Sub       string
+	FromReply string
+	Post      PostData
+	Comments  []*CommentData
+	More      []string // Top level comments not fetched, see CommentData.More.
+
+	// The response the page was parsed from, stored with each snapshot.
+	Raw        []byte
+	RequestUrl string
+	FetchTime  int64
+	Response   string // Status line and headers of the response, empty if not captured.
+
+	// Media archived with the thread, only set on the top level page.
+	Media []media.Item
+}
+
+type PostData struct {
+	Id                string
+	Title             string
+	Content           string
+	ContentLink       string
+	Author            string
+	RepliesNum        int64
+	Timestamp         int64
+	LinkFlair         string
+	AuthorFlair       string
+	Edited            int64 // Zero if never edited.
+	Distinguished     string
+	Stickied          bool
+	Locked            bool
+	RemovedByCategory string
+	UpvoteRatio       float64
+	Gilded            int64
+	Awards            string // JSON list of awards, see parseAwards.
+	CrosspostParent   string
+	Poll              *PollData // Nil if the post is not a poll.
+	Links             []ThreadLink
+	Raw               string // The post object as returned by the API.
+}
+
+type CommentData struct {
+	Id               string
+	Content          string
+	Author           string
+	Timestamp        int64
+	Score            int64
+	Controversiality int64
+	Rank             int64 // Position among its siblings in the order Reddit returned them, starting from 1.
+	AuthorFlair      string
+	Edited           int64
+	Distinguished    string
+	Stickied         bool
+	Gilded           int64
+	Awards           string
+	Raw              string // The comment object as returned by the API, without replies.
+	State            string // One of the COMMENT_ states.
+	ArchivedContent  string // Content of a deleted or removed comment before it was removed.
+	ArchivedAuthor   string
+	Continues        bool
+	Replies          []*CommentData
+	More             []string    // Replies listed in stubs of more comments, which are not fetched.
+	Continuation     *ThreadPage // Set once the continuing page has been fetched.
+}
+
+// Fetches the raw API response for a thread, or for the comment thread
+// starting from commentId if it is not empty, along with the status line and
+// headers of the response if they are known.
+type pageFetcher func(sub string, threadId string, commentId string) ([]byte, string, error)
+
+func fetchRedditPage(sub string, threadId string, commentId string) ([]byte, string, error) {
+	req, err := NewThreadRequest(sub, threadId, commentId)
+	if err != nil {
+		return nil, "", err
+	}
+	data, header, rErr := getThread(req)
+	if rErr != nil {
+		return nil, "", rErr
+	}
+	return data, header, nil
+}
+
+type award struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// Awards of a post or comment as a JSON list of names and counts, empty if none.
+func parseAwards(data gjson.Result) string {
+	awards := []award{}
+	for _, a := range data.Get("all_awardings").Array() {
+		awards = append(awards, award{a.Get("name").String(), a.Get("count").Int()})
+	}
+	if len(awards) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(awards)
+	return string(encoded)
+}
+
+// The API returns `false` for posts and comments that were never edited,
+// otherwise the time of the edit.
+func parseEdited(data gjson.Result) int64 {
+	if edited := data.Get("edited"); edited.Type == gjson.Number {
+		return edited.Int()
+	}
+	return 0
+}
+
+// The raw object stored with each comment, replies are stored as comments of their own.
+func rawComment(data gjson.Result) string {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(data.Raw), &fields); err != nil {
+		return "{}"
+	}
+	delete(fields, "replies")
+	encoded, _ := json.Marshal(fields)
+	return string(encoded)
+}
+
+func parseComment(data gjson.Result, depth int, rank int) *CommentData {
+	if depth == MAX_COMMENT_DEPTH {
+		return nil
+	}
+
+	comment := &CommentData{
+		Id:               data.Get("data.id").String(),
+		Content:          data.Get("data.body_html").String(),
+		Author:           data.Get("data.author").String(),
+		Timestamp:        data.Get("data.created").Int(),
+		Score:            data.Get("data.score").Int(),
+		Controversiality: data.Get("data.controversiality").Int(),
+		Rank:             int64(rank),
+		AuthorFlair:      data.Get("data.author_flair_text").String(),
+		Edited:           parseEdited(data.Get("data")),
+		Distinguished:    data.Get("data.distinguished").String(),
+		Stickied:         data.Get("data.stickied").Bool(),
+		Gilded:           data.Get("data.gilded").Int(),
+		Awards:           parseAwards(data.Get("data")),
+		State:            commentState(data.Get("data")),
+	}
+
+	// For now, don't load links unless continuing a comment thread.
+	if comment.Author == "" && comment.Content == "" {
+		return nil
+	}
+	comment.Raw = rawComment(data.Get("data"))
+
+	replies := data.Get("data.replies.data.children")
+	comment.Continues = replies.Get("0.kind").String() == "more"
+	if comment.Continues || !replies.IsArray() {
+		return comment
+	}
+	for i, reply := range replies.Array() {
+		if reply.Get("kind").String() == "more" {
+			comment.More = append(comment.More, parseMore(reply, comment.Id)...)
+		} else if child := parseComment(reply, depth+1, i+1); child != nil {
+			comment.Replies = append(comment.Replies, child)
+		}
+	}
+	return comment
+}
+
+// IDs of the comments listed in a stub of more comments. Stubs that continue
+// the thread list none, then the ID of the parent is returned as none of its
+// replies past the stub are known.
+func parseMore(data gjson.Result, parent string) []string {
+	ids := []string{}
+	for _, id := range data.Get("data.children").Array() {
+		ids = append(ids, id.String())
+	}
+	if len(ids) == 0 {
+		ids = append(ids, parent)
+	}
+	return ids
+}
+
+// Parse a raw API response into a page. Continuations are left unresolved.
+// The subreddit in the response takes precedence over the one given, as not
+// every link form includes it.
+func parseThreadPage(data []byte, sub string, fromReply string) *ThreadPage {
+	post := gjson.GetBytes(data, "0.data.children.0.data")
+	if postSub := post.Get("subreddit").String(); postSub != "" {
+		sub = postSub
+	}
+	page := &ThreadPage{
+		Sub:       sub,
+		FromReply: fromReply,
+		Raw:       data,
+		Post: PostData{
+			Id:          post.Get("id").String(),
+			Title:       post.Get("title").String(),
+			Content:     post.Get("selftext_html").String(),
+			ContentLink: post.Get("url_overridden_by_dest").String(),
+			Author:      post.Get("author").String(),
+			RepliesNum:  post.Get("num_comments").Int(),
+			Timestamp:   post.Get("created").Int(),
+
+			LinkFlair:         post.Get("link_flair_text").String(),
+			AuthorFlair:       post.Get("author_flair_text").String(),
+			Edited:            parseEdited(post),
+			Distinguished:     post.Get("distinguished").String(),
+			Stickied:          post.Get("stickied").Bool(),
+			Locked:            post.Get("locked").Bool(),
+			RemovedByCategory: post.Get("removed_by_category").String(),
+			UpvoteRatio:       post.Get("upvote_ratio").Float(),
+			Gilded:            post.Get("gilded").Int(),
+			Awards:            parseAwards(post),
+			CrosspostParent:   strings.TrimPrefix(post.Get("crosspost_parent").String(), "t3_"),
+			Poll:              parsePoll(post),
+			Links:             parseLinks(post),
+			Raw:               post.Raw,
+		},
+	}
+	if page.Post.Raw == "" {
+		page.Post.Raw = "{}"
+	}
+
+	// If link is internal.
+	if strings.HasPrefix(page.Post.ContentLink, "/") {
+		page.Post.ContentLink = "https://reddit.com" + page.Post.ContentLink
+	}
+
+	for i, c := range gjson.GetBytes(data, "1.data.children").Array() {
+		if c.Get("kind").String() == "more" {
+			parent := fromReply
+			if parent == "" {
+				parent = page.Post.Id
+			}
+			page.More = append(page.More, parseMore(c, parent)...)
+		} else if comment := parseComment(c, 0, i+1); comment != nil {
+			page.Comments = append(page.Comments, comment)
+		}
+	}
+	return page
+}
+
+// The page and all continuation pages reachable from it.
+func (page *ThreadPage) pages() []*ThreadPage {
+	pages := []*ThreadPage{page}
+	for _, c := range page.continuedComments() {
+		if c.Continuation != nil {
+			pages = append(pages, c.Continuation.pages()...)
+		}
+	}
+	return pages
+}
+
+// Comments of the page that continue on another page.
+func (page *ThreadPage) continuedComments() []*CommentData {
+	continued := []*CommentData{}
+	queue := append([]*CommentData{}, page.Comments...)
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		if c.Continues {
+			continued = append(continued, c)
+		}
+		queue = append(queue, c.Replies...)
+	}
+	return continued
+}
+
+// Fetch every continuation page reachable from the given page, at most
+// `workers` requests being in flight at a time. Pages that fail to load are
+// logged and left out of the tree, their comments continuing without a
+// Continuation.
+func resolveContinuations(page *ThreadPage, fetch pageFetcher, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+
+	var resolve func(p *ThreadPage)
+	resolve = func(p *ThreadPage) {
+		for _, c := range p.continuedComments() {
+			wg.Add(1)
+			go func(c *CommentData) {
+				defer wg.Done()
+				sem <- struct{}{}
+				data, header, err := fetch(p.Sub, p.Post.Id, c.Id)
+				<-sem
+				if err != nil {
+					Log("Error requesting comment thread", err.Error()).Error()
+					return
+				}
+				c.Continuation = parseThreadPage(data, p.Sub, c.Id)
+				c.Continuation.RequestUrl = threadRequestUrl(p.Sub, p.Post.Id, c.Id)
+				c.Continuation.FetchTime = time.Now().Unix()
+				c.Continuation.Response = header
+				resolve(c.Continuation)
+			}(c)
+		}
+	}
+
+	resolve(page)
+	wg.Wait()
+}
+
+// Fetch phase of the archive pipeline. Builds the full tree of pages for a
+// thread without touching the database.
+func fetchArchive(sub string, data []byte, header string, fetch pageFetcher) *ThreadPage {
+	page := parseThreadPage(data, sub, "")
+	page.RequestUrl = threadRequestUrl(sub, page.Post.Id, "")
+	page.FetchTime = time.Now().Unix()
+	page.Response = header
+	resolveContinuations(page, fetch, clientOptions.FetchWorkers)
+	fetchMedia(page, clientOptions.FetchWorkers)
+	return page
+}
+
+// Write phase of the archive pipeline. Commits the whole tree in one transaction.
+// Webhooks are notified of the new snapshot, or of the failure.
+func writeArchive(page *ThreadPage, upsert bool) error {
+	event := EVENT_ARCHIVED
+	if threadArchived(page.Post.Id) {
+		event = EVENT_UPDATED
+	}
+	tx, txErr := NewTransaction(upsert)
+	if txErr != nil {
+		err := LogE(&DbError{"Error starting transaction", txErr.Error()})
+		emitEvent(pageEvent(EVENT_FAILED, page, err))
+		return err
+	}
+	if err := tx.txPostArchive(page); err != nil {
+		tx.rollback()
+		emitEvent(pageEvent(EVENT_FAILED, page, err))
+		return err
+	}
+	tx.done()
+	Log("Archived thread.", fmt.Sprintf("ID %s", page.Post.Id)).Info()
+	emitEvent(pageEvent(event, page, nil))
+	return nil
+}
+
+// Write a snapshot of the thread and replace its stored rows.
+func (dbtx *ThreadDbTx) txPostArchive(page *ThreadPage) error {
+	if err := dbtx.txPostSnapshot(page); err != nil {
+		return err
+	}
+	if err := dbtx.txPostLinks(page); err != nil {
+		return err
+	}
+	if err := dbtx.txPostPoll(page); err != nil {
+		return err
+	}
+	if err := dbtx.txPostMedia(page); err != nil {
+		return err
+	}
+	return dbtx.txReplaceThread(page)
+}
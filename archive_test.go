@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//
+// Helpers building API responses in the same shape as Reddit returns them.
+//
+
+type testJson = map[string]interface{}
+
+func testCommentJson(id string, replies ...testJson) testJson {
+	data := testJson{
+		"id":        id,
+		"body_html": "<p>comment " + id + "</p>",
+		"author":    "author_" + id,
+		"created":   1650000000,
+		"score":     len(replies),
+		"replies":   "",
+	}
+	if len(replies) > 0 {
+		data["replies"] = testJson{"data": testJson{"children": replies}}
+	}
+	return testJson{"kind": "t1", "data": data}
+}
+
+// Comment whose replies continue on another page.
+func testContinuedJson(id string) testJson {
+	c := testCommentJson(id)
+	c["data"].(testJson)["replies"] = testJson{"data": testJson{"children": []testJson{
+		{"kind": "more", "data": testJson{"count": 0, "children": []string{}}},
+	}}}
+	return c
+}
+
+func testPostJson(threadId string, numComments int) testJson {
+	return testJson{
+		"id":            threadId,
+		"title":         "Thread " + threadId,
+		"selftext_html": "<p>post</p>",
+		"author":        "op",
+		"num_comments":  numComments,
+		"created":       1650000000,
+		"subreddit":     "test",
+	}
+}
+
+func testPostPageJson(post testJson, comments ...testJson) []byte {
+	page := []testJson{
+		{"data": testJson{"children": []testJson{{"kind": "t3", "data": post}}}},
+		{"data": testJson{"children": comments}},
+	}
+	data, _ := json.Marshal(page)
+	return data
+}
+
+func testPageJson(threadId string, comments ...testJson) []byte {
+	return testPostPageJson(testPostJson(threadId, len(comments)), comments...)
+}
+
+// Point the database at a fresh file for the duration of the test.
+func useTestDatabase(t *testing.T) {
+	previous := DBFILE
+	DBFILE = filepath.Join(t.TempDir(), "bettit.db")
+	InitDatabase()
+	LoadTemplates()
+	t.Cleanup(func() {
+		dbReadOnly.Close()
+		DBFILE = previous
+	})
+}
+
+func TestParseThreadPage(t *testing.T) {
+	data := testPageJson("abc123",
+		testCommentJson("c1", testCommentJson("c2"), testContinuedJson("c3")),
+		testJson{"kind": "more", "data": testJson{"children": []string{"c4"}}},
+	)
+	page := parseThreadPage(data, "test", "")
+
+	assert.Equal(t, "abc123", page.Post.Id)
+	assert.Equal(t, "Thread abc123", page.Post.Title)
+	assert.Len(t, page.Comments, 1)
+	assert.Len(t, page.Comments[0].Replies, 2)
+	assert.False(t, page.Comments[0].Replies[0].Continues)
+	assert.True(t, page.Comments[0].Replies[1].Continues)
+	assert.Len(t, page.continuedComments(), 1)
+}
+
+func TestResolveContinuationsBounded(t *testing.T) {
+	const workers = 3
+
+	comments := []testJson{}
+	for i := 0; i < 10; i++ {
+		comments = append(comments, testContinuedJson(fmt.Sprintf("top%d", i)))
+	}
+	root := parseThreadPage(testPageJson("abc123", comments...), "test", "")
+
+	var inFlight, maxInFlight, fetched int32
+	fetch := func(sub, threadId, commentId string) ([]byte, string, error) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		atomic.AddInt32(&fetched, 1)
+
+		// Each continuation continues once more.
+		header := "HTTP/1.1 200 OK\r\nX-Page: " + commentId + "\r\n"
+		if len(commentId) < 6 {
+			return testPageJson(threadId, testCommentJson(commentId, testContinuedJson(commentId+"-deep"))), header, nil
+		}
+		return testPageJson(threadId, testCommentJson(commentId)), header, nil
+	}
+
+	resolveContinuations(root, fetch, workers)
+
+	assert.Equal(t, int32(20), fetched)
+	assert.LessOrEqual(t, maxInFlight, int32(workers))
+	for _, c := range root.Comments {
+		if assert.NotNil(t, c.Continuation) {
+			assert.Equal(t, c.Id, c.Continuation.FromReply)
+			// Pages fetched at the same time keep the headers of their own response.
+			assert.Equal(t, "HTTP/1.1 200 OK\r\nX-Page: "+c.Id+"\r\n", c.Continuation.Response)
+			deep := c.Continuation.Comments[0].Replies[0]
+			if assert.NotNil(t, deep.Continuation) {
+				assert.Contains(t, deep.Continuation.Response, "X-Page: "+deep.Id+"\r\n")
+			}
+		}
+	}
+}
+
+func TestResolveContinuationsFetchError(t *testing.T) {
+	root := parseThreadPage(testPageJson("abc123", testContinuedJson("c1"), testContinuedJson("c2")), "test", "")
+	mu := sync.Mutex{}
+	requested := []string{}
+	fetch := func(sub, threadId, commentId string) ([]byte, string, error) {
+		mu.Lock()
+		requested = append(requested, commentId)
+		mu.Unlock()
+		if commentId == "c1" {
+			return nil, "", &RouterError{code: 500, message: "failed"}
+		}
+		return testPageJson(threadId, testCommentJson(commentId)), "", nil
+	}
+
+	resolveContinuations(root, fetch, 2)
+
+	assert.ElementsMatch(t, []string{"c1", "c2"}, requested)
+	assert.Nil(t, root.Comments[0].Continuation)
+	assert.NotNil(t, root.Comments[1].Continuation)
+}
+
+func TestWriteArchive(t *testing.T) {
+	useTestDatabase(t)
+
+	root := parseThreadPage(testPageJson("abc123",
+		testCommentJson("c1", testCommentJson("c2")),
+		testContinuedJson("c3"),
+	), "test", "")
+	resolveContinuations(root, func(sub, threadId, commentId string) ([]byte, string, error) {
+		return testPageJson(threadId, testCommentJson(commentId, testCommentJson("c4"))), "", nil
+	}, 2)
+
+	assert.Nil(t, writeArchive(root, false))
+
+	arch, err := GetArchiveQuery("abc123", "", "", 0)
+	assert.Nil(t, err)
+	if assert.NotNil(t, arch) {
+		assert.Equal(t, "Thread abc123", arch.ThreadTitle)
+		assert.Contains(t, string(arch.ThreadHTML), "comment c2")
+		assert.Contains(t, string(arch.ThreadHTML), "/abc123-c3")
+	}
+
+	cont, err := GetArchiveQuery("abc123", "c3", "", 0)
+	assert.Nil(t, err)
+	if assert.NotNil(t, cont) {
+		assert.Contains(t, string(cont.ThreadHTML), "comment c4")
+	}
+}
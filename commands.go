@@ -0,0 +1,604 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pborman/getopt/v2"
+)
+
+//
+// Commands run from the command line instead of starting the server.
+// Each returns the exit code of the program.
+//
+
+// Rebuild thread and comment rows from the API responses stored with the
+// latest snapshot of each thread. Used after changes to parsing or the schema.
+func cmdReparse(args []string) int {
+	set := getopt.New()
+	set.SetProgram("bettit reparse")
+	set.SetParameters("[thread-id ...]")
+	set.Parse(args)
+
+	InitDatabase()
+	snapshots, err := queryLatestSnapshots(set.Args())
+	if err != nil {
+		return 1
+	}
+
+	failed := 0
+	for _, snap := range snapshots {
+		if err := reparseSnapshot(snap); err != nil {
+			Log("Error reparsing thread", fmt.Sprintf("%s: %s", snap.threadId, err.Error())).Error()
+			failed++
+		} else {
+			Log("Reparsed thread.", snap.threadId).Info()
+		}
+	}
+	fmt.Fprintf(os.Stdout, "Reparsed %d threads, %d failed.\n", len(snapshots)-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Manage the watchlist of threads archived again at an interval.
+func cmdWatch(args []string) int {
+	subcommand := ""
+	if len(args) > 1 {
+		subcommand = args[1]
+	}
+	args = args[1:]
+
+	switch subcommand {
+	case "add":
+		interval, duration := 30*time.Minute, 48*time.Hour
+		set := getopt.New()
+		set.SetProgram("bettit watch add")
+		set.SetParameters("thread ...")
+		set.FlagLong(&interval, "interval", 'i', "Interval the threads are archived at.")
+		set.FlagLong(&duration, "duration", 'd', "Time the threads are kept on the watchlist.")
+		set.Parse(args)
+		if set.NArgs() == 0 {
+			set.PrintUsage(os.Stderr)
+			return 2
+		}
+
+		InitDatabase()
+		failed := 0
+		for _, thread := range set.Args() {
+			link, urlErr := readThreadUrl(thread)
+			if urlErr {
+				Log("Invalid thread", thread).Error()
+				failed++
+				continue
+			}
+			if err := addWatch(link.ThreadId, link.Sub, interval, duration, time.Now()); err != nil {
+				Log("Error adding thread to watchlist", err.Error()).Error()
+				failed++
+				continue
+			}
+			fmt.Fprintf(os.Stdout, "Watching %s every %s for %s.\n", link.ThreadId, interval, duration)
+		}
+		if failed > 0 {
+			return 1
+		}
+		return 0
+
+	case "list":
+		InitDatabase()
+		entries, err := queryWatchlist()
+		if err != nil {
+			return 1
+		}
+		for _, e := range entries {
+			lastRun := "never"
+			if e.LastRun > 0 {
+				lastRun = time.Unix(e.LastRun, 0).Format(time.RFC3339) + " (" + e.LastStatus + ")"
+			}
+			fmt.Fprintf(os.Stdout, "%s\tevery %s\tuntil %s\tlast run %s\t%d snapshots\n",
+				e.ThreadId,
+				time.Duration(e.Interval)*time.Second,
+				time.Unix(e.Expires, 0).Format(time.RFC3339),
+				lastRun,
+				e.Snapshots,
+			)
+		}
+		return 0
+
+	case "remove":
+		if len(args) < 2 {
+			os.Stderr.WriteString("Usage: bettit watch remove thread-id ...\n")
+			return 2
+		}
+		InitDatabase()
+		failed := 0
+		for _, threadId := range args[1:] {
+			if removed, err := removeWatch(threadId); err != nil || !removed {
+				Log("Thread not removed from watchlist", threadId).Error()
+				failed++
+			}
+		}
+		if failed > 0 {
+			return 1
+		}
+		return 0
+	}
+	os.Stderr.WriteString("Usage: bettit watch add|list|remove [arguments]\n")
+	return 2
+}
+
+// Manage the subreddits followed for new threads to archive.
+func cmdFollow(args []string) int {
+	subcommand := ""
+	if len(args) > 1 {
+		subcommand = args[1]
+	}
+	args = args[1:]
+
+	switch subcommand {
+	case "add":
+		listings := []string{"new"}
+		interval := 10 * time.Minute
+		var minAge, maxAge time.Duration
+		f := Follow{}
+		set := getopt.New()
+		set.SetProgram("bettit follow add")
+		set.SetParameters("subreddit")
+		set.FlagLong(&listings, "listings", 'l', `Comma separated listings to follow, "new" and/or "top" (top of the day).`)
+		set.FlagLong(&interval, "interval", 'i', "Interval the listings are requested at.")
+		set.FlagLong(&f.MinScore, "min-score", 0, "Minimum score of archived threads.")
+		set.FlagLong(&f.MinComments, "min-comments", 0, "Minimum number of comments of archived threads.")
+		set.FlagLong(&f.Flairs, "flair", 0, "Comma separated flairs of archived threads, any flair if not set.")
+		set.FlagLong(&minAge, "min-age", 0, "Minimum age of archived threads.")
+		set.FlagLong(&maxAge, "max-age", 0, "Maximum age of archived threads, no limit if 0.")
+		set.Parse(args)
+		if set.NArgs() != 1 {
+			set.PrintUsage(os.Stderr)
+			return 2
+		}
+		f.Sub = strings.TrimPrefix(set.Arg(0), "r/")
+		f.Listings = listings
+		f.Interval = int64(interval.Seconds())
+		f.MinAge = int64(minAge.Seconds())
+		f.MaxAge = int64(maxAge.Seconds())
+
+		InitDatabase()
+		if err := addFollow(f, time.Now()); err != nil {
+			Log("Error following subreddit", err.Error()).Error()
+			return 1
+		}
+		fmt.Fprintf(os.Stdout, "Following r/%s.\n", f.Sub)
+		return 0
+
+	case "list":
+		InitDatabase()
+		follows, err := queryFollows("")
+		if err != nil {
+			return 1
+		}
+		for _, f := range follows {
+			lastRun := "never"
+			if f.LastRun > 0 {
+				lastRun = time.Unix(f.LastRun, 0).Format(time.RFC3339) + " (" + f.LastStatus + ")"
+			}
+			fmt.Fprintf(os.Stdout, "r/%s\t%s every %s\tlast run %s\t%d archived\n",
+				f.Sub,
+				strings.Join(f.Listings, ","),
+				time.Duration(f.Interval)*time.Second,
+				lastRun,
+				f.Archived,
+			)
+		}
+		return 0
+
+	case "remove":
+		if len(args) < 2 {
+			os.Stderr.WriteString("Usage: bettit follow remove subreddit ...\n")
+			return 2
+		}
+		InitDatabase()
+		failed := 0
+		for _, sub := range args[1:] {
+			if removed, err := removeFollow(strings.TrimPrefix(sub, "r/")); err != nil || !removed {
+				Log("Subreddit not removed from follows", sub).Error()
+				failed++
+			}
+		}
+		if failed > 0 {
+			return 1
+		}
+		return 0
+	}
+	os.Stderr.WriteString("Usage: bettit follow add|list|remove [arguments]\n")
+	return 2
+}
+
+// Import threads from Pushshift style dumps of submissions and comments.
+func cmdImport(args []string) int {
+	staging := DBFILE + ".import"
+	set := getopt.New()
+	set.SetProgram("bettit import")
+	set.SetParameters("dump ...")
+	set.FlagLong(&staging, "staging", 's',
+		"Database the dumps are staged in and the progress of the import is kept, to continue an interrupted import.",
+	)
+	set.Parse(args)
+	if set.NArgs() == 0 {
+		set.PrintUsage(os.Stderr)
+		return 2
+	}
+
+	InitDatabase()
+	imp, err := openImporter(staging)
+	if err != nil {
+		Log("Error opening staging database", err.Error()).Error()
+		return 1
+	}
+	defer imp.close()
+
+	start := time.Now()
+	lines := newImportProgress("lines staged")
+	for _, path := range set.Args() {
+		if _, err := imp.stageFile(path, lines); err != nil {
+			Log("Error staging dump", fmt.Sprintf("%s: %s", path, err.Error())).Error()
+			return 1
+		}
+	}
+	threads := newImportProgress("threads imported")
+	comments := newImportProgress("comments imported")
+	_, failed, err := imp.importThreads(threads, comments)
+	if err != nil {
+		Log("Error importing threads", err.Error()).Error()
+		return 1
+	}
+	fmt.Fprintf(os.Stdout,
+		"Staged %d lines (%.0f/s), imported %d threads (%.0f/s) with %d comments (%.0f/s) in %s.\n",
+		lines.count, lines.rate(), threads.count, threads.rate(), comments.count, comments.rate(),
+		time.Since(start).Round(time.Second),
+	)
+	if failed > 0 {
+		fmt.Fprintf(os.Stdout, "%d threads failed to import and are retried on the next run.\n", failed)
+		return 1
+	}
+	return 0
+}
+
+// Write archived threads to files, or the standard output.
+func cmdExport(args []string) int {
+	format := "md"
+	output := ""
+	sortOrder := DEFAULT_SORT
+	width := EXPORT_TEXT_WIDTH
+	set := getopt.New()
+	set.SetProgram("bettit export")
+	set.SetParameters("thread-id ...")
+	set.FlagLong(&format, "format", 'f', "Format of the export: md, txt, json or epub.")
+	set.FlagLong(&output, "output", 'o', `Directory the exports are written to as <thread-id>.<format>, "-" for the standard output.`)
+	set.FlagLong(&sortOrder, "sort", 0, "Order of the comments.")
+	set.FlagLong(&width, "width", 0, "Line width of plain text exports.")
+	set.Parse(args)
+	exporter, ok := exportFormats[format]
+	if set.NArgs() == 0 || !ok {
+		set.PrintUsage(os.Stderr)
+		return 2
+	}
+	if format == "txt" {
+		exporter.write = func(w io.Writer, thread *ExportThread) error {
+			return writeTextWidth(w, thread, width)
+		}
+	}
+
+	InitDatabase()
+	failed := 0
+	for _, threadId := range set.Args() {
+		thread, err := queryExport(threadId, sortOrder)
+		if err != nil || thread == nil {
+			Log("Thread not archived", threadId).Error()
+			failed++
+			continue
+		}
+		w := os.Stdout
+		if output != "" && output != "-" {
+			if w, err = os.Create(filepath.Join(output, threadId+"."+format)); err != nil {
+				Log("Error creating export file", err.Error()).Error()
+				failed++
+				continue
+			}
+		}
+		if err := exporter.write(w, thread); err != nil {
+			Log("Error exporting thread", fmt.Sprintf("%s: %s", threadId, err.Error())).Error()
+			failed++
+		}
+		if w != os.Stdout {
+			w.Close()
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func cmdExportWarc(args []string) int {
+	output := ""
+	baseUrl := "http://localhost:8080"
+	set := getopt.New()
+	set.SetProgram("bettit export-warc")
+	set.SetParameters("thread-id ...")
+	set.FlagLong(&output, "output", 'o', "File the WARC is written to, the standard output if not given.")
+	set.FlagLong(&baseUrl, "base-url", 0, "Address of the server the archive pages are recorded under.")
+	set.Parse(args)
+	if set.NArgs() == 0 {
+		set.PrintUsage(os.Stderr)
+		return 2
+	}
+
+	InitDatabase()
+	LoadTemplates()
+	threadIds := []string{}
+	for _, threadId := range set.Args() {
+		if snaps, err := queryLatestSnapshots([]string{threadId}); err != nil || len(snaps) == 0 {
+			Log("Thread not archived", threadId).Error()
+			continue
+		}
+		threadIds = append(threadIds, threadId)
+	}
+	if len(threadIds) == 0 {
+		return 1
+	}
+	w := os.Stdout
+	if output != "" && output != "-" {
+		var err error
+		if w, err = os.Create(output); err != nil {
+			Log("Error creating WARC file", err.Error()).Error()
+			return 1
+		}
+		defer w.Close()
+	}
+	if err := writeWarc(w, threadIds, baseUrl); err != nil {
+		Log("Error writing WARC", err.Error()).Error()
+		return 1
+	}
+	if len(threadIds) < set.NArgs() {
+		return 1
+	}
+	return 0
+}
+
+// Archive threads without the server, waiting for each to be written.
+// Threads already archived with as many replies are left as they are.
+func cmdArchive(args []string) int {
+	set := getopt.New()
+	set.SetProgram("bettit archive")
+	set.SetParameters("thread ...")
+	set.Parse(args)
+	if set.NArgs() == 0 {
+		set.PrintUsage(os.Stderr)
+		return 2
+	}
+
+	apiToken = FetchAPIToken()
+	InitDatabase()
+	InitMedia()
+	failed := 0
+	for _, thread := range set.Args() {
+		link, urlErr := readThreadUrl(thread)
+		if urlErr {
+			Log("Invalid thread", thread).Error()
+			failed++
+			continue
+		}
+		data, header, tErr := requestThread(link)
+		if tErr != nil {
+			Log("Error requesting thread", fmt.Sprintf("ID %s: %d %s", link.ThreadId, tErr.code, tErr.message)).Error()
+			failed++
+			continue
+		}
+		archived, upsert := checkArchived(data)
+		if archived {
+			fmt.Fprintf(os.Stdout, "%s is already archived.\n", link.ThreadId)
+			continue
+		}
+		if err := storeArchive(link.Sub, data, header, upsert); err != nil {
+			failed++
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "Archived %s.\n", link.ThreadId)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Write an archive page, or an export of the whole thread, to the standard output.
+func cmdShow(args []string) int {
+	format := "html"
+	sortOrder := ""
+	page := 0
+	context := 0
+	set := getopt.New()
+	set.SetProgram("bettit show")
+	set.SetParameters("thread-id | thread-id-reply-id | thread-id/c/comment-id")
+	set.FlagLong(&format, "format", 'f', "html for the archive page, or md, txt, json or epub for the whole thread.")
+	set.FlagLong(&sortOrder, "sort", 0, "Order of the comments.")
+	set.FlagLong(&page, "page", 0, "Page of the archive, counting from 0.")
+	set.FlagLong(&context, "context", 0, "Levels of parent comments shown with a comment.")
+	set.Parse(args)
+	_, exportable := exportFormats[format]
+	if set.NArgs() != 1 || (format != "html" && !exportable) {
+		set.PrintUsage(os.Stderr)
+		return 2
+	}
+
+	InitDatabase()
+	LoadTemplates()
+	id := set.Arg(0)
+	if format != "html" {
+		thread, err := queryExport(id, sortOrder)
+		if err != nil || thread == nil {
+			Log("Thread not archived", id).Error()
+			return 1
+		}
+		if err := exportFormats[format].write(os.Stdout, thread); err != nil {
+			Log("Error exporting thread", fmt.Sprintf("%s: %s", id, err.Error())).Error()
+			return 1
+		}
+		return 0
+	}
+
+	var arch *ArchiveTmpl
+	var err error
+	if parts := strings.Split(id, "/c/"); len(parts) == 2 {
+		if context > MAX_COMMENT_CONTEXT {
+			context = MAX_COMMENT_CONTEXT
+		}
+		arch, err = GetCommentQuery(parts[0], parts[1], context, sortOrder)
+	} else {
+		threadId, continuingReply := splitFileId(id)
+		arch, err = GetArchiveQuery(threadId, continuingReply, sortOrder, page)
+	}
+	if err != nil {
+		Log("Error getting archive", err.Error()).Error()
+		return 1
+	} else if arch == nil {
+		Log("Thread not archived", id).Error()
+		return 1
+	}
+	arch.BaseUrl = routerOptions.BaseUrl
+	if err := templates.Lookup("thread.tmpl").Lookup("archive").Execute(os.Stdout, arch); err != nil {
+		Log("Error rendering archive", err.Error()).Error()
+		return 1
+	}
+	return 0
+}
+
+// Take down archived threads, removing them with their snapshots.
+func cmdDelete(args []string) int {
+	set := getopt.New()
+	set.SetProgram("bettit delete")
+	set.SetParameters("thread-id ...")
+	set.Parse(args)
+	if set.NArgs() == 0 {
+		set.PrintUsage(os.Stderr)
+		return 2
+	}
+
+	// The media store is needed to remove the files of the threads. Pages a
+	// running server has cached are served until they expire, takedowns
+	// through the admin API drop them at once.
+	InitDatabase()
+	InitMedia()
+	failed := 0
+	for _, threadId := range set.Args() {
+		removed, err := takedownThread(threadId)
+		if err != nil {
+			failed++
+		} else if !removed {
+			Log("Thread not archived", threadId).Error()
+			failed++
+		} else {
+			fmt.Fprintf(os.Stdout, "Deleted %s.\n", threadId)
+		}
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Print counts of the archived data, one "name<tab>value" line each.
+func cmdStats(args []string) int {
+	set := getopt.New()
+	set.SetProgram("bettit stats")
+	set.Parse(args)
+
+	InitDatabase()
+	stats, err := queryStats()
+	if err != nil {
+		return 1
+	}
+	archiveTime := func(timestamp int64) string {
+		if timestamp == 0 {
+			return "never"
+		}
+		return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+	}
+	for _, stat := range [][2]interface{}{
+		{"threads", stats.Threads},
+		{"subreddits", stats.Subreddits},
+		{"comments", stats.Comments},
+		{"snapshots", stats.Snapshots},
+		{"stored_pages", stats.StoredPages},
+		{"stored_bytes", stats.StoredBytes},
+		{"media_files", stats.MediaFiles},
+		{"media_bytes", stats.MediaBytes},
+		{"watchlist", stats.Watchlist},
+		{"follows", stats.Follows},
+		{"webhooks", stats.Webhooks},
+		{"webhook_deliveries_pending", stats.PendingHooks},
+		{"webhook_deliveries_dead", stats.DeadHooks},
+		{"first_archive", archiveTime(stats.FirstArchive)},
+		{"latest_archive", archiveTime(stats.LatestArchive)},
+		{"database_bytes", stats.DatabaseBytes},
+	} {
+		fmt.Fprintf(os.Stdout, "%s\t%v\n", stat[0], stat[1])
+	}
+	return 0
+}
+
+// Remove orphaned rows and media files and compact the database.
+func cmdVacuum(args []string) int {
+	set := getopt.New()
+	set.SetProgram("bettit vacuum")
+	set.Parse(args)
+
+	InitDatabase()
+	InitMedia()
+	before, _ := os.Stat(DBFILE)
+	removed, files, err := vacuumDatabase()
+	if err != nil {
+		return 1
+	}
+	for _, o := range orphanQueries {
+		if removed[o.name] > 0 {
+			fmt.Fprintf(os.Stdout, "Removed %d orphaned %s.\n", removed[o.name], o.name)
+		}
+	}
+	if files > 0 {
+		fmt.Fprintf(os.Stdout, "Removed %d media files.\n", files)
+	}
+	if after, err := os.Stat(DBFILE); err == nil && before != nil {
+		fmt.Fprintf(os.Stdout, "Database size %d bytes, was %d bytes.\n", after.Size(), before.Size())
+	}
+	return 0
+}
+
+// Check the archive for damaged data. Exits with 1 if any is found.
+func cmdVerify(args []string) int {
+	set := getopt.New()
+	set.SetProgram("bettit verify")
+	set.Parse(args)
+
+	InitDatabase()
+	InitMedia()
+	LoadTemplates()
+	problems, err := verifyArchive()
+	if err != nil {
+		return 1
+	}
+	for _, p := range problems {
+		fmt.Fprintln(os.Stdout, p)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(os.Stdout, "%d problems found.\n", len(problems))
+		return 1
+	}
+	fmt.Fprintln(os.Stdout, "No problems found.")
+	return 0
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Orders comments of an archive page can be sorted in.
+// "best" is the order Reddit returned the comments in, only available if the
+// rank of comments was stored when archiving.
+const DEFAULT_SORT = "top"
+
+var sortOrders = []string{"best", "top", "new", "old", "controversial", "author"}
+
+var commentLess = map[string]func(a, b *CommentTmpl) bool{
+	"best": func(a, b *CommentTmpl) bool {
+		if a.rank == 0 || b.rank == 0 {
+			// Unranked comments go last, ordered by score.
+			if a.rank != b.rank {
+				return b.rank == 0
+			}
+			return a.score > b.score
+		}
+		return a.rank < b.rank
+	},
+	"top": func(a, b *CommentTmpl) bool {
+		return a.score > b.score
+	},
+	"new": func(a, b *CommentTmpl) bool {
+		return a.timestamp > b.timestamp
+	},
+	"old": func(a, b *CommentTmpl) bool {
+		return a.timestamp < b.timestamp
+	},
+	"controversial": func(a, b *CommentTmpl) bool {
+		if a.controversiality != b.controversiality {
+			return a.controversiality > b.controversiality
+		}
+		return a.score < b.score
+	},
+	"author": func(a, b *CommentTmpl) bool {
+		aAuthor, bAuthor := strings.ToLower(a.Author), strings.ToLower(b.Author)
+		if aAuthor != bAuthor {
+			return aAuthor < bAuthor
+		}
+		return a.timestamp < b.timestamp
+	},
+}
+
+// Returns the given sort order if it is known, otherwise the default.
+func readSortOrder(order string) string {
+	if _, ok := commentLess[order]; ok {
+		return order
+	}
+	return DEFAULT_SORT
+}
+
+// Sort comments and all their replies in place.
+func sortComments(comments []*CommentTmpl, order string) {
+	less := commentLess[readSortOrder(order)]
+	queue := [][]*CommentTmpl{comments}
+	for len(queue) > 0 {
+		siblings := queue[0]
+		queue = queue[1:]
+		sort.SliceStable(siblings, func(i, j int) bool {
+			return less(siblings[i], siblings[j])
+		})
+		for _, c := range siblings {
+			if len(c.Children) > 0 {
+				queue = append(queue, c.Children)
+			}
+		}
+	}
+}
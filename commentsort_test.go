@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func commentIds(comments []*CommentTmpl) []string {
+	ids := []string{}
+	for _, c := range comments {
+		ids = append(ids, c.CommentId)
+	}
+	return ids
+}
+
+func TestSortComments(t *testing.T) {
+	newComments := func() []*CommentTmpl {
+		return []*CommentTmpl{
+			{CommentId: "a", Author: "zed", score: 5, timestamp: 300, rank: 2},
+			{CommentId: "b", Author: "Alice", score: 10, timestamp: 100, rank: 3, controversiality: 1},
+			{CommentId: "c", Author: "bob", score: -2, timestamp: 200, rank: 1, controversiality: 1,
+				Children: []*CommentTmpl{
+					{CommentId: "c1", score: 1, timestamp: 20},
+					{CommentId: "c2", score: 3, timestamp: 10},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{"top", []string{"b", "a", "c"}},
+		{"best", []string{"c", "a", "b"}},
+		{"new", []string{"a", "c", "b"}},
+		{"old", []string{"b", "c", "a"}},
+		{"controversial", []string{"c", "b", "a"}},
+		{"author", []string{"b", "c", "a"}},
+		{"unknown", []string{"b", "a", "c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.order, func(t *testing.T) {
+			comments := newComments()
+			sortComments(comments, test.order)
+			assert.Equal(t, test.want, commentIds(comments))
+		})
+	}
+
+	comments := newComments()
+	sortComments(comments, "old")
+	assert.Equal(t, []string{"c2", "c1"}, commentIds(comments[1].Children))
+}
+
+func TestSortCommentsUnranked(t *testing.T) {
+	comments := []*CommentTmpl{
+		{CommentId: "a", score: 1},
+		{CommentId: "b", score: 9},
+		{CommentId: "c", rank: 1},
+	}
+	sortComments(comments, "best")
+	assert.Equal(t, []string{"c", "b", "a"}, commentIds(comments))
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"html"
 	"html/template"
-	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -46,6 +45,18 @@ func InitDatabase() {
 			author TEXT,
 			timestamp INTEGER,
 			archive_timestamp INTEGER,
+			link_flair TEXT DEFAULT "",
+			author_flair TEXT DEFAULT "",
+			edited INTEGER DEFAULT 0,
+			distinguished TEXT DEFAULT "",
+			stickied BOOLEAN DEFAULT 0,
+			locked BOOLEAN DEFAULT 0,
+			removed_by_category TEXT DEFAULT "",
+			upvote_ratio REAL DEFAULT 0,
+			gilded INTEGER DEFAULT 0,
+			awards TEXT DEFAULT "",
+			crosspost_parent TEXT DEFAULT "",
+			data TEXT DEFAULT "{}",
 			CONSTRAINT unq UNIQUE(thread_id, continuing_reply),
 			CONSTRAINT chk_id CHECK(LENGTH(thread_id) >= 6)
 			CONSTRAINT chk_title CHECK(LENGTH(title) > 1)
@@ -68,6 +79,18 @@ func InitDatabase() {
 			timestamp INTEGER,
 			continues BOOLEAN,
 			score INTEGER,
+			controversiality INTEGER DEFAULT 0,
+			rank INTEGER DEFAULT 0,
+			author_flair TEXT DEFAULT "",
+			edited INTEGER DEFAULT 0,
+			distinguished TEXT DEFAULT "",
+			stickied BOOLEAN DEFAULT 0,
+			gilded INTEGER DEFAULT 0,
+			awards TEXT DEFAULT "",
+			data TEXT DEFAULT "{}",
+			state TEXT DEFAULT "live",
+			archived_content TEXT DEFAULT "",
+			archived_author TEXT DEFAULT "",
 			FOREIGN KEY (thread_key) REFERENCES threads(id),
 			FOREIGN KEY (parent_id) REFERENCES comments(id)
 		);`,
@@ -77,6 +100,235 @@ func InitDatabase() {
 		statement.Exec()
 	}
 
+	// Each time a thread is archived a snapshot is recorded, holding the
+	// responses of the API compressed.
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS snapshots (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			thread_id TEXT,
+			sub TEXT,
+			replies_num INTEGER,
+			archive_timestamp INTEGER
+		);`,
+	); err != nil {
+		Log("Error creating snapshots table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS raw_pages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			snapshot_id INTEGER,
+			continuing_reply TEXT,
+			request_url TEXT,
+			fetch_timestamp INTEGER,
+			response_headers TEXT DEFAULT "",
+			data BLOB,
+			FOREIGN KEY (snapshot_id) REFERENCES snapshots(id)
+		);`,
+	); err != nil {
+		Log("Error creating raw pages table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	// Downloaded media files by their original URL, and the media of each thread.
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS media (
+			url TEXT PRIMARY KEY,
+			hash TEXT,
+			mime TEXT,
+			size INTEGER
+		);`,
+	); err != nil {
+		Log("Error creating media table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS thread_media (
+			thread_id TEXT,
+			url TEXT,
+			kind TEXT,
+			position INTEGER,
+			CONSTRAINT unq UNIQUE(thread_id, url)
+		);`,
+	); err != nil {
+		Log("Error creating thread media table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	// Threads archived again at an interval, see watchlist.go.
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS watchlist (
+			thread_id TEXT PRIMARY KEY,
+			sub TEXT DEFAULT "",
+			interval INTEGER,
+			expires INTEGER,
+			next_run INTEGER,
+			last_run INTEGER DEFAULT 0,
+			last_status TEXT DEFAULT "",
+			snapshots INTEGER DEFAULT 0
+		);`,
+	); err != nil {
+		Log("Error creating watchlist table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	// Subreddits followed for new threads to archive, see follows.go.
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS follows (
+			sub TEXT PRIMARY KEY COLLATE NOCASE,
+			listings TEXT,
+			min_score INTEGER DEFAULT 0,
+			min_comments INTEGER DEFAULT 0,
+			flairs TEXT DEFAULT "",
+			min_age INTEGER DEFAULT 0,
+			max_age INTEGER DEFAULT 0,
+			interval INTEGER,
+			cursor TEXT DEFAULT "",
+			next_run INTEGER DEFAULT 0,
+			last_run INTEGER DEFAULT 0,
+			last_status TEXT DEFAULT "",
+			archived INTEGER DEFAULT 0
+		);`,
+	); err != nil {
+		Log("Error creating follows table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	// Threads posts are crossposts of or link to.
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS thread_links (
+			thread_id TEXT,
+			linked_id TEXT,
+			linked_sub TEXT,
+			kind TEXT,
+			CONSTRAINT unq UNIQUE(thread_id, linked_id)
+		);`,
+	); err != nil {
+		Log("Error creating thread links table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	// Polls and their options as recorded in each snapshot.
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS polls (
+			snapshot_id INTEGER PRIMARY KEY,
+			thread_id TEXT,
+			voting_end_timestamp INTEGER,
+			total_votes INTEGER
+		);`,
+	); err != nil {
+		Log("Error creating polls table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS poll_options (
+			snapshot_id INTEGER,
+			thread_id TEXT,
+			option_id TEXT,
+			position INTEGER,
+			text TEXT,
+			votes INTEGER,
+			CONSTRAINT unq UNIQUE(snapshot_id, option_id)
+		);`,
+	); err != nil {
+		Log("Error creating poll options table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	// Webhook subscriptions and the queue of their deliveries, see webhooks.go.
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT,
+			secret TEXT,
+			events TEXT,
+			created INTEGER
+		);`,
+	); err != nil {
+		Log("Error creating webhooks table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	if statement, err := db.Prepare(`
+		CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id INTEGER,
+			event TEXT,
+			payload TEXT,
+			attempts INTEGER DEFAULT 0,
+			next_attempt INTEGER,
+			last_error TEXT DEFAULT "",
+			dead BOOLEAN DEFAULT 0,
+			created INTEGER
+		);`,
+	); err != nil {
+		Log("Error creating webhook deliveries table", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	migrateColumns(db)
+
+	// Create index for thread_id in snapshots.
+	if statement, err := db.Prepare(`
+		CREATE INDEX IF NOT EXISTS snapshots_thread_id_index ON snapshots(thread_id)
+	`); err != nil {
+		Log("Error creating database index", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	// Create index for linked_id in thread_links, for finding threads linking to a thread.
+	if statement, err := db.Prepare(`
+		CREATE INDEX IF NOT EXISTS thread_links_linked_index ON thread_links(linked_id)
+	`); err != nil {
+		Log("Error creating database index", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	// Create index for thread_id in polls and poll_options.
+	for _, table := range []string{"polls", "poll_options"} {
+		if statement, err := db.Prepare(`
+			CREATE INDEX IF NOT EXISTS ` + table + `_thread_index ON ` + table + `(thread_id)
+		`); err != nil {
+			Log("Error creating database index", err.Error()).Fatal()
+		} else {
+			statement.Exec()
+		}
+	}
+
+	// Create index for hash in media, files are served by their hash.
+	if statement, err := db.Prepare(`
+		CREATE INDEX IF NOT EXISTS media_hash_index ON media(hash)
+	`); err != nil {
+		Log("Error creating database index", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
+	// Create index for snapshot_id in raw_pages.
+	if statement, err := db.Prepare(`
+		CREATE INDEX IF NOT EXISTS raw_pages_snapshot_index ON raw_pages(snapshot_id)
+	`); err != nil {
+		Log("Error creating database index", err.Error()).Fatal()
+	} else {
+		statement.Exec()
+	}
+
 	// Create index for thread_id in threads.
 	if statement, err := db.Prepare(`
 		CREATE INDEX IF NOT EXISTS threads_id_index ON threads(thread_id)
@@ -107,6 +359,61 @@ func InitDatabase() {
 	dbReadOnly, _ = sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rw&_busy_timeout=9999999", DBFILE))
 }
 
+// Columns added to tables after their creation. Missing ones are added to
+// existing databases on startup.
+var columnMigrations = []struct {
+	table      string
+	column     string
+	definition string
+}{
+	{"comments", "controversiality", "INTEGER DEFAULT 0"},
+	{"comments", "rank", "INTEGER DEFAULT 0"},
+	{"threads", "link_flair", `TEXT DEFAULT ""`},
+	{"threads", "author_flair", `TEXT DEFAULT ""`},
+	{"threads", "edited", "INTEGER DEFAULT 0"},
+	{"threads", "distinguished", `TEXT DEFAULT ""`},
+	{"threads", "stickied", "BOOLEAN DEFAULT 0"},
+	{"threads", "locked", "BOOLEAN DEFAULT 0"},
+	{"threads", "removed_by_category", `TEXT DEFAULT ""`},
+	{"threads", "upvote_ratio", "REAL DEFAULT 0"},
+	{"threads", "gilded", "INTEGER DEFAULT 0"},
+	{"threads", "awards", `TEXT DEFAULT ""`},
+	{"threads", "crosspost_parent", `TEXT DEFAULT ""`},
+	{"threads", "data", `TEXT DEFAULT "{}"`},
+	{"comments", "author_flair", `TEXT DEFAULT ""`},
+	{"comments", "edited", "INTEGER DEFAULT 0"},
+	{"comments", "distinguished", `TEXT DEFAULT ""`},
+	{"comments", "stickied", "BOOLEAN DEFAULT 0"},
+	{"comments", "gilded", "INTEGER DEFAULT 0"},
+	{"comments", "awards", `TEXT DEFAULT ""`},
+	{"comments", "data", `TEXT DEFAULT "{}"`},
+	{"comments", "state", `TEXT DEFAULT "live"`},
+	{"comments", "archived_content", `TEXT DEFAULT ""`},
+	{"comments", "archived_author", `TEXT DEFAULT ""`},
+	{"raw_pages", "response_headers", `TEXT DEFAULT ""`},
+}
+
+func migrateColumns(db *sql.DB) {
+	for _, m := range columnMigrations {
+		exists := false
+		if rows, err := db.Query(
+			fmt.Sprintf(`SELECT 1 FROM pragma_table_info('%s') WHERE name = ?`, m.table), m.column,
+		); err != nil {
+			Log("Error reading table info", err.Error()).Fatal()
+		} else {
+			exists = rows.Next()
+			rows.Close()
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, m.table, m.column, m.definition)); err != nil {
+			Log("Error migrating database", err.Error()).Fatal()
+		}
+		Log("Added column to database.", fmt.Sprintf("%s.%s", m.table, m.column)).Info()
+	}
+}
+
 func queryLatestArchives(limit int) (error, []ArchiveLinkTmpl) {
 	results := []ArchiveLinkTmpl{}
 	if rowsLatest, qErr := dbReadOnly.Query(`
@@ -130,12 +437,21 @@ func queryLatestArchives(limit int) (error, []ArchiveLinkTmpl) {
 	return nil, results
 }
 
-func querySubArchives(page, pageLen int, sub string) (error, []ArchiveLinkTmpl) {
+// Archived threads of a sub. With `removals` only threads that were removed or
+// have comments that were deleted, removed or went missing.
+func querySubArchives(page, pageLen int, sub string, removals bool) (error, []ArchiveLinkTmpl) {
 	results := []ArchiveLinkTmpl{}
+	filter := ""
+	if removals {
+		filter = `AND (removed_by_category != "" OR EXISTS (
+			SELECT 1 FROM comments c JOIN threads t ON c.thread_key = t.id
+			WHERE t.thread_id = threads.thread_id AND c.state != "live"
+		))`
+	}
 	if rowsLatest, qErr := dbReadOnly.Query(`
 		SELECT archive_timestamp, thread_id, title, sub
 		FROM threads
-		WHERE continuing_reply = "" AND sub = ?
+		WHERE continuing_reply = "" AND sub = ? `+filter+`
 		ORDER BY archive_timestamp DESC
 		LIMIT ?, ?`, sub, page*pageLen, pageLen,
 	); qErr != nil {
@@ -175,35 +491,17 @@ func querySubsList(page, pageLen int) (error, *SubsListTmpl) {
 
 // Post a new comment to the database and all replies to it.
 // Recursive function.
-func (dbtx *ThreadDbTx) txPostComment(
-	data gjson.Result,
-	threadId string,
-	threadKey int64,
-	sub string,
-	parent int,
-	currentDepth int,
-	maxDepth int) *DbError {
-
-	if currentDepth == maxDepth {
-		return nil
-	}
+func (dbtx *ThreadDbTx) txPostComment(comment *CommentData, threadKey int64, parent int) *DbError {
 
-	content := data.Get("data.body_html").String()
-	author := data.Get("data.author").String()
-	timestamp := data.Get("data.created").Int()
-	replies := data.Get("data.replies.data.children")
-	loadMore := replies.Get("0.kind").String() == "more"
-	commentId := data.Get("data.id").String()
-	score := data.Get("data.score").Int()
 	parentStr := "NULL"
 	if parent > -1 {
 		parentStr = fmt.Sprintf("%d", parent)
 	}
 
-	// For now, don't load links unless continuing a comment thread.
-	isLink := author == "" && content == ""
-	if isLink {
-		return nil
+	// Reddit's ordering of the comments is only kept if requested.
+	var rank int64 = 0
+	if clientOptions.StoreRank {
+		rank = comment.Rank
 	}
 
 	var insertId int64 = -1
@@ -216,81 +514,75 @@ func (dbtx *ThreadDbTx) txPostComment(
 			parent_id,
 			timestamp,
 			continues,
-			score
+			score,
+			controversiality,
+			rank,
+			author_flair,
+			edited,
+			distinguished,
+			stickied,
+			gilded,
+			awards,
+			data,
+			state,
+			archived_content,
+			archived_author
 		)
-		VALUES ( ?, ?, ?, ?, ?, ?, ?, ?);
+		VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
 	`); err != nil {
 		return &DbError{
 			"Error creating a new comment", err.Error(),
 		}
 	} else {
-		result, exErr := statement.Exec(commentId,
-			content,
-			author,
+		result, exErr := statement.Exec(comment.Id,
+			comment.Content,
+			comment.Author,
 			threadKey,
 			parentStr,
-			timestamp,
-			loadMore,
-			score,
+			comment.Timestamp,
+			comment.Continues,
+			comment.Score,
+			comment.Controversiality,
+			rank,
+			comment.AuthorFlair,
+			comment.Edited,
+			comment.Distinguished,
+			comment.Stickied,
+			comment.Gilded,
+			comment.Awards,
+			comment.Raw,
+			comment.State,
+			comment.ArchivedContent,
+			comment.ArchivedAuthor,
 		)
 		if exErr != nil {
 			return &DbError{
-				"Error creating a new comment", err.Error(),
+				"Error creating a new comment", exErr.Error(),
 			}
 		}
 		insertId, _ = result.LastInsertId()
 	}
 
 	// Continues in another thread / page for the same post.
-	if loadMore {
-
-		// Create a new thread from the comment as part of this transaction.
-		if req, err := NewThreadRequest(sub, threadId, commentId); err != nil {
-			Log("Error requesting comment thread", err.Error())
-		} else {
-			thrBytes, err := getThread(req)
-			if err != nil {
-				Log("Error requesting comment thread", err.Error())
-			} else {
-				dbtx.txPostThread(thrBytes, sub, commentId)
+	// The page has already been fetched, store it as part of this transaction.
+	if comment.Continues {
+		if comment.Continuation != nil {
+			if err := dbtx.txPostThread(comment.Continuation); err != nil {
+				return &DbError{"Error creating comment thread", err.Error()}
 			}
 		}
+		return nil
+	}
 
-	} else if replCount := replies.Get("#").Int(); replies.Exists() && replies.IsArray() && replCount > 0 {
-		for i := 0; i < int(replCount); i++ {
-			bubbledError := dbtx.txPostComment(
-				replies.Get(fmt.Sprintf("%d", i)),
-				threadId,
-				threadKey,
-				sub,
-				int(insertId),
-				currentDepth+1,
-				maxDepth,
-			)
-			if bubbledError != nil {
-				return bubbledError
-			}
+	for _, reply := range comment.Replies {
+		if bubbledError := dbtx.txPostComment(reply, threadKey, int(insertId)); bubbledError != nil {
+			return bubbledError
 		}
 	}
 	return nil
 }
 
-func (dbtx *ThreadDbTx) txPostThread(data []byte, sub string, fromReply string) error {
-
-	// Add first post as thread.
-	thrBody := gjson.GetBytes(data, "0.data.children.0.data.selftext_html").String()
-	thrBodyLink := gjson.GetBytes(data, "0.data.children.0.data.url_overridden_by_dest").String()
-
-	thrId := gjson.GetBytes(data, "0.data.children.0.data.id").String()
-	thrTitle := gjson.GetBytes(data, "0.data.children.0.data.title").String()
-	thrAuthor := gjson.GetBytes(data, "0.data.children.0.data.author").String()
-	thrRepliesNum := gjson.GetBytes(data, "0.data.children.0.data.num_comments").Int()
-	thrTimestamp := gjson.GetBytes(data, "0.data.children.0.data.created").Int()
-
-	// If link is internal.
-	if strings.HasPrefix(thrBodyLink, "/") {
-		thrBodyLink = "https://reddit.com" + thrBodyLink
-	}
+func (dbtx *ThreadDbTx) txPostThread(page *ThreadPage) error {
 
 	// TODO overwrite if previous older version exists.
 	thrStmnt, stmntErr := dbtx.tx.Prepare(`
@@ -304,57 +596,72 @@ func (dbtx *ThreadDbTx) txPostThread(data []byte, sub string, fromReply string)
 			author,
 			sub,
 			timestamp,
-			archive_timestamp
+			archive_timestamp,
+			link_flair,
+			author_flair,
+			edited,
+			distinguished,
+			stickied,
+			locked,
+			removed_by_category,
+			upvote_ratio,
+			gilded,
+			awards,
+			crosspost_parent,
+			data
 		)
-		VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ?, ? );
+		VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? );
 	`)
 
 	if stmntErr != nil || thrStmnt == nil {
 		Log(
 			"Error preparing new thread insert query", stmntErr.Error(),
 		).Error()
-		return &DbError{}
+		return &DbError{"Error preparing new thread insert query", stmntErr.Error()}
 	}
 
 	insertRes, thrExcErr := thrStmnt.Exec(
-		thrId,
-		fromReply,
-		thrRepliesNum,
-		thrTitle,
-		thrBody,
-		thrBodyLink,
-		thrAuthor,
-		sub,
-		thrTimestamp,
-		time.Now().Unix(),
+		page.Post.Id,
+		page.FromReply,
+		page.Post.RepliesNum,
+		page.Post.Title,
+		page.Post.Content,
+		page.Post.ContentLink,
+		page.Post.Author,
+		page.Sub,
+		page.Post.Timestamp,
+		dbtx.timestamp,
+		page.Post.LinkFlair,
+		page.Post.AuthorFlair,
+		page.Post.Edited,
+		page.Post.Distinguished,
+		page.Post.Stickied,
+		page.Post.Locked,
+		page.Post.RemovedByCategory,
+		page.Post.UpvoteRatio,
+		page.Post.Gilded,
+		page.Post.Awards,
+		page.Post.CrosspostParent,
+		page.Post.Raw,
 	)
 	if thrExcErr != nil || insertRes == nil {
 		Log(
 			"Error executing new thread insert query", thrExcErr.Error(),
 		).Error()
-		return &DbError{}
+		return &DbError{"Error executing new thread insert query", thrExcErr.Error()}
 	}
 
 	thrKey, _ := insertRes.LastInsertId()
 
-	Log("Created a new thread.", fmt.Sprintf("ID %s", thrId)).Info()
+	Log("Created a new thread.", fmt.Sprintf("ID %s", page.Post.Id)).Info()
 
-	comments := gjson.GetBytes(data, "1.data.children")
-	for i := 0; i < int(comments.Get("#").Int()); i++ {
-		bubbledError := dbtx.txPostComment(
-			comments.Get(fmt.Sprintf("%d", i)),
-			thrId,
-			thrKey,
-			sub,
-			-1,
-			0,
-			100,
-		)
+	for _, comment := range page.Comments {
+		bubbledError := dbtx.txPostComment(comment, thrKey, -1)
 		if bubbledError != nil {
 			Log(
 				bubbledError.message, bubbledError.details,
 			).Error()
-			return &DbError{}
+			return bubbledError
 		}
 	}
 
@@ -366,6 +673,8 @@ type ThreadDbTx struct {
 	dbConnection *sql.DB
 	tx           *sql.Tx
 	upsert       bool
+	timestamp    int64 // Archive time of the rows written.
+	snapshotId   int64 // Snapshot the rows are written with.
 }
 
 func NewTransaction(upsert bool) (*ThreadDbTx, error) {
@@ -382,9 +691,26 @@ func NewTransaction(upsert bool) (*ThreadDbTx, error) {
 		db,
 		tx,
 		upsert,
+		time.Now().Unix(),
+		0,
 	}, nil
 }
 
+// Run a single write statement in a transaction of its own.
+func execTransaction(query string, args ...interface{}) (sql.Result, error) {
+	tx, err := NewTransaction(false)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.tx.Exec(query, args...)
+	if err != nil {
+		tx.rollback()
+		return nil, err
+	}
+	tx.done()
+	return res, nil
+}
+
 func (dbtx *ThreadDbTx) rollback() {
 	dbtx.tx.Rollback()
 	dbtx.dbConnection.Close()
@@ -394,15 +720,14 @@ func (dbtx *ThreadDbTx) done() {
 	dbtx.dbConnection.Close()
 }
 
-func GetArchiveQuery(threadId string, replyId string) (*ArchiveTmpl, error) {
-
-	//
-	// Query thread, get highest level thread if no replyId specified, else start from reply.
-	//
-
+// Query the thread, or the continuing page starting from replyId if it is not empty.
+// Returns the key of the thread row and a template without replies, nil if not found.
+func queryThread(threadId string, replyId string) (int, *ThreadTmpl, int, error) {
 	rows, qerr := dbReadOnly.Query(`
 		SELECT
-		id, replies_num, sub, title, content, content_link, author, timestamp, archive_timestamp
+		id, replies_num, sub, title, content, content_link, author, timestamp, archive_timestamp,
+		link_flair, author_flair, edited, distinguished, stickied, locked,
+		removed_by_category, upvote_ratio, gilded, awards, crosspost_parent
 		FROM threads
 		WHERE thread_id = ? AND continuing_reply = ?
 		ORDER BY archive_timestamp DESC
@@ -412,16 +737,19 @@ func GetArchiveQuery(threadId string, replyId string) (*ArchiveTmpl, error) {
 		replyId,
 	)
 	if qerr != nil {
-		return nil, LogE(&DbError{"Error with thread query", qerr.Error()})
+		return 0, nil, 0, LogE(&DbError{"Error with thread query", qerr.Error()})
 	}
 
 	rows.Next()
 
 	thrNumId := 0
 	thrRepliesC := 0
-	thrTmpl := ThreadTmpl{}
+	thrTmpl := ThreadTmpl{ThreadId: threadId}
 	thrTimestamp := 0
 	arcTimestamp := 0
+	var edited int64
+	var upvoteRatio float64
+	awards := ""
 	rows.Scan(
 		&thrNumId,
 		&thrRepliesC,
@@ -432,131 +760,415 @@ func GetArchiveQuery(threadId string, replyId string) (*ArchiveTmpl, error) {
 		&thrTmpl.Author,
 		&thrTimestamp,
 		&arcTimestamp,
+		&thrTmpl.LinkFlair,
+		&thrTmpl.AuthorFlair,
+		&edited,
+		&thrTmpl.Distinguished,
+		&thrTmpl.Stickied,
+		&thrTmpl.Locked,
+		&thrTmpl.RemovedBy,
+		&upvoteRatio,
+		&thrTmpl.Gilded,
+		&awards,
+		&thrTmpl.CrosspostParent,
 	)
 
 	rows.Close()
 
 	// Nothing found.
 	if arcTimestamp == 0 {
-		return nil, nil
+		return 0, nil, 0, nil
 	}
 
 	thrTmpl.Time = time.Unix(int64(thrTimestamp), 0).Format("02 Jan 2006")
+	thrTmpl.created = int64(thrTimestamp)
+	thrTmpl.repliesNum = thrRepliesC
+	thrTmpl.Edited = formatEdited(edited)
+	thrTmpl.UpvotePercent = int(upvoteRatio*100 + 0.5)
+	thrTmpl.Awards = readAwards(awards)
+	return thrNumId, &thrTmpl, arcTimestamp, nil
+}
 
-	//
-	// Query each comment and its replies starting from the original post.
-	//
-
-	queue := []struct {
-		id string
-		p  *CommentTmpl
-	}{
-		{"NULL", nil}}
+const commentColumns = `id, comment_id, content, author, timestamp, continues, score, controversiality, rank,
+	author_flair, edited, distinguished, stickied, gilded, awards, state, archived_content, archived_author`
 
-	for len(queue) > 0 {
+func scanComment(rows *sql.Rows, threadId string) (*CommentTmpl, int) {
+	copmTmpl := &CommentTmpl{}
+	rId := -1
+	var edited int64
+	awards := ""
+	rows.Scan(
+		&rId,
+		&copmTmpl.CommentId,
+		&copmTmpl.CommentContent,
+		&copmTmpl.Author,
+		&copmTmpl.timestamp,
+		&copmTmpl.Continues,
+		&copmTmpl.score,
+		&copmTmpl.controversiality,
+		&copmTmpl.rank,
+		&copmTmpl.AuthorFlair,
+		&edited,
+		&copmTmpl.Distinguished,
+		&copmTmpl.Stickied,
+		&copmTmpl.Gilded,
+		&awards,
+		&copmTmpl.State,
+		&copmTmpl.ArchivedContent,
+		&copmTmpl.ArchivedAuthor,
+	)
+	copmTmpl.Edited = formatEdited(edited)
+	copmTmpl.Awards = readAwards(awards)
+	copmTmpl.rowId = rId
+	copmTmpl.Score = fmt.Sprintf("%d", copmTmpl.score)
+	copmTmpl.Time = time.Unix(copmTmpl.timestamp, 0).Format("02 Jan 2006")
+	copmTmpl.ThreadId = threadId
+	return copmTmpl, rId
+}
 
-		currentParentId := queue[0].id
-		currentParent := queue[0].p
-		queue = queue[1:]
+// Query the direct replies to the comment with row ID parentId.
+// Top level comments of the thread have "NULL" as their parent.
+func queryChildren(threadKey int, threadId string, parentId string) ([]*CommentTmpl, error) {
+	children := []*CommentTmpl{}
+	rows, qerr := dbReadOnly.Query(`
+		SELECT `+commentColumns+`
+		FROM comments
+		WHERE thread_key = ? AND parent_id = ?
+		`, threadKey, parentId,
+	)
+	if qerr != nil {
+		return nil, LogE(&DbError{"Error with comment query", qerr.Error()})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		copmTmpl, _ := scanComment(rows, threadId)
+		children = append(children, copmTmpl)
+	}
+	return children, nil
+}
 
-		rows, qerr = dbReadOnly.Query(`
-			SELECT id, comment_id, content, author, timestamp, continues, score
-			FROM comments
-			WHERE thread_key = ? AND parent_id = ?
-			ORDER BY score DESC
-			`, thrNumId, currentParentId,
-		)
-		if qerr != nil {
-			return nil, LogE(&DbError{"Error with comment query", qerr.Error()})
-		}
-		for rows.Next() {
-			copmTmpl := &CommentTmpl{}
-			rId := -1
-			rTimestamp := 0
-			rows.Scan(
-				&rId,
-				&copmTmpl.CommentId,
-				&copmTmpl.CommentContent,
-				&copmTmpl.Author,
-				&rTimestamp,
-				&copmTmpl.Continues,
-				&copmTmpl.Score,
-			)
-			copmTmpl.Time = time.Unix(int64(rTimestamp), 0).Format("02 Jan 2006")
-			copmTmpl.ThreadId = threadId
-			queue = append(queue, struct {
-				id string
-				p  *CommentTmpl
-			}{fmt.Sprintf("%d", rId), copmTmpl})
-			if currentParent == nil {
-				thrTmpl.Replies = append(thrTmpl.Replies, copmTmpl)
-			} else {
-				currentParent.Children = append(currentParent.Children, copmTmpl)
+// Query the replies to the given comments, down to `depth` levels below them.
+func queryReplies(threadKey int, threadId string, parents []*CommentTmpl, depth int) error {
+	level := parents
+	for d := 0; d < depth && len(level) > 0; d++ {
+		next := []*CommentTmpl{}
+		for _, parent := range level {
+			if parent.Continues {
+				continue
 			}
+			children, err := queryChildren(threadKey, threadId, fmt.Sprintf("%d", parent.rowId))
+			if err != nil {
+				return err
+			}
+			parent.Children = children
+			next = append(next, children...)
+		}
+		level = next
+	}
+	return nil
+}
+
+// Replies nested deeper than `depth` levels are left out of the page, replaced
+// with a link to the subtree. The given comments are on the first level.
+func cutDepth(comments []*CommentTmpl, depth int) {
+	if depth <= 0 {
+		return
+	}
+	level := comments
+	for d := 1; d < depth && len(level) > 0; d++ {
+		next := []*CommentTmpl{}
+		for _, c := range level {
+			next = append(next, c.Children...)
 		}
-		rows.Close()
+		level = next
+	}
+	for _, c := range level {
+		c.MoreReplies = len(c.Children)
+		c.Children = nil
 	}
+}
 
-	t := templates.Lookup("thread.tmpl").Lookup("thread")
+// Levels of replies loaded for a page. One level more than shown is queried to
+// know which comments have more replies.
+func pageQueryDepth() int {
+	if routerOptions.PageDepth <= 0 {
+		return MAX_COMMENT_DEPTH
+	}
+	return routerOptions.PageDepth
+}
+
+func renderArchive(thrTmpl *ThreadTmpl, tmplName string, arcTimestamp int, replyId string, sortOrder string) *ArchiveTmpl {
+	sortComments(thrTmpl.Replies, sortOrder)
+
+	// Errors are logged, the page is rendered with the original links.
+	mediaItems, _ := queryThreadMedia(thrTmpl.ThreadId)
+	thrTmpl.Images = postImages(mediaItems)
+	thrTmpl.Video = postVideo(mediaItems)
+	thrTmpl.Poll, _ = queryPoll(thrTmpl.ThreadId)
+	thrTmpl.LinksTo, thrTmpl.LinkedFrom, _ = queryThreadLinks(thrTmpl.ThreadId)
+
+	t := templates.Lookup("thread.tmpl").Lookup(tmplName)
 	thrBuf := new(bytes.Buffer)
 	t.Execute(thrBuf, thrTmpl)
+	threadHtml := mediaReplacer(mediaItems).Replace(thrBuf.String())
 
-	arcTs := ArchiveTmpl{
-		time.Unix(int64(arcTimestamp), 0).Format("02 Jan 2006"),
-		threadId,
-		thrTmpl.ThreadTitle,
-		replyId,
-		thrTmpl.Subreddit,
-		template.HTML(html.UnescapeString(thrBuf.String())),
+	canonical := "/" + thrTmpl.ThreadId
+	if tmplName == "permalink" {
+		canonical += "/c/" + replyId
+	} else if replyId != "" {
+		canonical += "-" + replyId
+	}
+	image := ""
+	if len(thrTmpl.Images) > 0 {
+		image = thrTmpl.Images[0]
 	}
 
-	return &arcTs, nil
+	return &ArchiveTmpl{
+		ArchiveTime:   time.Unix(int64(arcTimestamp), 0).Format("02 Jan 2006"),
+		ThreadId:      thrTmpl.ThreadId,
+		ThreadTitle:   thrTmpl.ThreadTitle,
+		ReplyId:       replyId,
+		Subreddit:     thrTmpl.Subreddit,
+		ThreadHTML:    template.HTML(html.UnescapeString(threadHtml)),
+		Sort:          readSortOrder(sortOrder),
+		SortOrders:    sortOrders,
+		PageCount:     1,
+		CanonicalPath: canonical,
+		Description:   pageDescription(thrTmpl),
+		Image:         image,
+		Author:        thrTmpl.Author,
+		created:       thrTmpl.created,
+		archived:      int64(arcTimestamp),
+		repliesNum:    thrTmpl.repliesNum,
+	}
 }
 
-func archiveThread(sub string, data []byte) error {
+// Query a page of the thread. Pages hold up to the configured amount of top
+// level comments, each with its replies down to the configured depth.
+func GetArchiveQuery(threadId string, replyId string, sortOrder string, page int) (*ArchiveTmpl, error) {
+
+	//
+	// Query thread, get highest level thread if no replyId specified, else start from reply.
+	//
+
+	thrNumId, thrTmpl, arcTimestamp, err := queryThread(threadId, replyId)
+	if err != nil || thrTmpl == nil {
+		return nil, err
+	}
+
+	//
+	// Query the top level comments and pick the ones on the requested page.
+	//
+
+	topLevel, err := queryChildren(thrNumId, threadId, "NULL")
+	if err != nil {
+		return nil, err
+	}
+	sortComments(topLevel, sortOrder)
+
+	perPage := routerOptions.PageComments
+	if perPage <= 0 {
+		perPage = len(topLevel)
+	}
+	pageCount := 1
+	if perPage > 0 {
+		pageCount = (len(topLevel) + perPage - 1) / perPage
+	}
+	if page < 0 || (page > 0 && page >= pageCount) {
+		return nil, nil
+	}
+	if perPage > 0 {
+		topLevel = topLevel[page*perPage:]
+		if len(topLevel) > perPage {
+			topLevel = topLevel[:perPage]
+		}
+	}
+
+	//
+	// Query replies to the comments on the page.
+	//
+
+	if err = queryReplies(thrNumId, threadId, topLevel, pageQueryDepth()); err != nil {
+		return nil, err
+	}
+	cutDepth(topLevel, routerOptions.PageDepth)
+	thrTmpl.Replies = topLevel
+
+	arch := renderArchive(thrTmpl, "thread", arcTimestamp, replyId, sortOrder)
+	if pageCount > 1 {
+		arch.Page = page
+		arch.PageCount = pageCount
+	}
+	if page > 0 {
+		arch.CanonicalPath += fmt.Sprintf("?page=%d", page)
+	}
+	return arch, nil
+}
+
+// Location of a stored comment.
+type commentRow struct {
+	id              int
+	commentId       string
+	parentId        string
+	threadKey       int
+	continuingReply string
+}
+
+func queryCommentRow(query string, args ...interface{}) (*commentRow, error) {
+	rows, qerr := dbReadOnly.Query(`
+		SELECT c.id, c.comment_id, c.parent_id, c.thread_key, t.continuing_reply
+		FROM comments c JOIN threads t ON c.thread_key = t.id
+		`+query, args...,
+	)
+	if qerr != nil {
+		return nil, LogE(&DbError{"Error with comment query", qerr.Error()})
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, nil
+	}
+	row := commentRow{}
+	rows.Scan(&row.id, &row.commentId, &row.parentId, &row.threadKey, &row.continuingReply)
+	return &row, nil
+}
+
+// Parent of a stored comment. The first comment of a continuation page is also
+// stored on the page it continues from, its parent is found there.
+func queryParentRow(threadId string, row *commentRow) (*commentRow, error) {
+	if row.parentId != "NULL" {
+		return queryCommentRow(`WHERE c.id = ?`, row.parentId)
+	}
+	if row.continuingReply == "" || row.continuingReply != row.commentId {
+		return nil, nil
+	}
+	continued, err := queryCommentRow(`
+		WHERE t.thread_id = ? AND c.comment_id = ? AND c.continues = 1 AND t.id != ?
+		LIMIT 1`, threadId, row.commentId, row.threadKey,
+	)
+	if err != nil || continued == nil {
+		return nil, err
+	}
+	return queryParentRow(threadId, continued)
+}
+
+func queryCommentTmpl(threadId string, rowId int) (*CommentTmpl, error) {
+	rows, qerr := dbReadOnly.Query(`
+		SELECT `+commentColumns+`
+		FROM comments
+		WHERE id = ?
+		`, rowId,
+	)
+	if qerr != nil {
+		return nil, LogE(&DbError{"Error with comment query", qerr.Error()})
+	}
+	defer rows.Close()
+	rows.Next()
+	copmTmpl, _ := scanComment(rows, threadId)
+	return copmTmpl, nil
+}
+
+// Query a single comment with all of its replies and up to `context` of its
+// parents. The comment may be on any of the pages stored for the thread.
+func GetCommentQuery(threadId string, commentId string, context int, sortOrder string) (*ArchiveTmpl, error) {
+
+	_, thrTmpl, arcTimestamp, err := queryThread(threadId, "")
+	if err != nil || thrTmpl == nil {
+		return nil, err
+	}
+
+	// Prefer the copy of the comment that has its replies stored with it.
+	row, err := queryCommentRow(`
+		WHERE t.thread_id = ? AND c.comment_id = ?
+		ORDER BY c.continues ASC, t.archive_timestamp DESC
+		LIMIT 1`, threadId, commentId,
+	)
+	if err != nil || row == nil {
+		return nil, err
+	}
+
+	selected, err := queryCommentTmpl(threadId, row.id)
+	if err != nil {
+		return nil, err
+	}
+	selected.Highlighted = true
+	if err = queryReplies(row.threadKey, threadId, []*CommentTmpl{selected}, pageQueryDepth()); err != nil {
+		return nil, err
+	}
+	cutDepth([]*CommentTmpl{selected}, routerOptions.PageDepth)
+
+	root := selected
+	for i := 0; i < context; i++ {
+		if row, err = queryParentRow(threadId, row); err != nil {
+			return nil, err
+		} else if row == nil {
+			break
+		}
+		parent, err := queryCommentTmpl(threadId, row.id)
+		if err != nil {
+			return nil, err
+		}
+		parent.Continues = false
+		parent.Children = []*CommentTmpl{root}
+		root = parent
+	}
+	thrTmpl.Replies = []*CommentTmpl{root}
+
+	return renderArchive(thrTmpl, "permalink", arcTimestamp, commentId, sortOrder), nil
+}
+
+// Whether the thread of the API response is archived already with the same
+// or a higher number of replies, and if not, whether it replaces an earlier
+// archive of the thread.
+func checkArchived(data []byte) (archived bool, upsert bool) {
 
 	thrId := gjson.GetBytes(data, "0.data.children.0.data.id").String()
 	thrRepliesNum := gjson.GetBytes(data, "0.data.children.0.data.num_comments").Int()
 
-	// Check that thread (with same or higher amount of replies) is not already archived.
-	rows, _ := dbReadOnly.Query(`
+	existingReplies := int64(0)
+	if err := dbReadOnly.QueryRow(`
 		SELECT replies_num FROM threads
 			WHERE thread_id = ? AND continuing_reply = ""
 			LIMIT 1
 		`,
 		thrId,
-		thrRepliesNum,
-	)
+	).Scan(&existingReplies); err != nil {
+		return false, false
+	}
+	if existingReplies >= thrRepliesNum {
+		return true, false
+	}
+	Log(
+		"Updating existing thread.",
+		fmt.Sprintf("New replies: %d - Previous replies: %d", thrRepliesNum, existingReplies),
+	).Debug()
+	return false, true
+}
 
-	upsert := false
-	if rows.Next() {
-		existingReplies := 0
-		rows.Scan(&existingReplies)
-		if existingReplies >= int(thrRepliesNum) {
-			rows.Close()
-			return &DbError{"Thread is already archived", "Same thread with equal number or more replies exists"}
-		} else {
-			Log(
-				"Updating existing thread.",
-				fmt.Sprintf("New replies: %d - Previous replies: %d", thrRepliesNum, existingReplies),
-			).Debug()
-			upsert = true
-		}
+// Fetch the continuation pages of the thread and write it, along with the
+// threads it links to if enabled.
+func storeArchive(sub string, data []byte, header string, upsert bool) error {
+	page := fetchArchive(sub, data, header, fetchRedditPage)
+	if err := writeArchive(page, upsert); err != nil {
+		return err
+	}
+	if clientOptions.ArchiveLinked {
+		archiveLinked(page, fetchRedditPage)
+	}
+	return nil
+}
+
+func archiveThread(sub string, data []byte, header string) error {
+
+	// Check that thread (with same or higher amount of replies) is not already archived.
+	archived, upsert := checkArchived(data)
+	if archived {
+		return &DbError{"Thread is already archived", "Same thread with equal number or more replies exists"}
 	}
-	rows.Close()
 
 	// Archive thread in another goroutine, return before for sending response.
-	go func() {
-		tx, txerr := NewTransaction(upsert)
-		if txerr != nil {
-			Log("Error starting transaction", txerr.Error()).Error()
-		}
-		if tx.txPostThread(data, sub, "") != nil {
-			tx.rollback()
-		} else {
-			tx.done()
-		}
-	}()
+	// Continuation pages are all fetched before the write transaction is opened,
+	// so the database is only locked for as long as it takes to write the tree.
+	go storeArchive(sub, data, header, upsert)
 
 	return nil
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCommentQuery(t *testing.T) {
+	useTestDatabase(t)
+
+	root := parseThreadPage(testPageJson("abc123",
+		testCommentJson("c1", testContinuedJson("c2"), testCommentJson("c3")),
+		testCommentJson("c4"),
+	), "test", "")
+	resolveContinuations(root, func(sub, threadId, commentId string) ([]byte, string, error) {
+		return testPageJson(threadId,
+			testCommentJson(commentId, testCommentJson("c5", testCommentJson("c6", testCommentJson("c7")))),
+		), "", nil
+	}, 1)
+	assert.Nil(t, writeArchive(root, false))
+
+	// Comment on a continuation page, parents reach back to the first page.
+	arch, err := GetCommentQuery("abc123", "c6", 3, "")
+	assert.Nil(t, err)
+	if assert.NotNil(t, arch) {
+		html := string(arch.ThreadHTML)
+		for _, id := range []string{"c1", "c2", "c5", "c6", "c7"} {
+			assert.Contains(t, html, "comment "+id+"<")
+		}
+		assert.NotContains(t, html, "comment c3<")
+		assert.NotContains(t, html, "comment c4<")
+		assert.Contains(t, html, `class="comment highlighted" id="c6"`)
+		assert.Equal(t, "c6", arch.ReplyId)
+	}
+
+	arch, _ = GetCommentQuery("abc123", "c6", 1, "")
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), "comment c5<")
+		assert.NotContains(t, string(arch.ThreadHTML), "comment c2<")
+	}
+
+	// Comment with continued replies resolves to the page holding them.
+	arch, _ = GetCommentQuery("abc123", "c2", 0, "")
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), "comment c5<")
+		assert.NotContains(t, string(arch.ThreadHTML), "Continue ->")
+	}
+
+	arch, err = GetCommentQuery("abc123", "missing", 0, "")
+	assert.Nil(t, err)
+	assert.Nil(t, arch)
+}
+
+func TestGetArchiveQueryPages(t *testing.T) {
+	useTestDatabase(t)
+	previous := routerOptions
+	routerOptions.PageComments = 2
+	routerOptions.PageDepth = 2
+	t.Cleanup(func() { routerOptions = previous })
+
+	root := parseThreadPage(testPageJson("abc123",
+		testCommentJson("c1", testCommentJson("c11", testCommentJson("c111", testCommentJson("c1111")))),
+		testCommentJson("c2"),
+		testCommentJson("c3"),
+		testCommentJson("c4"),
+		testCommentJson("c5"),
+	), "test", "")
+	assert.Nil(t, writeArchive(root, false))
+
+	arch, err := GetArchiveQuery("abc123", "", "old", 0)
+	assert.Nil(t, err)
+	if assert.NotNil(t, arch) {
+		html := string(arch.ThreadHTML)
+		assert.Equal(t, 3, arch.PageCount)
+		assert.Contains(t, html, "comment c11<")
+		assert.NotContains(t, html, "comment c111<")
+		assert.Contains(t, html, `href="/abc123/c/c11">1 more replies`)
+		assert.NotContains(t, html, "comment c3<")
+	}
+
+	arch, _ = GetArchiveQuery("abc123", "", "old", 2)
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), "comment c5<")
+		assert.Equal(t, -1, arch.NextPage())
+	}
+
+	arch, err = GetArchiveQuery("abc123", "", "old", 3)
+	assert.Nil(t, err)
+	assert.Nil(t, arch)
+
+	// Subtree route continues where the page was cut.
+	arch, _ = GetCommentQuery("abc123", "c11", 0, "")
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), "comment c111<")
+		assert.NotContains(t, string(arch.ThreadHTML), "comment c1111<")
+	}
+}
+
+func TestArchiveMetadata(t *testing.T) {
+	useTestDatabase(t)
+
+	post := testPostJson("abc123", 1)
+	post["link_flair_text"] = "Discussion"
+	post["edited"] = 1650003600.0
+	post["stickied"] = true
+	post["locked"] = true
+	post["upvote_ratio"] = 0.87
+	post["crosspost_parent"] = "t3_xyz789"
+	post["all_awardings"] = []testJson{{"name": "Helpful", "count": 2}}
+	comment := testCommentJson("c1", testCommentJson("c2"))
+	comment["data"].(testJson)["distinguished"] = "moderator"
+	comment["data"].(testJson)["author_flair_text"] = "Regular"
+	comment["data"].(testJson)["edited"] = false
+	comment["data"].(testJson)["custom_field"] = "kept"
+
+	root := parseThreadPage(testPostPageJson(post, comment), "test", "")
+	assert.Equal(t, int64(1650003600), root.Post.Edited)
+	assert.Equal(t, "xyz789", root.Post.CrosspostParent)
+	assert.Equal(t, int64(0), root.Comments[0].Edited)
+	assert.Nil(t, writeArchive(root, false))
+
+	arch, _ := GetArchiveQuery("abc123", "", "", 0)
+	if assert.NotNil(t, arch) {
+		html := string(arch.ThreadHTML)
+		assert.Contains(t, html, `<span class="flair">Discussion</span>`)
+		assert.Contains(t, html, "87% upvoted")
+		assert.Contains(t, html, "Helpful ×2")
+		assert.Contains(t, html, "[moderator]")
+		assert.Contains(t, html, `<span class="flair">Regular</span>`)
+		assert.Contains(t, html, "xyz789")
+	}
+
+	// Fields not parsed out are queryable from the stored objects.
+	custom := ""
+	dbReadOnly.QueryRow(`
+		SELECT json_extract(data, '$.custom_field') FROM comments WHERE comment_id = 'c1'
+	`).Scan(&custom)
+	assert.Equal(t, "kept", custom)
+	hasReplies := true
+	dbReadOnly.QueryRow(`
+		SELECT json_type(data, '$.replies') IS NOT NULL FROM comments WHERE comment_id = 'c1'
+	`).Scan(&hasReplies)
+	assert.False(t, hasReplies)
+	ratio := 0.0
+	dbReadOnly.QueryRow(`
+		SELECT json_extract(data, '$.upvote_ratio') FROM threads WHERE thread_id = 'abc123'
+	`).Scan(&ratio)
+	assert.Equal(t, 0.87, ratio)
+}
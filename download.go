@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/ilmari-h/bettit/media"
+)
+
+//
+// Archive pages downloaded as one HTML file that works offline: styles are
+// inlined, archived images embedded and continuation pages included.
+//
+
+// Style sheets of archive pages, inlined in downloads.
+var downloadStyles = []string{"page.css", "navbar.css"}
+
+func readDownloadStyles() (template.CSS, error) {
+	styles := ""
+	for _, name := range downloadStyles {
+		data, err := ioutil.ReadFile(filepath.Join("./public", name))
+		if err != nil {
+			return "", err
+		}
+		styles += string(data) + "\n"
+	}
+	return template.CSS(styles), nil
+}
+
+// Replaces links to archived media with the files as data URIs. Media other
+// than images link to the original instead.
+func mediaDataReplacer(items []media.Item) *strings.Replacer {
+	replacements := []string{}
+	for _, item := range items {
+		if !strings.HasPrefix(item.Mime, "image/") {
+			replacements = append(replacements, mediaRoute(item), item.Url)
+			continue
+		}
+		file, err := mediaStore.Open(item.Hash)
+		if err != nil {
+			replacements = append(replacements, mediaRoute(item), item.Url)
+			continue
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			replacements = append(replacements, mediaRoute(item), item.Url)
+			continue
+		}
+		replacements = append(replacements,
+			mediaRoute(item), "data:"+item.Mime+";base64,"+base64.StdEncoding.EncodeToString(data),
+		)
+	}
+	return strings.NewReplacer(replacements...)
+}
+
+// Query the whole thread as one page, nil if it is not archived.
+func GetDownloadQuery(threadId string, sortOrder string) (*DownloadTmpl, error) {
+	key, thrTmpl, arcTimestamp, err := queryThread(threadId, "")
+	if err != nil || thrTmpl == nil {
+		return nil, err
+	}
+	comments, err := queryChildren(key, threadId, "NULL")
+	if err != nil {
+		return nil, err
+	}
+	if err := queryReplies(key, threadId, comments, MAX_COMMENT_DEPTH); err != nil {
+		return nil, err
+	}
+	if err := mergeContinuations(threadId, comments); err != nil {
+		return nil, err
+	}
+	thrTmpl.Replies = comments
+
+	styles, err := readDownloadStyles()
+	if err != nil {
+		return nil, LogE(&DbError{"Error reading style sheets", err.Error()})
+	}
+	arch := renderArchive(thrTmpl, "thread", arcTimestamp, "", sortOrder)
+	if mediaStore != nil {
+		items, _ := queryThreadMedia(threadId)
+		arch.ThreadHTML = template.HTML(mediaDataReplacer(items).Replace(string(arch.ThreadHTML)))
+	}
+	return &DownloadTmpl{ArchiveTmpl: arch, Styles: styles}, nil
+}
+
+func writeDownload(w io.Writer, download *DownloadTmpl) error {
+	return templates.Lookup("thread.tmpl").Lookup("download").Execute(w, download)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload(t *testing.T) {
+	useTestDatabase(t)
+	useTestMedia(t)
+	LoadTemplates()
+
+	img := new(bytes.Buffer)
+	png.Encode(img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img.Bytes())
+	}))
+	defer server.Close()
+
+	post := testPostJson("abc123", 2)
+	post["url_overridden_by_dest"] = server.URL + "/post.png"
+	root := parseThreadPage(testPostPageJson(post, testCommentJson("c1"), testContinuedJson("c2")), "test", "")
+	resolveContinuations(root, func(sub, threadId, commentId string) ([]byte, string, error) {
+		return testPageJson(threadId, testCommentJson(commentId, testCommentJson("c3"))), "", nil
+	}, 1)
+	fetchMedia(root, 1)
+	assert.Nil(t, writeArchive(root, false))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/:threadid", routeGetPage)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/abc123?download=1", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `attachment; filename="abc123.html"`, w.Header().Get("Content-Disposition"))
+
+	page := w.Body.String()
+	assert.NotContains(t, page, `href="/res/`)
+	assert.Contains(t, page, ".toggle-button {")
+	assert.Contains(t, page, `<img src="data:image/png;base64,`+base64.StdEncoding.EncodeToString(img.Bytes())+`"`)
+	assert.NotContains(t, page, "/media/")
+	// The continuation page is included in place of the link to it.
+	assert.NotContains(t, page, `href="/abc123-c2"`)
+	assert.Contains(t, page, `<details class="continuation">`)
+	assert.Contains(t, page, `id="c3"`)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/def456?download=1", nil))
+	assert.Equal(t, 404, w.Code)
+}
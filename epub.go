@@ -0,0 +1,188 @@
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"io"
+	"strings"
+	"time"
+)
+
+//
+// EPUB 3 books of archived threads for reading on e-readers. The post is the
+// first chapter and every top-level comment with its replies a chapter of its
+// own.
+//
+
+// Length of the comment excerpt in chapter titles.
+const EPUB_TITLE_EXCERPT = 60
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const epubStyle = `body { font-family: serif; margin: 0 0.5em; }
+.details { font-size: 0.8em; color: #555; margin: 1em 0 0.3em 0; }
+.reply { margin-left: 0.8em; padding-left: 0.6em; border-left: 1px solid #999; }
+.tombstone { font-style: italic; }
+blockquote { margin: 0.5em 1em; padding-left: 0.5em; border-left: 3px solid #ccc; }
+pre { white-space: pre-wrap; }
+`
+
+type epubChapter struct {
+	file  string
+	title string
+	body  string
+}
+
+func epubXhtml(title string, body string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops" lang="en" xml:lang="en">
+<head>
+<meta charset="utf-8"/>
+<title>` + html.EscapeString(title) + `</title>
+<link rel="stylesheet" type="text/css" href="style.css"/>
+</head>
+<body>
+` + body + `
+</body>
+</html>
+`
+}
+
+// The comment and its replies, each reply nested in its parent.
+func epubComment(c *ExportComment) string {
+	body := `<div class="details">` + html.EscapeString(c.header()) + "</div>\n"
+	body += htmlToXhtml(c.BodyHtml) + "\n"
+	if c.ArchivedBody != "" {
+		body += `<div class="tombstone"><div class="details">Archived before it was ` + c.State + ":</div>\n"
+		body += htmlToXhtml(c.ArchivedBody) + "</div>\n"
+	}
+	for i := range c.Replies {
+		body += `<div class="reply">` + "\n" + epubComment(&c.Replies[i]) + "</div>\n"
+	}
+	return body
+}
+
+func epubChapterTitle(n int, c *ExportComment) string {
+	title := fmt.Sprintf("%d. u/%s", n, c.Author)
+	excerpt := strings.Join(strings.Fields(htmlToText(c.BodyHtml)), " ")
+	if len([]rune(excerpt)) > EPUB_TITLE_EXCERPT {
+		excerpt = string([]rune(excerpt)[:EPUB_TITLE_EXCERPT]) + "…"
+	}
+	if excerpt != "" {
+		title += ": " + excerpt
+	}
+	return title
+}
+
+func epubChapters(thread *ExportThread) []epubChapter {
+	post := fmt.Sprintf("<h1>%s</h1>\n", html.EscapeString(thread.Title))
+	post += fmt.Sprintf(`<p class="details">r/%s, posted by u/%s on %s. <a href="%s">Original thread</a>, archived on %s.</p>`+"\n",
+		html.EscapeString(thread.Subreddit), html.EscapeString(thread.Author), formatExportTime(thread.Created),
+		html.EscapeString(thread.Url), formatExportTime(thread.Archived),
+	)
+	if thread.ContentLink != "" {
+		post += fmt.Sprintf("<p><a href=\"%[1]s\">%[1]s</a></p>\n", html.EscapeString(thread.ContentLink))
+	}
+	post += htmlToXhtml(thread.ContentHtml)
+	chapters := []epubChapter{{"post.xhtml", thread.Title, post}}
+
+	for i := range thread.Comments {
+		c := &thread.Comments[i]
+		chapters = append(chapters, epubChapter{
+			file:  fmt.Sprintf("comment-%d.xhtml", i+1),
+			title: epubChapterTitle(i+1, c),
+			body:  epubComment(c),
+		})
+	}
+	return chapters
+}
+
+func epubPackage(thread *ExportThread, chapters []epubChapter) string {
+	manifest := `    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="style" href="style.css" media-type="text/css"/>
+`
+	spine := ""
+	for i, ch := range chapters {
+		manifest += fmt.Sprintf(`    <item id="ch%d" href="%s" media-type="application/xhtml+xml"/>`+"\n", i, ch.file)
+		spine += fmt.Sprintf(`    <itemref idref="ch%d"/>`+"\n", i)
+	}
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="uid" xml:lang="en">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="uid">` + html.EscapeString(thread.Url) + `</dc:identifier>
+    <dc:title>` + html.EscapeString(thread.Title) + `</dc:title>
+    <dc:creator>u/` + html.EscapeString(thread.Author) + `</dc:creator>
+    <dc:publisher>Bettit ` + APPVER + `</dc:publisher>
+    <dc:language>en</dc:language>
+    <dc:date>` + time.Unix(thread.Created, 0).UTC().Format("2006-01-02T15:04:05Z") + `</dc:date>
+    <meta property="dcterms:modified">` + time.Unix(thread.Archived, 0).UTC().Format("2006-01-02T15:04:05Z") + `</meta>
+  </metadata>
+  <manifest>
+` + manifest + `  </manifest>
+  <spine>
+` + spine + `  </spine>
+</package>
+`
+}
+
+func epubNav(chapters []epubChapter) string {
+	items := ""
+	for _, ch := range chapters {
+		items += fmt.Sprintf(`<li><a href="%s">%s</a></li>`+"\n", ch.file, html.EscapeString(ch.title))
+	}
+	return epubXhtml("Contents", `<nav epub:type="toc" id="toc">
+<h1>Contents</h1>
+<ol>
+`+items+`</ol>
+</nav>`)
+}
+
+func writeEpub(w io.Writer, thread *ExportThread) error {
+	zw := zip.NewWriter(w)
+
+	// The mimetype comes first, stored without compression or extra fields.
+	mimetype := []byte("application/epub+zip")
+	mw, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "mimetype",
+		Method:             zip.Store,
+		CRC32:              crc32.ChecksumIEEE(mimetype),
+		CompressedSize64:   uint64(len(mimetype)),
+		UncompressedSize64: uint64(len(mimetype)),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := mw.Write(mimetype); err != nil {
+		return err
+	}
+
+	chapters := epubChapters(thread)
+	files := [][2]string{
+		{"META-INF/container.xml", epubContainer},
+		{"OEBPS/content.opf", epubPackage(thread, chapters)},
+		{"OEBPS/nav.xhtml", epubNav(chapters)},
+		{"OEBPS/style.css", epubStyle},
+	}
+	for _, ch := range chapters {
+		files = append(files, [2]string{"OEBPS/" + ch.file, epubXhtml(ch.title, ch.body)})
+	}
+	for _, file := range files {
+		fw, err := zw.Create(file[0])
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, file[1]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
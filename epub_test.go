@@ -0,0 +1,145 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEpubPackage struct {
+	Version  string `xml:"version,attr"`
+	Title    string `xml:"metadata>title"`
+	Manifest []struct {
+		Id         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IdRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// Check that the document is well-formed XML.
+func assertWellFormed(t *testing.T, name string, data []byte) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return
+		}
+		if !assert.Nil(t, err, name) {
+			return
+		}
+	}
+}
+
+// Check the structure of an EPUB 3 book, returning its files by name.
+func validateTestEpub(t *testing.T, data []byte) (map[string][]byte, *testEpubPackage) {
+	// The mimetype is the first file, stored as is without extra fields.
+	assert.Equal(t, "mimetype", string(data[30:38]))
+	assert.Equal(t, uint16(zip.Store), binary.LittleEndian.Uint16(data[8:10]))
+	assert.Equal(t, uint16(0), binary.LittleEndian.Uint16(data[28:30]))
+	assert.Equal(t, "application/epub+zip", string(data[38:58]))
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if !assert.Nil(t, err) {
+		return nil, nil
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		r, _ := f.Open()
+		files[f.Name], _ = io.ReadAll(r)
+		r.Close()
+	}
+
+	container := struct {
+		Rootfiles []struct {
+			FullPath  string `xml:"full-path,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}{}
+	assert.Nil(t, xml.Unmarshal(files["META-INF/container.xml"], &container))
+	if !assert.Len(t, container.Rootfiles, 1) {
+		return nil, nil
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	pkg := &testEpubPackage{}
+	assert.Nil(t, xml.Unmarshal(files[opfPath], pkg))
+	assert.Equal(t, "3.0", pkg.Version)
+
+	// Every item in the manifest exists, and every document in it is well-formed.
+	ids := map[string]bool{}
+	navs := 0
+	for _, item := range pkg.Manifest {
+		ids[item.Id] = true
+		name := path.Join(path.Dir(opfPath), item.Href)
+		if assert.Contains(t, files, name) && item.MediaType == "application/xhtml+xml" {
+			assertWellFormed(t, name, files[name])
+		}
+		if item.Properties == "nav" {
+			navs++
+		}
+	}
+	assert.Equal(t, 1, navs)
+	for _, ref := range pkg.Spine {
+		assert.True(t, ids[ref.IdRef], ref.IdRef)
+	}
+	return files, pkg
+}
+
+func TestEpub(t *testing.T) {
+	useTestDatabase(t)
+
+	c1 := testCommentJson("c1", testCommentJson("c2"))
+	c1["data"].(testJson)["body_html"] = `&lt;div class="md"&gt;&lt;p&gt;A&amp;amp;B&lt;br&gt;&lt;img src="https://i.redd.it/x.png" alt="a cat"&gt; &lt;a href="/r/test"&gt;/r/test&lt;/a&gt;&amp;nbsp;&lt;/p&gt;&lt;/div&gt;`
+	root := parseThreadPage(testPageJson("abc123", c1, testContinuedJson("c3")), "test", "")
+	resolveContinuations(root, func(sub, threadId, commentId string) ([]byte, string, error) {
+		return testPageJson(threadId, testCommentJson(commentId, testCommentJson("c4"))), "", nil
+	}, 1)
+	assert.Nil(t, writeArchive(root, false))
+
+	thread, err := queryExport("abc123", "old")
+	assert.Nil(t, err)
+	if !assert.NotNil(t, thread) {
+		return
+	}
+	buf := new(bytes.Buffer)
+	assert.Nil(t, writeEpub(buf, thread))
+	files, pkg := validateTestEpub(t, buf.Bytes())
+	if pkg == nil {
+		return
+	}
+
+	// The post and a chapter for each top-level comment.
+	assert.Len(t, pkg.Spine, 3)
+	assert.Equal(t, thread.Title, pkg.Title)
+	chapter := string(files["OEBPS/comment-1.xhtml"])
+	assert.Contains(t, chapter, "A&amp;B<br/>")
+	assert.Contains(t, chapter, `<a href="https://i.redd.it/x.png">a cat</a>`)
+	assert.Contains(t, chapter, `<a href="https://www.reddit.com/r/test">`)
+	assert.Contains(t, chapter, `<div class="reply">`+"\n"+`<div class="details">u/author_c2`)
+	// The continuation page is merged into its chapter.
+	assert.Contains(t, string(files["OEBPS/comment-2.xhtml"]), "u/author_c4")
+	assert.Contains(t, string(files["OEBPS/nav.xhtml"]), `<a href="comment-1.xhtml">1. u/author_c1: A&amp;B`)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/:threadid", routeGetPage)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/abc123.epub", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/epub+zip", w.Header().Get("Content-Type"))
+	assert.True(t, strings.HasPrefix(w.Body.String(), "PK"))
+	validateTestEpub(t, w.Body.Bytes())
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+)
+
+//
+// Exports of a whole archived thread, continuation pages merged into one
+// comment tree.
+//
+
+// Line width of plain text exports.
+const EXPORT_TEXT_WIDTH = 80
+
+type ExportComment struct {
+	Id              string          `json:"id"`
+	Author          string          `json:"author"`
+	Created         int64           `json:"created"`
+	Score           int64           `json:"score"`
+	State           string          `json:"state"`
+	BodyHtml        string          `json:"body_html"`
+	ArchivedBody    string          `json:"archived_body_html,omitempty"` // Earlier body of a deleted or removed comment.
+	ArchivedAuthor  string          `json:"archived_author,omitempty"`
+	Replies         []ExportComment `json:"replies"`
+	depth           int
+	commentTemplate *CommentTmpl
+}
+
+type ExportThread struct {
+	Id          string          `json:"id"`
+	Subreddit   string          `json:"subreddit"`
+	Title       string          `json:"title"`
+	Author      string          `json:"author"`
+	Created     int64           `json:"created"`
+	Archived    int64           `json:"archived"`
+	Url         string          `json:"url"` // The thread on Reddit.
+	ContentLink string          `json:"content_link,omitempty"`
+	ContentHtml string          `json:"content_html"`
+	Flair       string          `json:"flair,omitempty"`
+	Comments    []ExportComment `json:"comments"`
+}
+
+// Format a thread is exported in, by file extension.
+type exportFormat struct {
+	mime  string
+	write func(w io.Writer, thread *ExportThread) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"md":   {"text/markdown; charset=utf-8", writeMarkdown},
+	"txt":  {"text/plain; charset=utf-8", writeText},
+	"json": {"application/json; charset=utf-8", writeJson},
+	"epub": {"application/epub+zip", writeEpub},
+}
+
+// Read an export path like "abc123.md" into the thread ID and the format.
+func readExportPath(path string) (string, string, bool) {
+	dot := strings.LastIndex(path, ".")
+	if dot < 0 {
+		return "", "", false
+	}
+	if _, ok := exportFormats[path[dot+1:]]; !ok {
+		return "", "", false
+	}
+	return path[:dot], path[dot+1:], true
+}
+
+// Replace comments that continue on another page with their stored page.
+func mergeContinuations(threadId string, comments []*CommentTmpl) error {
+	for _, c := range comments {
+		if c.Continues {
+			key, _, _, err := queryThread(threadId, c.CommentId)
+			if err != nil {
+				return err
+			}
+			if key != 0 {
+				top, err := queryChildren(key, threadId, "NULL")
+				if err != nil {
+					return err
+				}
+				if err := queryReplies(key, threadId, top, MAX_COMMENT_DEPTH); err != nil {
+					return err
+				}
+				// The page starts from the continued comment itself.
+				c.Children = top
+				if len(top) == 1 && top[0].CommentId == c.CommentId {
+					c.Children = top[0].Children
+				}
+				c.Continues = false
+				c.Continued = true
+			}
+		}
+		if err := mergeContinuations(threadId, c.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportComments(comments []*CommentTmpl, depth int) []ExportComment {
+	exported := []ExportComment{}
+	for _, c := range comments {
+		exported = append(exported, ExportComment{
+			Id:              c.CommentId,
+			Author:          c.Author,
+			Created:         c.timestamp,
+			Score:           c.score,
+			State:           c.State,
+			BodyHtml:        html.UnescapeString(string(c.CommentContent)),
+			ArchivedBody:    html.UnescapeString(string(c.ArchivedContent)),
+			ArchivedAuthor:  c.ArchivedAuthor,
+			Replies:         exportComments(c.Children, depth+1),
+			depth:           depth,
+			commentTemplate: c,
+		})
+	}
+	return exported
+}
+
+// Query the whole thread for exporting, nil if it is not archived.
+func queryExport(threadId string, sortOrder string) (*ExportThread, error) {
+	key, thread, arcTimestamp, err := queryThread(threadId, "")
+	if err != nil || thread == nil {
+		return nil, err
+	}
+	comments, err := queryChildren(key, threadId, "NULL")
+	if err != nil {
+		return nil, err
+	}
+	if err := queryReplies(key, threadId, comments, MAX_COMMENT_DEPTH); err != nil {
+		return nil, err
+	}
+	if err := mergeContinuations(threadId, comments); err != nil {
+		return nil, err
+	}
+	sortComments(comments, sortOrder)
+	thread.Replies = comments
+
+	var created int64
+	dbReadOnly.QueryRow(`SELECT timestamp FROM threads WHERE id = ?`, key).Scan(&created)
+	return &ExportThread{
+		Id:          threadId,
+		Subreddit:   thread.Subreddit,
+		Title:       thread.ThreadTitle,
+		Author:      thread.Author,
+		Created:     created,
+		Archived:    int64(arcTimestamp),
+		Url:         fmt.Sprintf("https://www.reddit.com/r/%s/comments/%s/", thread.Subreddit, threadId),
+		ContentLink: thread.ThreadContentLink,
+		ContentHtml: html.UnescapeString(string(thread.ThreadContent)),
+		Flair:       thread.LinkFlair,
+		Comments:    exportComments(comments, 0),
+	}, nil
+}
+
+// Visit the comments depth first, in order.
+func walkComments(comments []ExportComment, visit func(c *ExportComment)) {
+	for i := range comments {
+		visit(&comments[i])
+		walkComments(comments[i].Replies, visit)
+	}
+}
+
+func formatExportTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format("02 Jan 2006 15:04 MST")
+}
+
+func (c *ExportComment) header() string {
+	points := "points"
+	if c.Score == 1 || c.Score == -1 {
+		points = "point"
+	}
+	header := fmt.Sprintf("u/%s, %d %s, %s", c.Author, c.Score, points, formatExportTime(c.Created))
+	if label := c.commentTemplate.StateLabel(); label != "" {
+		header += " [" + label + "]"
+	}
+	return header
+}
+
+func writeMarkdown(w io.Writer, thread *ExportThread) error {
+	doc := fmt.Sprintf("# %s\n\n", thread.Title)
+	doc += fmt.Sprintf("r/%s, posted by u/%s on %s. [Original thread](%s), archived on %s.\n\n",
+		thread.Subreddit, thread.Author, formatExportTime(thread.Created), thread.Url, formatExportTime(thread.Archived),
+	)
+	if thread.ContentLink != "" {
+		doc += fmt.Sprintf("<%s>\n\n", thread.ContentLink)
+	}
+	if content := htmlToMarkdown(thread.ContentHtml); content != "" {
+		doc += content + "\n\n"
+	}
+	doc += "---\n"
+
+	// Replies are nested in block quotes.
+	walkComments(thread.Comments, func(c *ExportComment) {
+		quote := strings.Repeat("> ", c.depth)
+		body := "**" + markdownEscaper.Replace(c.header()) + "**"
+		if content := htmlToMarkdown(c.BodyHtml); content != "" {
+			body += "\n\n" + content
+		}
+		if c.ArchivedBody != "" {
+			body += "\n\n*Archived before it was " + c.State + ":*\n\n" + htmlToMarkdown(c.ArchivedBody)
+		}
+		if c.depth == 0 {
+			doc += "\n"
+		} else {
+			doc += strings.TrimRight(strings.Repeat("> ", c.depth-1), " ") + "\n"
+		}
+		doc += prefixLines(body, quote, quote) + "\n"
+	})
+	_, err := io.WriteString(w, doc)
+	return err
+}
+
+// Wrap the lines of the text to the width, continuation lines keeping the
+// indentation of the line.
+func wrapText(text string, width int) string {
+	wrapped := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		indent := line[:len(line)-len(strings.TrimLeft(line, " "))]
+		if len(line) <= width {
+			wrapped = append(wrapped, line)
+			continue
+		}
+		current := indent
+		for _, word := range strings.Fields(line) {
+			if current != indent && len(current)+1+len(word) > width {
+				wrapped = append(wrapped, current)
+				current = indent
+			}
+			if current != indent {
+				current += " "
+			}
+			current += word
+		}
+		wrapped = append(wrapped, current)
+	}
+	return strings.Join(wrapped, "\n")
+}
+
+func writeText(w io.Writer, thread *ExportThread) error {
+	return writeTextWidth(w, thread, EXPORT_TEXT_WIDTH)
+}
+
+func writeTextWidth(w io.Writer, thread *ExportThread, width int) error {
+	doc := wrapText(thread.Title, width) + "\n"
+	doc += wrapText(fmt.Sprintf("r/%s, posted by u/%s on %s, archived on %s.",
+		thread.Subreddit, thread.Author, formatExportTime(thread.Created), formatExportTime(thread.Archived),
+	), width) + "\n" + thread.Url + "\n"
+	if thread.ContentLink != "" {
+		doc += thread.ContentLink + "\n"
+	}
+	if content := htmlToText(thread.ContentHtml); content != "" {
+		doc += "\n" + wrapText(content, width) + "\n"
+	}
+	doc += "\n" + strings.Repeat("=", width) + "\n"
+
+	// Replies are indented, up to half of the width.
+	walkComments(thread.Comments, func(c *ExportComment) {
+		indent := strings.Repeat(" ", 4*c.depth)
+		if len(indent) > width/2 {
+			indent = indent[:width/2]
+		}
+		body := c.header()
+		if content := htmlToText(c.BodyHtml); content != "" {
+			body += "\n" + content
+		}
+		if c.ArchivedBody != "" {
+			body += "\nArchived before it was " + c.State + ":\n" + htmlToText(c.ArchivedBody)
+		}
+		doc += "\n" + wrapText(prefixLines(body, indent, indent), width) + "\n"
+	})
+	_, err := io.WriteString(w, doc)
+	return err
+}
+
+func writeJson(w io.Writer, thread *ExportThread) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(thread)
+}
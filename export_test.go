@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHtmlToMarkdown(t *testing.T) {
+	content := `<div class="md"><p>Some <strong>bold</strong> and <em>italic</em> text with a <a href="https://example.com">link</a>
+and a_name.</p>
+<blockquote>
+<p>quoted</p>
+</blockquote>
+<ul>
+<li>one</li>
+<li>two<ol><li>nested</li></ol></li>
+</ul>
+<pre><code>code  line
+</code></pre>
+<table><thead><tr><th>a</th><th>b</th></tr></thead><tbody><tr><td>1</td><td>2</td></tr></tbody></table>
+<p><span class="md-spoiler-text">spoiler</span> &amp; <a href="/r/test">/r/test</a></p></div>`
+
+	assert.Equal(t, strings.Join([]string{
+		`Some **bold** and *italic* text with a [link](https://example.com) and a\_name.`,
+		"",
+		"> quoted",
+		"",
+		"- one",
+		"- two",
+		"",
+		"  1. nested",
+		"",
+		"```\ncode  line\n```",
+		"",
+		"| a | b |\n| --- | --- |\n| 1 | 2 |",
+		"",
+		">!spoiler!< & [/r/test](https://www.reddit.com/r/test)",
+	}, "\n"), htmlToMarkdown(content))
+
+	assert.Equal(t, strings.Join([]string{
+		"Some bold and italic text with a link (https://example.com) and a_name.",
+		"",
+		"> quoted",
+		"",
+		"- one",
+		"- two",
+		"",
+		"  1. nested",
+		"",
+		"    code  line",
+		"",
+		"a | b\n1 | 2",
+		"",
+		">!spoiler!< & /r/test (https://www.reddit.com/r/test)",
+	}, "\n"), htmlToText(content))
+}
+
+func TestWrapText(t *testing.T) {
+	assert.Equal(t, "one two three\n    four five\n    six", wrapText("one two three\n    four five six", 14))
+}
+
+func TestExport(t *testing.T) {
+	useTestDatabase(t)
+
+	root := parseThreadPage(testPageJson("abc123",
+		testCommentJson("c1", testCommentJson("c2")),
+		testContinuedJson("c3"),
+	), "test", "")
+	resolveContinuations(root, func(sub, threadId, commentId string) ([]byte, string, error) {
+		return testPageJson(threadId, testCommentJson(commentId, testCommentJson("c4", testCommentJson("c5")))), "", nil
+	}, 1)
+	assert.Nil(t, writeArchive(root, false))
+
+	thread, err := queryExport("abc123", "old")
+	assert.Nil(t, err)
+	if !assert.NotNil(t, thread) {
+		return
+	}
+
+	// Continuation pages are merged into the tree.
+	ids := []string{}
+	walkComments(thread.Comments, func(c *ExportComment) {
+		ids = append(ids, strings.Repeat("-", c.depth)+c.Id)
+	})
+	assert.Equal(t, []string{"c1", "-c2", "c3", "-c4", "--c5"}, ids)
+
+	md := new(strings.Builder)
+	assert.Nil(t, writeMarkdown(md, thread))
+	assert.Contains(t, md.String(), "# Thread abc123\n")
+	assert.Contains(t, md.String(), "comment c1\n\n> **u/author\\_c2, 0 points")
+	assert.Contains(t, md.String(), "> comment c4\n>\n> > **u/author\\_c5, 0 points, 15 Apr 2022 05:20 UTC**\n> >\n> > comment c5\n")
+
+	txt := new(strings.Builder)
+	assert.Nil(t, writeText(txt, thread))
+	assert.Contains(t, txt.String(), "\n        u/author_c5, 0 points, 15 Apr 2022 05:20 UTC\n        comment c5\n")
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/:threadid", routeGetPage)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/abc123.json", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `attachment; filename="abc123.json"`, w.Header().Get("Content-Disposition"))
+	exported := ExportThread{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &exported))
+	assert.Equal(t, "c5", exported.Comments[1].Replies[0].Replies[0].Id)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/def456.md", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
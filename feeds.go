@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//
+// Atom and RSS feeds of the latest archived threads, of all subreddits or of
+// one.
+//
+
+// Threads in a feed.
+const FEED_ENTRIES = 50
+
+// Length of the excerpt of the post in feed entries.
+const FEED_EXCERPT = 300
+
+type feedEntry struct {
+	threadId    string
+	title       string
+	sub         string
+	author      string
+	created     int64
+	archived    int64
+	content     string // Unescaped HTML.
+	contentLink string
+}
+
+// Latest archived threads of the sub, or of every sub if it is empty.
+func queryFeedEntries(sub string) ([]feedEntry, error) {
+	where := ""
+	args := []interface{}{}
+	if sub != "" {
+		where = "AND sub = ?"
+		args = append(args, sub)
+	}
+	args = append(args, FEED_ENTRIES)
+	rows, qErr := dbReadOnly.Query(`
+		SELECT thread_id, title, sub, author, timestamp, archive_timestamp, content, content_link
+		FROM threads
+		WHERE continuing_reply = "" `+where+`
+		ORDER BY archive_timestamp DESC
+		LIMIT ?`, args...,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in feed query", qErr.Error()})
+	}
+	defer rows.Close()
+	entries := []feedEntry{}
+	for rows.Next() {
+		e := feedEntry{}
+		rows.Scan(&e.threadId, &e.title, &e.sub, &e.author, &e.created, &e.archived, &e.content, &e.contentLink)
+		e.content = html.UnescapeString(e.content)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (e *feedEntry) excerpt() string {
+	text := strings.Join(strings.Fields(htmlToText(e.content)), " ")
+	if len([]rune(text)) > FEED_EXCERPT {
+		text = string([]rune(text)[:FEED_EXCERPT]) + "…"
+	}
+	if text == "" {
+		text = e.contentLink
+	}
+	return text
+}
+
+func (e *feedEntry) redditUrl() string {
+	return fmt.Sprintf("https://www.reddit.com/r/%s/comments/%s/", e.sub, e.threadId)
+}
+
+// Summary of the entry as HTML, for RSS readers.
+func (e *feedEntry) description() string {
+	return fmt.Sprintf("<p>%s</p><p>Posted in r/%s by u/%s on %s. <a href=\"%s\">Original thread</a>.</p>",
+		html.EscapeString(e.excerpt()), html.EscapeString(e.sub), html.EscapeString(e.author),
+		formatExportTime(e.created), html.EscapeString(e.redditUrl()),
+	)
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	Id        string     `xml:"id"`
+	Links     []atomLink `xml:"link"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published"`
+	Author    string     `xml:"author>name"`
+	Category  struct {
+		Term string `xml:"term,attr"`
+	} `xml:"category"`
+	Summary atomText `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title     string      `xml:"title"`
+	Id        string      `xml:"id"`
+	Links     []atomLink  `xml:"link"`
+	Updated   string      `xml:"updated"`
+	Generator atomText    `xml:"generator"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Guid        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+	Author      string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Category    string `xml:"category"`
+	Description string `xml:"description"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	Channel struct {
+		Title         string    `xml:"title"`
+		Link          string    `xml:"link"`
+		Description   string    `xml:"description"`
+		LastBuildDate string    `xml:"lastBuildDate"`
+		Generator     string    `xml:"generator"`
+		Items         []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+func atomTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+func writeAtomFeed(buf *bytes.Buffer, title string, feedUrl string, pageUrl string, baseUrl string, entries []feedEntry) error {
+	feed := atomFeed{
+		Title:     title,
+		Id:        feedUrl,
+		Links:     []atomLink{{Href: feedUrl, Rel: "self"}, {Href: pageUrl, Rel: "alternate", Type: "text/html"}},
+		Generator: atomText{Text: "Bettit " + APPVER},
+	}
+	if len(entries) > 0 {
+		feed.Updated = atomTime(entries[0].archived)
+	} else {
+		feed.Updated = atomTime(0)
+	}
+	for _, e := range entries {
+		entry := atomEntry{
+			Title: e.title,
+			Id:    baseUrl + "/" + e.threadId,
+			Links: []atomLink{
+				{Href: baseUrl + "/" + e.threadId, Rel: "alternate", Type: "text/html"},
+				{Href: e.redditUrl(), Rel: "related", Type: "text/html"},
+			},
+			Updated:   atomTime(e.archived),
+			Published: atomTime(e.created),
+			Author:    "u/" + e.author,
+			Summary:   atomText{Type: "text", Text: e.excerpt()},
+		}
+		entry.Category.Term = e.sub
+		feed.Entries = append(feed.Entries, entry)
+	}
+	buf.WriteString(xml.Header)
+	return xml.NewEncoder(buf).Encode(feed)
+}
+
+func writeRssFeed(buf *bytes.Buffer, title string, pageUrl string, baseUrl string, entries []feedEntry) error {
+	feed := rssFeed{Version: "2.0"}
+	feed.Channel.Title = title
+	feed.Channel.Link = pageUrl
+	feed.Channel.Description = title
+	feed.Channel.Generator = "Bettit " + APPVER
+	if len(entries) > 0 {
+		feed.Channel.LastBuildDate = time.Unix(entries[0].archived, 0).UTC().Format(time.RFC1123Z)
+	}
+	for _, e := range entries {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       e.title,
+			Link:        baseUrl + "/" + e.threadId,
+			Guid:        baseUrl + "/" + e.threadId,
+			PubDate:     time.Unix(e.archived, 0).UTC().Format(time.RFC1123Z),
+			Author:      "u/" + e.author,
+			Category:    e.sub,
+			Description: e.description(),
+		})
+	}
+	buf.WriteString(xml.Header)
+	return xml.NewEncoder(buf).Encode(feed)
+}
+
+// Write the feed, or only 304 Not Modified if the client has it already.
+func serveFeed(c *gin.Context, mime string, feed []byte, entries []feedEntry) {
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum(feed))
+	c.Header("ETag", etag)
+	var modified time.Time
+	if len(entries) > 0 {
+		modified = time.Unix(entries[0].archived, 0).UTC()
+		c.Header("Last-Modified", modified.Format(http.TimeFormat))
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since.
+	if match := c.GetHeader("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+	} else if since, err := http.ParseTime(c.GetHeader("If-Modified-Since")); err == nil && len(entries) > 0 {
+		if !modified.After(since) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.Data(http.StatusOK, mime, feed)
+}
+
+func routeGetFeed(c *gin.Context) {
+	sub := c.Param("subId")
+	entries, err := queryFeedEntries(sub)
+	if err != nil {
+		RenderErrorPage(500, c.Writer)
+		return
+	} else if sub != "" && len(entries) == 0 {
+		RenderErrorPage(404, c.Writer)
+		return
+	}
+
+	baseUrl := requestBaseUrl(c)
+	title := "Bettit: latest archives"
+	pageUrl := baseUrl + "/"
+	if sub != "" {
+		title = "Bettit: archives of r/" + sub
+		pageUrl = baseUrl + "/subs/" + sub
+	}
+	buf := new(bytes.Buffer)
+	mime := "application/atom+xml; charset=utf-8"
+	if strings.HasSuffix(c.Request.URL.Path, ".rss") {
+		mime = "application/rss+xml; charset=utf-8"
+		err = writeRssFeed(buf, title, pageUrl, baseUrl, entries)
+	} else {
+		err = writeAtomFeed(buf, title, baseUrl+c.Request.URL.Path, pageUrl, baseUrl, entries)
+	}
+	if err != nil {
+		Log("Error writing feed", err.Error()).Error()
+		RenderErrorPage(500, c.Writer)
+		return
+	}
+	serveFeed(c, mime, buf.Bytes(), entries)
+}
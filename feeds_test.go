@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeeds(t *testing.T) {
+	useTestDatabase(t)
+
+	post := testPostJson("abc123", 0)
+	post["selftext_html"] = "&lt;div class=\"md\"&gt;&lt;p&gt;Post &amp;amp; text&lt;/p&gt;&lt;/div&gt;"
+	root := parseThreadPage(testPostPageJson(post), "test", "")
+	assert.Nil(t, writeArchive(root, false))
+	other := testPostJson("def456", 0)
+	other["subreddit"] = "other"
+	root = parseThreadPage(testPostPageJson(other), "other", "")
+	assert.Nil(t, writeArchive(root, false))
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Host = "bettit.example"
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/feed.atom")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/atom+xml; charset=utf-8", w.Header().Get("Content-Type"))
+	feed := atomFeed{}
+	assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed))
+	assert.Len(t, feed.Entries, 2)
+
+	w = get("/subs/test/feed.atom")
+	assert.Equal(t, 200, w.Code)
+	feed = atomFeed{}
+	assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &feed))
+	if assert.Len(t, feed.Entries, 1) {
+		entry := feed.Entries[0]
+		assert.Equal(t, "http://bettit.example/abc123", entry.Id)
+		assert.Equal(t, "https://www.reddit.com/r/test/comments/abc123/", entry.Links[1].Href)
+		assert.Equal(t, "Post & text", entry.Summary.Text)
+		assert.NotEmpty(t, entry.Published)
+		assert.NotEmpty(t, entry.Updated)
+	}
+	assert.Equal(t, 404, get("/subs/none/feed.atom").Code)
+
+	w = get("/feed.rss")
+	assert.Equal(t, 200, w.Code)
+	rss := rssFeed{}
+	assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &rss))
+	assert.Equal(t, "2.0", rss.Version)
+	assert.Len(t, rss.Channel.Items, 2)
+
+	// Conditional requests.
+	etag := w.Header().Get("ETag")
+	modified := w.Header().Get("Last-Modified")
+	assert.NotEmpty(t, etag)
+	assert.NotEmpty(t, modified)
+	w = get("/feed.rss", "If-None-Match", etag)
+	assert.Equal(t, 304, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, 200, get("/feed.rss", "If-None-Match", `"other"`).Code)
+	assert.Equal(t, 304, get("/feed.rss", "If-Modified-Since", modified).Code)
+	assert.Equal(t, 200, get("/feed.rss", "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT").Code)
+	// A mismatching ETag wins over the date.
+	assert.Equal(t, 200, get("/feed.rss", "If-None-Match", `"other"`, "If-Modified-Since", modified).Code)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/tidwall/gjson"
+)
+
+// Shortest interval the listings of a followed subreddit are requested at.
+const MIN_FOLLOW_INTERVAL = 2 * time.Minute
+
+// Threads waiting to be archived at most, further matches are dropped until
+// the queue has room again. They are found again when still listed.
+const FOLLOW_QUEUE_SIZE = 500
+
+// Requests left in the window reported by the API at which followers pause
+// until the window resets, leaving room for archives requested by users.
+const API_RESERVE = 50
+
+// Listings that can be followed and the paths they are requested from.
+var followListings = map[string]string{
+	"new": "new?limit=100",
+	"top": "top?t=day&limit=100",
+}
+
+var followSubPattern = regexp.MustCompile(`^[A-Za-z0-9_]{2,21}$`)
+
+// A followed subreddit and the rules threads in its listings are archived by.
+type Follow struct {
+	Sub         string   `json:"sub"`
+	Listings    []string `json:"listings"`
+	MinScore    int64    `json:"min_score"`
+	MinComments int64    `json:"min_comments"`
+	Flairs      []string `json:"flairs"`  // Any flair if empty.
+	MinAge      int64    `json:"min_age"` // Seconds.
+	MaxAge      int64    `json:"max_age"` // Seconds, no limit if 0.
+	Interval    int64    `json:"interval"`
+	Cursor      string   `json:"cursor"` // Fullname of the newest post handled in the new listing.
+	NextRun     int64    `json:"next_run"`
+	LastRun     int64    `json:"last_run"`
+	LastStatus  string   `json:"last_status"`
+	Archived    int64    `json:"archived"` // Threads archived by following the subreddit.
+}
+
+// A post in a subreddit listing.
+type listingPost struct {
+	fullname string
+	id       string
+	sub      string
+	score    int64
+	comments int64
+	flair    string
+	created  int64
+}
+
+func parseListing(data []byte) []listingPost {
+	posts := []listingPost{}
+	for _, child := range gjson.GetBytes(data, "data.children").Array() {
+		post := child.Get("data")
+		posts = append(posts, listingPost{
+			fullname: post.Get("name").String(),
+			id:       post.Get("id").String(),
+			sub:      post.Get("subreddit").String(),
+			score:    post.Get("score").Int(),
+			comments: post.Get("num_comments").Int(),
+			flair:    post.Get("link_flair_text").String(),
+			created:  post.Get("created_utc").Int(),
+		})
+	}
+	return posts
+}
+
+// Whether the post is old enough to be judged by the rules. Younger posts are
+// seen again on later requests.
+func (f *Follow) ripe(post listingPost, now int64) bool {
+	return now-post.created >= f.MinAge
+}
+
+func (f *Follow) matches(post listingPost, now int64) bool {
+	if post.score < f.MinScore || post.comments < f.MinComments || !f.ripe(post, now) {
+		return false
+	}
+	if f.MaxAge > 0 && now-post.created > f.MaxAge {
+		return false
+	}
+	if len(f.Flairs) == 0 {
+		return true
+	}
+	for _, flair := range f.Flairs {
+		if strings.EqualFold(flair, post.flair) {
+			return true
+		}
+	}
+	return false
+}
+
+// Follow a subreddit, or update its rules if it is already followed. Its
+// listings are requested on the next check.
+func addFollow(f Follow, now time.Time) error {
+	if !followSubPattern.MatchString(f.Sub) {
+		return &DbError{"Invalid subreddit", f.Sub}
+	}
+	if len(f.Listings) == 0 {
+		return &DbError{"Invalid listings", "No listings to follow"}
+	}
+	for _, listing := range f.Listings {
+		if _, ok := followListings[listing]; !ok {
+			return &DbError{"Invalid listings", fmt.Sprintf(`Unknown listing "%s", expected "new" or "top"`, listing)}
+		}
+	}
+	if time.Duration(f.Interval)*time.Second < MIN_FOLLOW_INTERVAL {
+		return &DbError{"Invalid follow interval", fmt.Sprintf("Interval must be at least %s", MIN_FOLLOW_INTERVAL)}
+	}
+	if f.MinAge < 0 || f.MaxAge < 0 {
+		return &DbError{"Invalid follow rules", "Ages must not be negative"}
+	}
+	if _, err := execTransaction(`
+		INSERT INTO follows (sub, listings, min_score, min_comments, flairs, min_age, max_age, interval, next_run)
+		VALUES ( ?, ?, ?, ?, ?, ?, ?, ?, ? )
+		ON CONFLICT(sub) DO UPDATE SET
+			listings = excluded.listings, min_score = excluded.min_score, min_comments = excluded.min_comments,
+			flairs = excluded.flairs, min_age = excluded.min_age, max_age = excluded.max_age,
+			interval = excluded.interval, next_run = excluded.next_run
+		`, f.Sub, strings.Join(f.Listings, ","), f.MinScore, f.MinComments, strings.Join(f.Flairs, ","),
+		f.MinAge, f.MaxAge, f.Interval, now.Unix(),
+	); err != nil {
+		return LogE(&DbError{"Error following subreddit", err.Error()})
+	}
+	return nil
+}
+
+// Stop following a subreddit, returns false if it was not followed.
+func removeFollow(sub string) (bool, error) {
+	res, err := execTransaction(`DELETE FROM follows WHERE sub = ?`, sub)
+	if err != nil {
+		return false, LogE(&DbError{"Error removing followed subreddit", err.Error()})
+	}
+	removed, _ := res.RowsAffected()
+	return removed > 0, nil
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
+
+// Followed subreddits, only the given one if sub is not empty.
+func queryFollows(sub string) ([]Follow, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT sub, listings, min_score, min_comments, flairs, min_age, max_age, interval,
+		cursor, next_run, last_run, last_status, archived
+		FROM follows
+		WHERE ? = "" OR sub = ?
+		ORDER BY sub`,
+		sub, sub,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in follows query", qErr.Error()})
+	}
+	defer rows.Close()
+	follows := []Follow{}
+	for rows.Next() {
+		f := Follow{}
+		listings, flairs := "", ""
+		rows.Scan(
+			&f.Sub, &listings, &f.MinScore, &f.MinComments, &flairs, &f.MinAge, &f.MaxAge, &f.Interval,
+			&f.Cursor, &f.NextRun, &f.LastRun, &f.LastStatus, &f.Archived,
+		)
+		f.Listings = splitList(listings)
+		f.Flairs = splitList(flairs)
+		follows = append(follows, f)
+	}
+	return follows, nil
+}
+
+type listingFetcher func(sub string, listing string) ([]byte, error)
+
+// Requests made by followers. Shared by every followed subreddit, and paused
+// when the API reports few requests left.
+type apiBudget struct {
+	bucket   *ratelimit.Bucket
+	mu       sync.Mutex
+	resumeAt time.Time
+}
+
+func newApiBudget(perMinute int) *apiBudget {
+	if perMinute < 1 {
+		perMinute = 1
+	}
+	return &apiBudget{bucket: ratelimit.NewBucketWithQuantum(time.Minute, int64(perMinute), int64(perMinute))}
+}
+
+func (b *apiBudget) wait() {
+	b.bucket.Wait(1)
+	b.mu.Lock()
+	pause := time.Until(b.resumeAt)
+	b.mu.Unlock()
+	if pause > 0 {
+		Log("API budget used, pausing followers.", pause.String()).Info()
+		time.Sleep(pause)
+	}
+}
+
+// Read the rate limit headers of an API response.
+func (b *apiBudget) update(header http.Header) {
+	remaining, rErr := strconv.ParseFloat(header.Get("X-Ratelimit-Remaining"), 64)
+	reset, sErr := strconv.Atoi(header.Get("X-Ratelimit-Reset"))
+	if rErr != nil || sErr != nil || remaining > API_RESERVE {
+		return
+	}
+	b.mu.Lock()
+	b.resumeAt = time.Now().Add(time.Duration(reset) * time.Second)
+	b.mu.Unlock()
+}
+
+func (b *apiBudget) limit(fetch pageFetcher) pageFetcher {
+	return func(sub string, threadId string, commentId string) ([]byte, string, error) {
+		b.wait()
+		return fetch(sub, threadId, commentId)
+	}
+}
+
+func (b *apiBudget) fetchListing(sub string, listing string) ([]byte, error) {
+	b.wait()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("https://oauth.reddit.com/r/%s/%s", sub, followListings[listing]), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Authorization", "bearer "+apiToken)
+
+	client := http.Client{
+		Timeout: time.Second * time.Duration(clientOptions.Timeout),
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b.update(res.Header)
+	if res.StatusCode != 200 {
+		return nil, &RouterError{code: res.StatusCode, message: fmt.Sprintf("Listing request failed: %s", res.Status)}
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+type archiveJob struct {
+	sub      string // Followed subreddit the thread was found in.
+	threadId string
+}
+
+// Requests the listings of followed subreddits and archives the threads
+// matching their rules.
+type follower struct {
+	clock   clock
+	listing listingFetcher
+	fetch   pageFetcher
+	jobs    chan archiveJob
+	mu      sync.Mutex
+	queued  map[string]bool
+}
+
+func newFollower(clock clock, listing listingFetcher, fetch pageFetcher) *follower {
+	return &follower{
+		clock:   clock,
+		listing: listing,
+		fetch:   fetch,
+		jobs:    make(chan archiveJob, FOLLOW_QUEUE_SIZE),
+		queued:  map[string]bool{},
+	}
+}
+
+// Queue the thread to be archived, unless it is archived or queued already.
+func (f *follower) enqueue(job archiveJob) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.queued[job.threadId] || threadArchived(job.threadId) {
+		return false
+	}
+	select {
+	case f.jobs <- job:
+		f.queued[job.threadId] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Request the listings of the subreddit and queue the matching threads.
+// Returns the number of threads queued and the new cursor.
+func (f *follower) poll(follow Follow, now int64) (int, string, error) {
+	queued := 0
+	cursor := follow.Cursor
+	for _, listing := range follow.Listings {
+		data, err := f.listing(follow.Sub, listing)
+		if err != nil {
+			return queued, cursor, err
+		}
+		posts := parseListing(data)
+		movedCursor := false
+		for _, post := range posts {
+			if listing == "new" {
+				// Posts up to the cursor have been handled, but posts too
+				// young for the rules are left for a later request.
+				if post.fullname == follow.Cursor {
+					break
+				}
+				if !movedCursor && follow.ripe(post, now) {
+					cursor = post.fullname
+					movedCursor = true
+				}
+			}
+			if follow.matches(post, now) && f.enqueue(archiveJob{follow.Sub, post.id}) {
+				queued++
+			}
+		}
+	}
+	return queued, cursor, nil
+}
+
+// Request the listings of subreddits that are due. Returns the number of
+// subreddits checked.
+func (f *follower) runDue() int {
+	now := f.clock.Now().Unix()
+	follows, err := queryFollows("")
+	if err != nil {
+		return 0
+	}
+	checked := 0
+	for _, follow := range follows {
+		if follow.NextRun > now {
+			continue
+		}
+		queued, cursor, err := f.poll(follow, now)
+		status := fmt.Sprintf("%d threads queued", queued)
+		if err != nil {
+			Log("Error requesting listing of followed subreddit", fmt.Sprintf("r/%s: %s", follow.Sub, err.Error())).Error()
+			status = "failed: " + err.Error()
+		}
+		if _, err := execTransaction(`
+			UPDATE follows SET cursor = ?, next_run = ?, last_run = ?, last_status = ?
+			WHERE sub = ?
+			`, cursor, now+follow.Interval, now, status, follow.Sub,
+		); err != nil {
+			Log("Error updating followed subreddit", err.Error()).Error()
+		}
+		checked++
+	}
+	return checked
+}
+
+func (f *follower) archive(job archiveJob) {
+	defer func() {
+		f.mu.Lock()
+		delete(f.queued, job.threadId)
+		f.mu.Unlock()
+	}()
+	data, header, err := f.fetch("", job.threadId, "")
+	if err != nil {
+		Log("Error fetching thread of followed subreddit", fmt.Sprintf("ID %s: %s", job.threadId, err.Error())).Error()
+		emitEvent(fetchFailedEvent(job.sub, job.threadId, err))
+		return
+	}
+	if err := writeArchive(fetchArchive("", data, header, f.fetch), false); err != nil {
+		return
+	}
+	if _, err := execTransaction(`UPDATE follows SET archived = archived + 1 WHERE sub = ?`, job.sub); err != nil {
+		Log("Error updating followed subreddit", err.Error()).Error()
+	}
+}
+
+func (f *follower) run(tick time.Duration) {
+	go func() {
+		for job := range f.jobs {
+			f.archive(job)
+		}
+	}()
+	for {
+		f.runDue()
+		time.Sleep(tick)
+	}
+}
+
+// Status of the followed subreddit for its page, nil if it is not followed.
+func queryFollowStatus(sub string) *FollowTmpl {
+	follows, err := queryFollows(sub)
+	if err != nil || len(follows) == 0 {
+		return nil
+	}
+	f := follows[0]
+	tmpl := &FollowTmpl{
+		Listings:   strings.Join(f.Listings, ", "),
+		Rules:      []string{},
+		Interval:   (time.Duration(f.Interval) * time.Second).String(),
+		LastRun:    "not yet",
+		LastStatus: f.LastStatus,
+		Archived:   f.Archived,
+	}
+	if f.LastRun > 0 {
+		tmpl.LastRun = time.Unix(f.LastRun, 0).Format("02 Jan 2006 15:04")
+	}
+	if f.MinScore > 0 {
+		tmpl.Rules = append(tmpl.Rules, fmt.Sprintf("a score of at least %d", f.MinScore))
+	}
+	if f.MinComments > 0 {
+		tmpl.Rules = append(tmpl.Rules, fmt.Sprintf("at least %d comments", f.MinComments))
+	}
+	if len(f.Flairs) > 0 {
+		tmpl.Rules = append(tmpl.Rules, "the flair "+strings.Join(f.Flairs, " or "))
+	}
+	if f.MinAge > 0 {
+		tmpl.Rules = append(tmpl.Rules, fmt.Sprintf("an age of at least %s", time.Duration(f.MinAge)*time.Second))
+	}
+	if f.MaxAge > 0 {
+		tmpl.Rules = append(tmpl.Rules, fmt.Sprintf("an age of at most %s", time.Duration(f.MaxAge)*time.Second))
+	}
+	return tmpl
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func testListingPost(id string, score int, comments int, flair string, created int64) testJson {
+	return testJson{"kind": "t3", "data": testJson{
+		"name":            "t3_" + id,
+		"id":              id,
+		"subreddit":       "test",
+		"score":           score,
+		"num_comments":    comments,
+		"link_flair_text": flair,
+		"created_utc":     created,
+	}}
+}
+
+func testListingJson(posts ...testJson) []byte {
+	data, _ := json.Marshal(testJson{"kind": "Listing", "data": testJson{"children": posts}})
+	return data
+}
+
+func TestAddFollow(t *testing.T) {
+	useTestDatabase(t)
+	now := time.Unix(1650000000, 0)
+
+	assert.NotNil(t, addFollow(Follow{Sub: "test", Listings: []string{"hot"}, Interval: 600}, now))
+	assert.NotNil(t, addFollow(Follow{Sub: "test", Listings: []string{"new"}, Interval: 60}, now))
+	assert.NotNil(t, addFollow(Follow{Sub: "a/b", Listings: []string{"new"}, Interval: 600}, now))
+	assert.Nil(t, addFollow(Follow{Sub: "test", Listings: []string{"new", "top"}, Flairs: []string{"News"}, Interval: 600}, now))
+	assert.Nil(t, addFollow(Follow{Sub: "test", Listings: []string{"top"}, MinScore: 10, Interval: 600}, now))
+
+	follows, err := queryFollows("")
+	assert.Nil(t, err)
+	if assert.Len(t, follows, 1) {
+		assert.Equal(t, []string{"top"}, follows[0].Listings)
+		assert.Equal(t, int64(10), follows[0].MinScore)
+		assert.Empty(t, follows[0].Flairs)
+	}
+	removed, _ := removeFollow("test")
+	assert.True(t, removed)
+	removed, _ = removeFollow("test")
+	assert.False(t, removed)
+}
+
+func TestFollower(t *testing.T) {
+	useTestDatabase(t)
+	clock := &fakeClock{time.Unix(1650000000, 0)}
+	now := clock.Now().Unix()
+
+	listing := []testJson{
+		testListingPost("new001", 50, 20, "News", now-5*60),       // Too young.
+		testListingPost("old001", 50, 20, "news", now-2*60*60),    // Matches.
+		testListingPost("old002", 2, 20, "News", now-3*60*60),     // Low score.
+		testListingPost("old003", 50, 20, "Meme", now-4*60*60),    // Other flair.
+		testListingPost("old004", 50, 20, "News", now-48*60*60+1), // Matches.
+	}
+	requested := []string{}
+	f := newFollower(clock,
+		func(sub string, name string) ([]byte, error) {
+			requested = append(requested, sub+"/"+name)
+			return testListingJson(listing...), nil
+		},
+		func(sub, threadId, commentId string) ([]byte, string, error) {
+			return testPageJson(threadId), "", nil
+		},
+	)
+	assert.Nil(t, addFollow(Follow{
+		Sub:      "test",
+		Listings: []string{"new"},
+		MinScore: 10,
+		Flairs:   []string{"News"},
+		MinAge:   60 * 60,
+		MaxAge:   48 * 60 * 60,
+		Interval: 600,
+	}, clock.Now()))
+
+	assert.Equal(t, 1, f.runDue())
+	assert.Equal(t, []string{"test/new"}, requested)
+	assert.Len(t, f.jobs, 2)
+	follows, _ := queryFollows("test")
+	assert.Equal(t, "t3_old001", follows[0].Cursor)
+	assert.Equal(t, "2 threads queued", follows[0].LastStatus)
+	assert.Equal(t, 0, f.runDue())
+
+	// Posts up to the cursor are not queued again.
+	clock.advance(10 * time.Minute)
+	assert.Equal(t, 1, f.runDue())
+	assert.Len(t, f.jobs, 2)
+
+	for len(f.jobs) > 0 {
+		f.archive(<-f.jobs)
+	}
+	assert.True(t, threadArchived("old001"))
+	assert.True(t, threadArchived("old004"))
+	assert.False(t, threadArchived("new001"))
+
+	// Posts too young earlier are queued once old enough.
+	clock.advance(time.Hour)
+	listing = append([]testJson{testListingPost("new002", 50, 20, "News", clock.Now().Unix())}, listing[:2]...)
+	listing = append(listing, testListingPost("old005", 50, 20, "News", now-5*60*60))
+	assert.Equal(t, 1, f.runDue())
+	assert.Len(t, f.jobs, 1)
+	assert.Equal(t, "new001", (<-f.jobs).threadId)
+	follows, _ = queryFollows("test")
+	assert.Equal(t, "t3_new001", follows[0].Cursor)
+	assert.Equal(t, int64(2), follows[0].Archived)
+
+	// Status is shown on the page of the subreddit.
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/subs/:subId", routeSubThreads)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/subs/test", nil)
+	r.ServeHTTP(w, req)
+	assert.Contains(t, w.Body.String(), "Following the new listings every 10m0s.")
+	assert.Contains(t, w.Body.String(), "a score of at least 10, the flair News, an age of at least 1h0m0s, an age of at most 48h0m0s")
+	assert.Contains(t, w.Body.String(), "2 threads archived.")
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+//
+// Conversion of the HTML Reddit renders posts and comments to back to
+// Markdown or plain text, or to XHTML. Stored content is escaped, and
+// unescaped before conversion.
+//
+
+var spacePattern = regexp.MustCompile(`[ \t\r\n]+`)
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`,
+)
+
+type htmlConverter struct {
+	plain bool // Plain text instead of Markdown.
+}
+
+// Convert the HTML of a post or comment to Markdown.
+func htmlToMarkdown(content string) string {
+	return htmlConverter{false}.convert(content)
+}
+
+// Convert the HTML of a post or comment to plain text.
+func htmlToText(content string) string {
+	return htmlConverter{true}.convert(content)
+}
+
+func (c htmlConverter) convert(content string) string {
+	context := &nethtml.Node{Type: nethtml.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := nethtml.ParseFragment(strings.NewReader(content), context)
+	if err != nil {
+		return ""
+	}
+	root := &nethtml.Node{Type: nethtml.ElementNode, Data: "div", DataAtom: atom.Div}
+	for _, n := range nodes {
+		root.AppendChild(n)
+	}
+	return c.blocks(root)
+}
+
+func isBlock(n *nethtml.Node) bool {
+	if n.Type != nethtml.ElementNode {
+		return false
+	}
+	switch n.DataAtom {
+	case atom.P, atom.Div, atom.Blockquote, atom.Ul, atom.Ol, atom.Pre, atom.Hr, atom.Table,
+		atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		return true
+	}
+	return false
+}
+
+func attr(n *nethtml.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// Prefix every line of the text, the first line with `first`.
+func prefixLines(text string, first string, rest string) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		p := rest
+		if i == 0 {
+			p = first
+		}
+		lines[i] = strings.TrimRight(p+line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Children of the node as blocks separated by empty lines. Consecutive inline
+// children form a paragraph.
+func (c htmlConverter) blocks(n *nethtml.Node) string {
+	blocks := []string{}
+	paragraph := ""
+	flush := func() {
+		if p := strings.TrimSpace(paragraph); p != "" {
+			blocks = append(blocks, p)
+		}
+		paragraph = ""
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if !isBlock(child) {
+			paragraph += c.inline(child)
+			continue
+		}
+		flush()
+		if b := c.block(child); strings.TrimSpace(b) != "" {
+			blocks = append(blocks, b)
+		}
+	}
+	flush()
+	return strings.Join(blocks, "\n\n")
+}
+
+func (c htmlConverter) block(n *nethtml.Node) string {
+	switch n.DataAtom {
+	case atom.P:
+		return strings.TrimSpace(c.inlineChildren(n))
+	case atom.Blockquote:
+		return prefixLines(c.blocks(n), "> ", "> ")
+	case atom.Ul, atom.Ol:
+		items := []string{}
+		i := 1
+		for li := n.FirstChild; li != nil; li = li.NextSibling {
+			if li.DataAtom != atom.Li {
+				continue
+			}
+			marker := "- "
+			if n.DataAtom == atom.Ol {
+				marker = fmt.Sprintf("%d. ", i)
+			}
+			items = append(items, prefixLines(c.blocks(li), marker, strings.Repeat(" ", len(marker))))
+			i++
+		}
+		return strings.Join(items, "\n")
+	case atom.Pre:
+		code := strings.TrimRight(textContent(n), "\n")
+		if c.plain {
+			return prefixLines(code, "    ", "    ")
+		}
+		return "```\n" + code + "\n```"
+	case atom.Hr:
+		return "---"
+	case atom.Table:
+		return c.table(n)
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		text := strings.TrimSpace(c.inlineChildren(n))
+		if c.plain {
+			return text
+		}
+		return strings.Repeat("#", int(n.Data[1]-'0')) + " " + text
+	}
+	return c.blocks(n)
+}
+
+func (c htmlConverter) table(n *nethtml.Node) string {
+	rows := [][]string{}
+	var walk func(n *nethtml.Node)
+	walk = func(n *nethtml.Node) {
+		if n.DataAtom == atom.Tr {
+			row := []string{}
+			for cell := n.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+					row = append(row, strings.TrimSpace(c.inlineChildren(cell)))
+				}
+			}
+			rows = append(rows, row)
+			return
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+
+	lines := []string{}
+	for i, row := range rows {
+		if c.plain {
+			lines = append(lines, strings.Join(row, " | "))
+			continue
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, "|"+strings.Repeat(" --- |", len(row)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func textContent(n *nethtml.Node) string {
+	if n.Type == nethtml.TextNode {
+		return n.Data
+	}
+	text := ""
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		text += textContent(child)
+	}
+	return text
+}
+
+func (c htmlConverter) inlineChildren(n *nethtml.Node) string {
+	text := ""
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		text += c.inline(child)
+	}
+	return text
+}
+
+// Wrap inline text in the given Markdown markers, kept outside of the
+// surrounding whitespace.
+func (c htmlConverter) wrap(text string, marker string) string {
+	trimmed := strings.TrimSpace(text)
+	if c.plain || trimmed == "" {
+		return text
+	}
+	lead := text[:strings.Index(text, trimmed)]
+	trail := text[len(lead)+len(trimmed):]
+	return lead + marker + trimmed + marker + trail
+}
+
+func (c htmlConverter) inline(n *nethtml.Node) string {
+	if n.Type == nethtml.TextNode {
+		text := spacePattern.ReplaceAllString(n.Data, " ")
+		if c.plain {
+			return text
+		}
+		return markdownEscaper.Replace(text)
+	}
+	if n.Type != nethtml.ElementNode {
+		return ""
+	}
+	switch n.DataAtom {
+	case atom.Br:
+		if c.plain {
+			return "\n"
+		}
+		return "  \n"
+	case atom.Strong, atom.B:
+		return c.wrap(c.inlineChildren(n), "**")
+	case atom.Em, atom.I:
+		return c.wrap(c.inlineChildren(n), "*")
+	case atom.Del, atom.S, atom.Strike:
+		return c.wrap(c.inlineChildren(n), "~~")
+	case atom.Code:
+		if c.plain {
+			return textContent(n)
+		}
+		return "`" + textContent(n) + "`"
+	case atom.Sup:
+		return "^(" + strings.TrimSpace(c.inlineChildren(n)) + ")"
+	case atom.A:
+		text := strings.TrimSpace(c.inlineChildren(n))
+		href := attr(n, "href")
+		// Links like /r/sub and /u/user keep their text.
+		autolink := textContent(n) == href && !strings.HasPrefix(href, "/")
+		if strings.HasPrefix(href, "/") {
+			href = "https://www.reddit.com" + href
+		}
+		switch {
+		case href == "":
+			return text
+		case c.plain && (text == "" || autolink):
+			return href
+		case c.plain:
+			return text + " (" + href + ")"
+		case autolink:
+			return "<" + href + ">"
+		}
+		return "[" + text + "](" + href + ")"
+	case atom.Img:
+		if c.plain {
+			return attr(n, "src")
+		}
+		return "![" + attr(n, "alt") + "](" + attr(n, "src") + ")"
+	case atom.Span:
+		if strings.Contains(attr(n, "class"), "md-spoiler-text") {
+			return ">!" + c.inlineChildren(n) + "!<"
+		}
+	}
+	return c.inlineChildren(n)
+}
+
+// Convert the HTML of a post or comment to well-formed XHTML. Links relative
+// to Reddit are made absolute and images are replaced with links to them.
+func htmlToXhtml(content string) string {
+	context := &nethtml.Node{Type: nethtml.ElementNode, Data: "div", DataAtom: atom.Div}
+	nodes, err := nethtml.ParseFragment(strings.NewReader(content), context)
+	if err != nil {
+		return ""
+	}
+	var fix func(n *nethtml.Node)
+	fix = func(n *nethtml.Node) {
+		if n.DataAtom == atom.Img {
+			src, text := attr(n, "src"), attr(n, "alt")
+			if text == "" {
+				text = src
+			}
+			n.Data, n.DataAtom = "a", atom.A
+			n.Attr = []nethtml.Attribute{{Key: "href", Val: src}}
+			n.AppendChild(&nethtml.Node{Type: nethtml.TextNode, Data: text})
+		}
+		for i, a := range n.Attr {
+			if a.Key == "href" && strings.HasPrefix(a.Val, "/") {
+				n.Attr[i].Val = "https://www.reddit.com" + a.Val
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			fix(child)
+		}
+	}
+	buf := new(strings.Builder)
+	for _, n := range nodes {
+		fix(n)
+		nethtml.Render(buf, n)
+	}
+	return buf.String()
+}
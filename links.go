@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/ilmari-h/bettit/redditurl"
+	"github.com/tidwall/gjson"
+)
+
+// Kinds of links between threads.
+const (
+	LINK_CROSSPOST = "crosspost" // The post is a crosspost of the linked thread.
+	LINK_THREAD    = "link"      // The post links to the thread.
+)
+
+// Another thread a post refers to.
+type ThreadLink struct {
+	ThreadId string
+	Sub      string
+	Kind     string
+}
+
+// Threads the post is a crosspost of or links to.
+func parseLinks(post gjson.Result) []ThreadLink {
+	links := []ThreadLink{}
+	if parent := post.Get("crosspost_parent_list.0"); parent.Exists() {
+		links = append(links, ThreadLink{parent.Get("id").String(), parent.Get("subreddit").String(), LINK_CROSSPOST})
+	} else if parent := strings.TrimPrefix(post.Get("crosspost_parent").String(), "t3_"); parent != "" {
+		links = append(links, ThreadLink{parent, "", LINK_CROSSPOST})
+	}
+
+	// The URL of a crosspost is the parent thread, which is already linked.
+	contentLink := post.Get("url_overridden_by_dest").String()
+	if strings.HasPrefix(contentLink, "/") {
+		contentLink = "https://reddit.com" + contentLink
+	}
+	if len(links) == 0 && strings.Contains(contentLink, "://") {
+		if link, err := redditurl.Parse(contentLink); err == nil && !link.IsShare() && link.ThreadId != post.Get("id").String() {
+			links = append(links, ThreadLink{link.ThreadId, link.Sub, LINK_THREAD})
+		}
+	}
+	return links
+}
+
+func (dbtx *ThreadDbTx) txPostLinks(root *ThreadPage) error {
+	for _, link := range root.Post.Links {
+		if _, err := dbtx.tx.Exec(`
+			REPLACE INTO thread_links (thread_id, linked_id, linked_sub, kind) VALUES ( ?, ?, ?, ? );
+			`, root.Post.Id, link.ThreadId, link.Sub, link.Kind,
+		); err != nil {
+			return &DbError{"Error storing thread link", err.Error()}
+		}
+	}
+	return nil
+}
+
+func threadArchived(threadId string) bool {
+	found := 0
+	dbReadOnly.QueryRow(`
+		SELECT COUNT(*) FROM threads WHERE thread_id = ? AND continuing_reply = ""
+		`, threadId,
+	).Scan(&found)
+	return found > 0
+}
+
+// Archive the threads the post links to, if they are not archived yet. Links
+// of the linked threads are not followed.
+func archiveLinked(page *ThreadPage, fetch pageFetcher) {
+	for _, link := range page.Post.Links {
+		if threadArchived(link.ThreadId) {
+			continue
+		}
+		data, header, err := fetch(link.Sub, link.ThreadId, "")
+		if err != nil {
+			Log("Error fetching linked thread", fmt.Sprintf("ID %s: %s", link.ThreadId, err.Error())).Warn()
+			continue
+		}
+		writeArchive(fetchArchive(link.Sub, data, header, fetch), false)
+	}
+}
+
+func threadLinkUrl(threadId string, archived bool) string {
+	if archived {
+		return "/" + threadId
+	}
+	return "https://www.reddit.com/comments/" + threadId
+}
+
+// Threads the thread links to, and archived threads linking to it.
+func queryThreadLinks(threadId string) ([]ThreadLinkTmpl, []ThreadLinkTmpl, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT l.linked_id, l.linked_sub, l.kind, MAX(t.sub), MAX(t.title)
+		FROM thread_links l LEFT JOIN threads t ON t.thread_id = l.linked_id AND t.continuing_reply = ""
+		WHERE l.thread_id = ?
+		GROUP BY l.linked_id
+		ORDER BY MIN(l.rowid)`, threadId,
+	)
+	if qErr != nil {
+		return nil, nil, LogE(&DbError{"Error in thread link query", qErr.Error()})
+	}
+	linksTo := []ThreadLinkTmpl{}
+	for rows.Next() {
+		link := ThreadLinkTmpl{}
+		var sub, title sql.NullString
+		rows.Scan(&link.ThreadId, &link.Subreddit, &link.Kind, &sub, &title)
+		link.Archived = title.Valid
+		if sub.Valid {
+			link.Subreddit = sub.String
+		}
+		link.Title = title.String
+		link.Url = threadLinkUrl(link.ThreadId, link.Archived)
+		linksTo = append(linksTo, link)
+	}
+	rows.Close()
+
+	rows, qErr = dbReadOnly.Query(`
+		SELECT l.thread_id, l.kind, MAX(t.sub), MAX(t.title)
+		FROM thread_links l JOIN threads t ON t.thread_id = l.thread_id AND t.continuing_reply = ""
+		WHERE l.linked_id = ?
+		GROUP BY l.thread_id
+		ORDER BY MIN(t.timestamp)`, threadId,
+	)
+	if qErr != nil {
+		return nil, nil, LogE(&DbError{"Error in thread link query", qErr.Error()})
+	}
+	defer rows.Close()
+	linkedFrom := []ThreadLinkTmpl{}
+	for rows.Next() {
+		link := ThreadLinkTmpl{Archived: true}
+		rows.Scan(&link.ThreadId, &link.Kind, &link.Subreddit, &link.Title)
+		link.Url = threadLinkUrl(link.ThreadId, true)
+		linkedFrom = append(linkedFrom, link)
+	}
+	return linksTo, linkedFrom, nil
+}
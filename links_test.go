@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLinks(t *testing.T) {
+	crosspost := testPostJson("xpost1", 0)
+	crosspost["crosspost_parent"] = "t3_orig01"
+	crosspost["crosspost_parent_list"] = []testJson{{"id": "orig01", "subreddit": "origsub"}}
+	crosspost["url_overridden_by_dest"] = "/r/origsub/comments/orig01/title/"
+	assert.Equal(t,
+		[]ThreadLink{{"orig01", "origsub", LINK_CROSSPOST}},
+		parseThreadPage(testPostPageJson(crosspost), "test", "").Post.Links,
+	)
+
+	link := testPostJson("link01", 0)
+	link["url_overridden_by_dest"] = "https://old.reddit.com/r/other/comments/orig02/title/"
+	assert.Equal(t,
+		[]ThreadLink{{"orig02", "other", LINK_THREAD}},
+		parseThreadPage(testPostPageJson(link), "test", "").Post.Links,
+	)
+
+	external := testPostJson("ext001", 0)
+	external["url_overridden_by_dest"] = "https://example.com/comments/abc123"
+	assert.Empty(t, parseThreadPage(testPostPageJson(external), "test", "").Post.Links)
+}
+
+func TestArchiveLinked(t *testing.T) {
+	useTestDatabase(t)
+
+	crosspost := testPostJson("xpost1", 0)
+	crosspost["crosspost_parent"] = "t3_orig01"
+	crosspost["crosspost_parent_list"] = []testJson{{"id": "orig01", "subreddit": "origsub"}}
+	root := parseThreadPage(testPostPageJson(crosspost), "test", "")
+	assert.Nil(t, writeArchive(root, false))
+
+	// The parent is linked to on Reddit until archived.
+	arch, _ := GetArchiveQuery("xpost1", "", "", 0)
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), `href="https://www.reddit.com/comments/orig01">r/origsub</a>`)
+	}
+
+	requested := []string{}
+	archiveLinked(root, func(sub, threadId, commentId string) ([]byte, string, error) {
+		requested = append(requested, sub+"/"+threadId)
+		parent := testPostJson(threadId, 0)
+		parent["subreddit"] = sub
+		parent["title"] = "Original"
+		return testPostPageJson(parent), "", nil
+	})
+	assert.Equal(t, []string{"origsub/orig01"}, requested)
+
+	arch, _ = GetArchiveQuery("xpost1", "", "", 0)
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), `href="/orig01">r/origsub: Original</a>`)
+	}
+	parent, _ := GetArchiveQuery("orig01", "", "", 0)
+	if assert.NotNil(t, parent) {
+		assert.Contains(t, string(parent.ThreadHTML), "Crossposted to")
+		assert.Contains(t, string(parent.ThreadHTML), `href="/xpost1">r/test: Thread xpost1</a>`)
+	}
+
+	// Already archived threads are not fetched again.
+	archiveLinked(root, func(sub, threadId, commentId string) ([]byte, string, error) {
+		t.Error("fetched archived thread", threadId)
+		return nil, "", nil
+	})
+}
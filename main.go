@@ -20,13 +20,30 @@ var userAgent string = ""
 
 const APPVER = "v1.0.3"
 
-const DBFILE = "./bettit.db.d/bettit.db"
+var DBFILE = "./bettit.db.d/bettit.db"
 
 type ClientOptions struct {
-	Timeout int
+	Timeout      int
+	FetchWorkers int
+	StoreRank    bool
+	MediaDir     string
+	MediaMaxSize int // Megabytes.
+	MediaTypes   []string
+	VideoMaxSize int // Megabytes.
+	VideoMaxRes  int // Height in pixels.
+
+	ArchiveLinked bool // Archive the threads posts are crossposts of or link to.
+	HideRemoved   bool // Do not keep the text of comments deleted or removed on Reddit.
+	FollowBudget  int  // Requests per minute made for followed subreddits.
 }
 
-var clientOptions ClientOptions
+var clientOptions = ClientOptions{
+	FetchWorkers: 4,
+	MediaMaxSize: 20,
+	VideoMaxSize: 200,
+	VideoMaxRes:  720,
+	FollowBudget: 30,
+}
 
 func Log(message string, detail string) *log.Entry {
 	return log.WithFields(log.Fields{
@@ -107,26 +124,126 @@ func init() {
 func main() {
 
 	nRouterOpts := RouterOptions{}
-	clientOptions.Timeout = *getopt.IntLong("client-timeout", 'c', 5, "Timeout for requests made to Reddit API.")
-	nRouterOpts.GetCacheTime = *getopt.IntLong("get-cache-time", 'g', 60, "Time in seconds for caching GET-requests.")
-	nRouterOpts.GetCacheExpiration = *getopt.IntLong("get-cache-exp", 'e', 300, "Expiry time in seconds for GET-requests.")
-	nRouterOpts.PostRateLimitN = *getopt.IntLong("post-rate-limit-numerator", 'r', 5,
+	clientOptions.Timeout = 5
+	getopt.FlagLong(&clientOptions.Timeout, "client-timeout", 'c', "Timeout for requests made to Reddit API.")
+	getopt.FlagLong(&clientOptions.FetchWorkers, "fetch-workers", 'w',
+		`Maximum number of continuation pages fetched concurrently when archiving a thread.`,
+	)
+	getopt.FlagLong(&clientOptions.StoreRank, "store-rank", 0,
+		`Store the order Reddit returns comments in, allowing archives to be shown in "best" order.`,
+	)
+	nRouterOpts.GetCacheTime = 60
+	getopt.FlagLong(&nRouterOpts.GetCacheTime, "get-cache-time", 'g', "Time in seconds for caching GET-requests.")
+	nRouterOpts.GetCacheExpiration = 300
+	getopt.FlagLong(&nRouterOpts.GetCacheExpiration, "get-cache-exp", 'e', "Expiry time in seconds for GET-requests.")
+	nRouterOpts.PostRateLimitN = 5
+	getopt.FlagLong(&nRouterOpts.PostRateLimitN, "post-rate-limit-numerator", 'r',
 		`Numerator of the post rate limit.
 The default denominator being 60 seconds, that means default rate is 5 per minute.`,
 	)
-	nRouterOpts.PostRateLimitD = *getopt.IntLong("post-rate-limit-denominator", 'd', 60,
+	nRouterOpts.PostRateLimitD = 60
+	getopt.FlagLong(&nRouterOpts.PostRateLimitD, "post-rate-limit-denominator", 'd',
 		`Denominator of the post rate limit.
 By default 60, the default numerator being 5, that means default rate is 5 per minute.`,
 	)
-	nRouterOpts.PostCacheTime = *getopt.IntLong("post-cache-time", 'p', 3600,
+	nRouterOpts.PostCacheTime = 3600
+	getopt.FlagLong(&nRouterOpts.PostCacheTime, "post-cache-time", 'p',
 		`Time in seconds for blocking identical POST-requests to /archive -endpoint.
 An archive request initiates an request to the Reddit API.
 To avoid unnecessary requests, this option is used.`,
 	)
 
+	getopt.FlagLong(&clientOptions.MediaDir, "media-dir", 0,
+		`Directory for archiving images of threads. Media is not archived if not set.`,
+	)
+	getopt.FlagLong(&clientOptions.MediaMaxSize, "media-max-size", 0,
+		`Maximum size in megabytes of an archived media file.`,
+	)
+	getopt.FlagLong(&clientOptions.MediaTypes, "media-types", 0,
+		`Comma separated list of MIME types of media that is archived.
+By default common image formats.`,
+	)
+	getopt.FlagLong(&clientOptions.ArchiveLinked, "archive-linked", 0,
+		`Archive the original threads of crossposts and threads linked by posts along with them.`,
+	)
+	getopt.FlagLong(&clientOptions.HideRemoved, "hide-removed", 0,
+		`Do not keep the earlier text of comments deleted or removed on Reddit when threads are archived again.`,
+	)
+	getopt.FlagLong(&clientOptions.VideoMaxSize, "video-max-size", 0,
+		`Maximum size in megabytes of an archived video, 0 to not archive videos.`,
+	)
+	getopt.FlagLong(&clientOptions.VideoMaxRes, "video-max-res", 0,
+		`Maximum height in pixels of an archived video, 0 for the highest available.`,
+	)
+
+	getopt.FlagLong(&clientOptions.FollowBudget, "follow-budget", 0,
+		`Maximum number of requests per minute made to Reddit API for followed subreddits.`,
+	)
+
+	nRouterOpts.PageComments = 100
+	getopt.FlagLong(&nRouterOpts.PageComments, "page-comments", 0,
+		`Number of top level comments on a page of an archive. 0 shows all comments on one page.`,
+	)
+	nRouterOpts.PageDepth = 10
+	getopt.FlagLong(&nRouterOpts.PageDepth, "page-depth", 0,
+		`Levels of replies shown on a page of an archive.
+Deeper replies are linked to a page of their own. 0 shows all replies.`,
+	)
+
+	getopt.FlagLong(&nRouterOpts.BaseUrl, "base-url", 0,
+		`Address of the site, such as https://example.com, used in canonical links, sitemaps and feeds.
+By default the address requests are made to.`,
+	)
+	robotsFile := ""
+	getopt.FlagLong(&robotsFile, "robots", 0,
+		`File served as /robots.txt. By default crawlers are allowed on archive pages and pointed to the sitemap.`,
+	)
+
+	getopt.SetParameters("[command [arguments]]")
 	getopt.SetUsage(func() {
 		getopt.PrintUsage(os.Stderr)
 		os.Stderr.WriteString(`
+Without a command the server is started. Commands exit with 0 on success, 1 if any thread failed
+and 2 on invalid arguments. Commands:
+
+serve
+	Start the server.
+archive thread ...
+	Archive threads given as URLs or IDs, waiting for each to be written.
+show [--format html|md|txt|json|epub] [--sort order] [--page n] [--context n] id
+	Write the archive page of a thread (thread-id), continuing page (thread-id-reply-id) or comment
+	(thread-id/c/comment-id), or an export of the whole thread, to the standard output.
+delete thread-id ...
+	Take down archived threads, removing them with their snapshots.
+stats
+	Print counts of the archived threads, comments, snapshots and media.
+vacuum
+	Remove data no archived thread refers to and compact the database.
+verify
+	Check the database, the stored API responses, that every thread can be shown and that media files
+	are intact. Exits with 1 if problems are found.
+reparse [thread-id ...]
+	Rebuild archived threads from the API responses stored with their latest snapshot.
+watch add [--interval 30m] [--duration 48h] thread ...
+	Archive threads again at an interval, when they have changed, until the duration has passed.
+watch list
+	List the threads on the watchlist.
+watch remove thread-id ...
+	Remove threads from the watchlist.
+follow add [--listings new,top] [--min-score n] [--min-comments n] [--flair a,b] [--min-age d] [--max-age d] subreddit
+	Archive threads of the subreddit's listings that match the rules.
+follow list
+	List the followed subreddits.
+follow remove subreddit ...
+	Stop following subreddits.
+import [--staging file] dump ...
+	Import threads from Pushshift style NDJSON dumps of submissions and comments, compressed with zstd if
+	ending in .zst. An interrupted import continues where it stopped when run again.
+export [--format md|txt|json|epub] [--output dir] thread-id ...
+	Write archived threads with all their comments as Markdown, plain text, JSON or EPUB.
+export-warc [--output file] [--base-url url] thread-id ...
+	Write a WARC file of the threads with the stored API responses and the rendered archive pages.
+
 Make sure the following environment variables are defined to access Reddit API.
 They are defined by creating a 'script' type application on: https://www.reddit.com/prefs/apps
 
@@ -141,13 +258,69 @@ REDDIT_APP_ID
 	ID of the script application.
 REDDIT_APP_SECRET
 	Secret of the application.
+
+BETTIT_ADMIN_TOKEN
+	Enables the admin API under /api/admin for requests with the header "Authorization: Bearer <token>".
 `)
 	})
 	getopt.Parse()
 
+	// Pages rendered by commands follow the same options as the server's, and
+	// logs go to the standard error to keep the output of commands clean.
+	routerOptions = nRouterOpts
+	command := getopt.Arg(0)
+	if command != "" && command != "serve" {
+		log.SetOutput(os.Stderr)
+	}
+
+	switch command {
+	case "", "serve":
+	case "archive":
+		os.Exit(cmdArchive(getopt.Args()))
+	case "show":
+		os.Exit(cmdShow(getopt.Args()))
+	case "delete":
+		os.Exit(cmdDelete(getopt.Args()))
+	case "stats":
+		os.Exit(cmdStats(getopt.Args()))
+	case "vacuum":
+		os.Exit(cmdVacuum(getopt.Args()))
+	case "verify":
+		os.Exit(cmdVerify(getopt.Args()))
+	case "reparse":
+		os.Exit(cmdReparse(getopt.Args()))
+	case "watch":
+		os.Exit(cmdWatch(getopt.Args()))
+	case "follow":
+		os.Exit(cmdFollow(getopt.Args()))
+	case "import":
+		os.Exit(cmdImport(getopt.Args()))
+	case "export":
+		os.Exit(cmdExport(getopt.Args()))
+	case "export-warc":
+		os.Exit(cmdExportWarc(getopt.Args()))
+	default:
+		Log("Unknown command", command).Error()
+		getopt.Usage()
+		os.Exit(2)
+	}
+
 	apiToken = FetchAPIToken()
 	InitDatabase()
+	InitMedia()
 	LoadTemplates()
+	go (&watcher{systemClock{}, fetchRedditPage}).run(WATCH_TICK)
+	budget := newApiBudget(clientOptions.FollowBudget)
+	go newFollower(systemClock{}, budget.fetchListing, budget.limit(fetchRedditPage)).run(WATCH_TICK)
+	go newWebhookSender(systemClock{}).run(WEBHOOK_TICK)
+	nRouterOpts.AdminToken = os.Getenv("BETTIT_ADMIN_TOKEN")
+	if robotsFile != "" {
+		robots, err := ioutil.ReadFile(robotsFile)
+		if err != nil {
+			Log("Error reading robots.txt", err.Error()).Fatal()
+		}
+		nRouterOpts.Robots = string(robots)
+	}
 	r := GettitRouter(nRouterOpts)
 	r.Static("/res", "./public")
 	r.Run()
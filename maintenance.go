@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ilmari-h/bettit/media"
+	"github.com/tidwall/gjson"
+)
+
+//
+// Upkeep of the database and media files, run from the command line.
+//
+
+type ArchiveStats struct {
+	Threads       int64
+	Subreddits    int64
+	Comments      int64
+	Snapshots     int64
+	StoredPages   int64
+	StoredBytes   int64 // Compressed size of the stored API responses.
+	MediaFiles    int64
+	MediaBytes    int64
+	Watchlist     int64
+	Follows       int64
+	Webhooks      int64
+	PendingHooks  int64 // Webhook deliveries waiting to be sent.
+	DeadHooks     int64
+	FirstArchive  int64
+	LatestArchive int64
+	DatabaseBytes int64
+}
+
+func queryStats() (*ArchiveStats, error) {
+	stats := &ArchiveStats{}
+	for _, q := range []struct {
+		query string
+		dest  []interface{}
+	}{
+		{`SELECT COUNT(*), COUNT(DISTINCT sub) FROM threads WHERE continuing_reply = ""`, []interface{}{&stats.Threads, &stats.Subreddits}},
+		{`SELECT COUNT(*) FROM comments`, []interface{}{&stats.Comments}},
+		{`SELECT COUNT(*), IFNULL(MIN(archive_timestamp), 0), IFNULL(MAX(archive_timestamp), 0) FROM snapshots`,
+			[]interface{}{&stats.Snapshots, &stats.FirstArchive, &stats.LatestArchive}},
+		{`SELECT COUNT(*), IFNULL(SUM(LENGTH(data)), 0) FROM raw_pages`, []interface{}{&stats.StoredPages, &stats.StoredBytes}},
+		{`SELECT COUNT(DISTINCT hash), IFNULL(SUM(size), 0) FROM media`, []interface{}{&stats.MediaFiles, &stats.MediaBytes}},
+		{`SELECT COUNT(*) FROM watchlist`, []interface{}{&stats.Watchlist}},
+		{`SELECT COUNT(*) FROM follows`, []interface{}{&stats.Follows}},
+		{`SELECT COUNT(*) FROM webhooks`, []interface{}{&stats.Webhooks}},
+		{`SELECT COUNT(*) - IFNULL(SUM(dead), 0), IFNULL(SUM(dead), 0) FROM webhook_deliveries`,
+			[]interface{}{&stats.PendingHooks, &stats.DeadHooks}},
+	} {
+		if err := dbReadOnly.QueryRow(q.query).Scan(q.dest...); err != nil {
+			return nil, LogE(&DbError{"Error in stats query", err.Error()})
+		}
+	}
+	if info, err := os.Stat(DBFILE); err == nil {
+		stats.DatabaseBytes = info.Size()
+	}
+	return stats, nil
+}
+
+// Rows left behind by threads that are gone, such as comments of replaced
+// rows and pages of removed snapshots.
+var orphanQueries = []struct {
+	name  string
+	query string
+}{
+	{"comments", `DELETE FROM comments WHERE thread_key NOT IN (SELECT id FROM threads)`},
+	{"stored pages", `DELETE FROM raw_pages WHERE snapshot_id NOT IN (SELECT id FROM snapshots)`},
+	{"polls", `DELETE FROM polls WHERE snapshot_id NOT IN (SELECT id FROM snapshots)`},
+	{"poll options", `DELETE FROM poll_options WHERE snapshot_id NOT IN (SELECT id FROM snapshots)`},
+	{"media", `DELETE FROM media WHERE url NOT IN (SELECT url FROM thread_media)`},
+	{"webhook deliveries", `DELETE FROM webhook_deliveries WHERE webhook_id NOT IN (SELECT id FROM webhooks)`},
+}
+
+// Remove orphaned rows and media files no thread refers to, and rebuild the
+// database file to return the space to the file system. Returns the number
+// of rows removed of each kind and the number of files removed.
+func vacuumDatabase() (map[string]int64, int64, error) {
+	hashes := map[string]bool{}
+	if rows, err := dbReadOnly.Query(`SELECT DISTINCT hash FROM media`); err != nil {
+		return nil, 0, LogE(&DbError{"Error in media query", err.Error()})
+	} else {
+		for rows.Next() {
+			hash := ""
+			rows.Scan(&hash)
+			hashes[hash] = true
+		}
+		rows.Close()
+	}
+
+	tx, txErr := NewTransaction(false)
+	if txErr != nil {
+		return nil, 0, LogE(&DbError{"Error starting transaction", txErr.Error()})
+	}
+	removed := map[string]int64{}
+	for _, o := range orphanQueries {
+		res, err := tx.tx.Exec(o.query)
+		if err != nil {
+			tx.rollback()
+			return nil, 0, LogE(&DbError{"Error removing orphaned " + o.name, err.Error()})
+		}
+		removed[o.name], _ = res.RowsAffected()
+	}
+	tx.done()
+
+	// Files are shared by URLs with the same content, so only those of
+	// hashes no longer in the table are removed.
+	files := int64(0)
+	if mediaStore != nil {
+		rows, err := dbReadOnly.Query(`SELECT DISTINCT hash FROM media`)
+		if err != nil {
+			return nil, 0, LogE(&DbError{"Error in media query", err.Error()})
+		}
+		for rows.Next() {
+			hash := ""
+			rows.Scan(&hash)
+			delete(hashes, hash)
+		}
+		rows.Close()
+		for hash := range hashes {
+			if media.ValidHash(hash) && mediaStore.Has(hash) && os.Remove(mediaStore.Path(hash)) == nil {
+				files++
+			}
+		}
+	}
+
+	// VACUUM cannot run inside a transaction.
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=rw&_busy_timeout=9999999", DBFILE))
+	if err != nil {
+		return nil, 0, LogE(&DbError{"Error opening database", err.Error()})
+	}
+	defer db.Close()
+	if _, err := db.Exec(`VACUUM`); err != nil {
+		return nil, 0, LogE(&DbError{"Error vacuuming database", err.Error()})
+	}
+	return removed, files, nil
+}
+
+// Check the database file, that the stored API responses can be read and
+// every archived thread rendered, and that archived media files are intact.
+// Returns a description of each problem found.
+func verifyArchive() ([]string, error) {
+	problems := []string{}
+
+	integrity, err := dbReadOnly.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return nil, LogE(&DbError{"Error checking database integrity", err.Error()})
+	}
+	for integrity.Next() {
+		result := ""
+		integrity.Scan(&result)
+		if result != "ok" {
+			problems = append(problems, "database: "+result)
+		}
+	}
+	integrity.Close()
+
+	pages, err := dbReadOnly.Query(`
+		SELECT s.thread_id, p.id, p.data
+		FROM raw_pages p JOIN snapshots s ON p.snapshot_id = s.id
+		ORDER BY p.id`,
+	)
+	if err != nil {
+		return nil, LogE(&DbError{"Error in raw page query", err.Error()})
+	}
+	for pages.Next() {
+		threadId, pageId, compressed := "", int64(0), []byte{}
+		pages.Scan(&threadId, &pageId, &compressed)
+		if data, err := decompressRaw(compressed); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: stored page %d: %s", threadId, pageId, err.Error()))
+		} else if !gjson.ValidBytes(data) {
+			problems = append(problems, fmt.Sprintf("%s: stored page %d is not valid JSON", threadId, pageId))
+		}
+	}
+	pages.Close()
+
+	threadIds := []string{}
+	threads, err := dbReadOnly.Query(`SELECT thread_id FROM threads WHERE continuing_reply = "" ORDER BY thread_id`)
+	if err != nil {
+		return nil, LogE(&DbError{"Error in thread query", err.Error()})
+	}
+	for threads.Next() {
+		threadId := ""
+		threads.Scan(&threadId)
+		threadIds = append(threadIds, threadId)
+	}
+	threads.Close()
+	for _, threadId := range threadIds {
+		if arch, err := GetArchiveQuery(threadId, "", "", 0); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", threadId, err.Error()))
+		} else if arch == nil {
+			problems = append(problems, fmt.Sprintf("%s: archive page not found", threadId))
+		}
+	}
+
+	if mediaStore == nil {
+		return problems, nil
+	}
+	mediaRows, err := dbReadOnly.Query(`SELECT DISTINCT hash FROM media ORDER BY hash`)
+	if err != nil {
+		return nil, LogE(&DbError{"Error in media query", err.Error()})
+	}
+	hashes := []string{}
+	for mediaRows.Next() {
+		hash := ""
+		mediaRows.Scan(&hash)
+		hashes = append(hashes, hash)
+	}
+	mediaRows.Close()
+	for _, hash := range hashes {
+		f, err := mediaStore.Open(hash)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("media %s: %s", hash, err.Error()))
+			continue
+		}
+		sum := sha256.New()
+		_, err = io.Copy(sum, f)
+		f.Close()
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("media %s: %s", hash, err.Error()))
+		} else if hex.EncodeToString(sum.Sum(nil)) != hash {
+			problems = append(problems, fmt.Sprintf("media %s: content does not match its hash", hash))
+		}
+	}
+	return problems, nil
+}
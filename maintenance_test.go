@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckArchived(t *testing.T) {
+	useTestDatabase(t)
+	assert.Nil(t, writeArchive(parseThreadPage(testPageJson("abc123", testCommentJson("c1")), "test", ""), false))
+
+	archived, upsert := checkArchived(testPageJson("abc123"))
+	assert.True(t, archived)
+	assert.False(t, upsert)
+	archived, upsert = checkArchived(testPostPageJson(testPostJson("abc123", 5)))
+	assert.False(t, archived)
+	assert.True(t, upsert)
+	archived, upsert = checkArchived(testPageJson("def456"))
+	assert.False(t, archived)
+	assert.False(t, upsert)
+}
+
+func TestMaintenance(t *testing.T) {
+	useTestDatabase(t)
+	useTestMedia(t)
+
+	img := new(bytes.Buffer)
+	png.Encode(img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img.Bytes())
+	}))
+	defer server.Close()
+
+	post := testPostJson("abc123", 1)
+	post["url_overridden_by_dest"] = server.URL + "/post.png"
+	root := parseThreadPage(testPostPageJson(post, testCommentJson("c1")), "test", "")
+	fetchMedia(root, 2)
+	if !assert.Len(t, root.Media, 1) {
+		return
+	}
+	assert.Nil(t, writeArchive(root, false))
+	other := testPostJson("def456", 0)
+	other["subreddit"] = "other"
+	assert.Nil(t, writeArchive(parseThreadPage(testPostPageJson(other), "other", ""), false))
+
+	stats, err := queryStats()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), stats.Threads)
+	assert.Equal(t, int64(2), stats.Subreddits)
+	assert.Equal(t, int64(1), stats.Comments)
+	assert.Equal(t, int64(2), stats.Snapshots)
+	assert.Equal(t, int64(1), stats.MediaFiles)
+	assert.Equal(t, int64(img.Len()), stats.MediaBytes)
+	assert.Greater(t, stats.DatabaseBytes, int64(0))
+
+	problems, err := verifyArchive()
+	assert.Nil(t, err)
+	assert.Empty(t, problems)
+
+	// Damaged media files are reported.
+	path := mediaStore.Path(root.Media[0].Hash)
+	assert.Nil(t, os.WriteFile(path, []byte("damaged"), 0644))
+	problems, err = verifyArchive()
+	assert.Nil(t, err)
+	if assert.Len(t, problems, 1) {
+		assert.Contains(t, problems[0], "content does not match its hash")
+	}
+	assert.Nil(t, os.WriteFile(path, img.Bytes(), 0644))
+
+	// Media of taken down threads is removed along with the files, once no
+	// other thread refers to the same content.
+	hash := root.Media[0].Hash
+	shared := testPostJson("ghi789", 0)
+	shared["url_overridden_by_dest"] = server.URL + "/shared.png"
+	sharedRoot := parseThreadPage(testPostPageJson(shared), "test", "")
+	fetchMedia(sharedRoot, 2)
+	assert.Nil(t, writeArchive(sharedRoot, false))
+	removed, err := takedownThread("abc123")
+	assert.Nil(t, err)
+	assert.True(t, removed)
+	assert.True(t, mediaStore.Has(hash))
+	removed, err = takedownThread("ghi789")
+	assert.Nil(t, err)
+	assert.True(t, removed)
+	assert.False(t, mediaStore.Has(hash))
+	orphans, files, err := vacuumDatabase()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), orphans["media"])
+	assert.Equal(t, int64(0), files)
+
+	stats, _ = queryStats()
+	assert.Equal(t, int64(1), stats.Threads)
+	assert.Equal(t, int64(0), stats.Comments)
+	assert.Equal(t, int64(0), stats.MediaFiles)
+
+	// Damaged stored responses are reported.
+	_, err = execTransaction(`UPDATE raw_pages SET data = x'00'`)
+	assert.Nil(t, err)
+	problems, err = verifyArchive()
+	assert.Nil(t, err)
+	if assert.Len(t, problems, 1) {
+		assert.Contains(t, problems[0], "def456: stored page")
+	}
+}
+
+func TestDeleteCommand(t *testing.T) {
+	useTestDatabase(t)
+	img := new(bytes.Buffer)
+	png.Encode(img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img.Bytes())
+	}))
+	defer server.Close()
+
+	clientOptions.MediaDir = t.TempDir()
+	defer func() { clientOptions.MediaDir = "" }()
+	InitMedia()
+	mediaFetcher.AllowPrivate = true
+	post := testPostJson("abc123", 0)
+	post["url_overridden_by_dest"] = server.URL + "/post.png"
+	root := parseThreadPage(testPostPageJson(post), "test", "")
+	fetchMedia(root, 2)
+	if !assert.Len(t, root.Media, 1) {
+		return
+	}
+	assert.Nil(t, writeArchive(root, false))
+	path := mediaStore.Path(root.Media[0].Hash)
+
+	// The command opens the media directory itself to remove the files.
+	mediaStore, mediaFetcher = nil, nil
+	defer func() { mediaStore, mediaFetcher = nil, nil }()
+	assert.Equal(t, 0, cmdDelete([]string{"delete", "abc123"}))
+	assert.False(t, threadArchived("abc123"))
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 1, cmdDelete([]string{"delete", "abc123"}))
+}
@@ -0,0 +1,139 @@
+package media
+
+import (
+	"encoding/xml"
+	"net/url"
+	"strings"
+)
+
+// Manifests are small, anything larger is not a manifest.
+const MAX_MANIFEST_BYTES = 1024 * 1024
+
+//
+// Archiving of videos hosted by Reddit. Reddit serves the video and audio of a
+// post as separate streams listed in a DASH manifest; the best streams within
+// the limits are downloaded and combined into one MP4 file.
+//
+
+type dashRepresentation struct {
+	Id        string `xml:"id,attr"`
+	Bandwidth int    `xml:"bandwidth,attr"`
+	Height    int    `xml:"height,attr"`
+	MimeType  string `xml:"mimeType,attr"`
+	BaseURL   string `xml:"BaseURL"`
+}
+
+type dashAdaptationSet struct {
+	ContentType     string               `xml:"contentType,attr"`
+	MimeType        string               `xml:"mimeType,attr"`
+	Representations []dashRepresentation `xml:"Representation"`
+}
+
+type dashManifest struct {
+	Periods []struct {
+		AdaptationSets []dashAdaptationSet `xml:"AdaptationSet"`
+	} `xml:"Period"`
+}
+
+// Either "video" or "audio", or empty for other streams such as subtitles.
+func (set *dashAdaptationSet) kind(rep *dashRepresentation) string {
+	for _, t := range []string{set.ContentType, set.MimeType, rep.MimeType} {
+		if strings.HasPrefix(t, "video") {
+			return "video"
+		}
+		if strings.HasPrefix(t, "audio") {
+			return "audio"
+		}
+	}
+	return ""
+}
+
+// Highest bandwidth video stream no higher than maxHeight, or of any height if
+// maxHeight is 0, and the highest bandwidth audio stream. Either is nil if
+// there is none; videos without sound have no audio stream.
+func (m *dashManifest) selectStreams(maxHeight int) (*dashRepresentation, *dashRepresentation) {
+	var video, audio *dashRepresentation
+	for _, period := range m.Periods {
+		for i := range period.AdaptationSets {
+			set := &period.AdaptationSets[i]
+			for j := range set.Representations {
+				rep := &set.Representations[j]
+				switch set.kind(rep) {
+				case "video":
+					if (maxHeight == 0 || rep.Height <= maxHeight) &&
+						(video == nil || rep.Bandwidth > video.Bandwidth) {
+						video = rep
+					}
+				case "audio":
+					if audio == nil || rep.Bandwidth > audio.Bandwidth {
+						audio = rep
+					}
+				}
+			}
+		}
+	}
+	return video, audio
+}
+
+func (f *Fetcher) fetchVideo(ref Ref) (*Item, error) {
+	if f.VideoMaxBytes <= 0 {
+		return nil, &MediaError{ref.Url, "video archiving disabled"}
+	}
+	anyType := func(string) bool { return true }
+
+	manifestData, err := f.get(ref.Url, MAX_MANIFEST_BYTES, anyType)
+	if err != nil {
+		return nil, err
+	}
+	manifest := dashManifest{}
+	if err := xml.Unmarshal(manifestData, &manifest); err != nil {
+		return nil, &MediaError{ref.Url, "invalid manifest: " + err.Error()}
+	}
+	video, audio := manifest.selectStreams(f.VideoMaxHeight)
+	if video == nil {
+		return nil, &MediaError{ref.Url, "no video stream within limits"}
+	}
+
+	// Stream URLs are relative to the manifest.
+	base, err := url.Parse(ref.Url)
+	if err != nil {
+		return nil, &MediaError{ref.Url, err.Error()}
+	}
+	streamUrl := func(rep *dashRepresentation) (string, error) {
+		u, err := url.Parse(strings.TrimSpace(rep.BaseURL))
+		if err != nil {
+			return "", &MediaError{ref.Url, "invalid stream url: " + err.Error()}
+		}
+		return base.ResolveReference(u).String(), nil
+	}
+
+	// The size limit is for both streams together.
+	videoUrl, err := streamUrl(video)
+	if err != nil {
+		return nil, err
+	}
+	videoData, err := f.get(videoUrl, f.VideoMaxBytes, anyType)
+	if err != nil {
+		return nil, err
+	}
+	var audioData []byte
+	if audio != nil {
+		audioUrl, err := streamUrl(audio)
+		if err != nil {
+			return nil, err
+		}
+		if audioData, err = f.get(audioUrl, f.VideoMaxBytes-int64(len(videoData)), anyType); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := MuxDash(videoData, audioData)
+	if err != nil {
+		return nil, &MediaError{ref.Url, err.Error()}
+	}
+	hash, err := f.Store.Put(data)
+	if err != nil {
+		return nil, &MediaError{ref.Url, err.Error()}
+	}
+	return &Item{ref, hash, "video/mp4", int64(len(data))}, nil
+}
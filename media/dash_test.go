@@ -0,0 +1,193 @@
+package media
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+// The files in testdata/dash follow the layout of the streams of a v.redd.it
+// video: a manifest and fragmented MP4 files of one track each, every fragment
+// holding a single sample with the text "<file> fragment <n>".
+
+func testDashServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata/dash")))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testDashFile(t *testing.T, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata/dash", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+type testSample struct {
+	track uint32
+	data  string
+}
+
+// Read the track IDs of the file and the samples of every fragment, following
+// the data offsets the way a player does.
+func readMuxed(t *testing.T, data []byte) ([]uint32, []testSample) {
+	top, err := readBoxes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := []uint32{}
+	samples := []testSample{}
+	sequence := uint32(0)
+	for _, b := range top {
+		switch b.typ {
+		case "moov":
+			moov, _ := readBoxes(b.data)
+			for _, trak := range moov {
+				if trak.typ == "trak" {
+					tkhd, _ := childBox(trak, "tkhd")
+					tracks = append(tracks, binary.BigEndian.Uint32(tkhd.data[12:]))
+				}
+			}
+			trex, _ := childBox(b, "mvex", "trex")
+			assert.Equal(t, uint32(1), binary.BigEndian.Uint32(trex.data[4:]))
+		case "moof":
+			mfhd, _ := childBox(b, "mfhd")
+			assert.Equal(t, sequence+1, binary.BigEndian.Uint32(mfhd.data[4:]))
+			sequence++
+
+			tfhd, _ := childBox(b, "traf", "tfhd")
+			trun, _ := childBox(b, "traf", "trun")
+			offset := int(binary.BigEndian.Uint32(trun.data[8:]))
+			size := int(binary.BigEndian.Uint32(trun.data[12:]))
+			samples = append(samples, testSample{
+				binary.BigEndian.Uint32(tfhd.data[4:]),
+				string(data[b.offset+offset : b.offset+offset+size]),
+			})
+		}
+	}
+	return tracks, samples
+}
+
+func TestMuxDash(t *testing.T) {
+	muxed, err := MuxDash(testDashFile(t, "DASH_720.mp4"), testDashFile(t, "DASH_AUDIO_128.mp4"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	tracks, samples := readMuxed(t, muxed)
+	assert.Equal(t, []uint32{1, 2}, tracks)
+	assert.Equal(t, []testSample{
+		{1, "DASH_720 fragment 0"},
+		{2, "DASH_AUDIO_128 fragment 0"},
+		{1, "DASH_720 fragment 1"},
+		{2, "DASH_AUDIO_128 fragment 1"},
+	}, samples)
+}
+
+// Durations in the movie timescale of the audio are converted to the one of
+// the video.
+func TestMuxDashTimescales(t *testing.T) {
+	audio := testDashFile(t, "DASH_AUDIO_128.mp4")
+	top, _ := readBoxes(audio)
+	moov, _ := findBox(top, "moov")
+	mvhd, _ := childBox(moov, "mvhd")
+	tkhd, _ := childBox(moov, "trak", "tkhd")
+	mehd, _ := childBox(moov, "mvex", "mehd")
+	binary.BigEndian.PutUint32(mvhd.data[12:], 44100)
+	binary.BigEndian.PutUint32(mvhd.data[16:], 132300)
+	binary.BigEndian.PutUint32(tkhd.data[20:], 132300)
+	binary.BigEndian.PutUint32(mehd.data[4:], 132300)
+
+	muxed, err := MuxDash(testDashFile(t, "DASH_720.mp4"), audio)
+	if !assert.Nil(t, err) {
+		return
+	}
+	top, _ = readBoxes(muxed)
+	moov, _ = findBox(top, "moov")
+	mvhd, _ = childBox(moov, "mvhd")
+	mehd, _ = childBox(moov, "mvex", "mehd")
+	assert.Equal(t, uint32(1000), binary.BigEndian.Uint32(mvhd.data[12:]))
+	assert.Equal(t, uint32(3000), binary.BigEndian.Uint32(mvhd.data[16:]))
+	assert.Equal(t, uint32(3000), binary.BigEndian.Uint32(mehd.data[4:]))
+	durations := []uint32{}
+	children, _ := readBoxes(moov.data)
+	for _, trak := range children {
+		if trak.typ == "trak" {
+			tkhd, _ := childBox(trak, "tkhd")
+			durations = append(durations, binary.BigEndian.Uint32(tkhd.data[20:]))
+		}
+	}
+	assert.Equal(t, []uint32{0, 3000}, durations)
+
+	_, samples := readMuxed(t, muxed)
+	assert.Len(t, samples, 4)
+}
+
+func TestMuxDashInvalid(t *testing.T) {
+	_, err := MuxDash([]byte("<html></html>"), nil)
+	assert.NotNil(t, err)
+
+	video := testDashFile(t, "DASH_720.mp4")
+	_, err = MuxDash(video, video[:len(video)-4])
+	assert.NotNil(t, err)
+}
+
+func TestFetchVideo(t *testing.T) {
+	server := testDashServer(t)
+	f := testFetcher(t, 1024)
+	f.VideoMaxBytes = 1024 * 1024
+	f.VideoMaxHeight = 480
+
+	item, err := f.Fetch(Ref{server.URL + "/DASHPlaylist.mpd?a=1&v=1&f=sd", KindVideo})
+	if !assert.Nil(t, err) || !assert.NotNil(t, item) {
+		return
+	}
+	assert.Equal(t, "video/mp4", item.Mime)
+
+	muxed, _ := os.ReadFile(f.Store.Path(item.Hash))
+	_, samples := readMuxed(t, muxed)
+	assert.Equal(t, testSample{1, "DASH_480 fragment 0"}, samples[0])
+	assert.Equal(t, testSample{2, "DASH_AUDIO_128 fragment 0"}, samples[1])
+}
+
+func TestFetchVideoLimits(t *testing.T) {
+	server := testDashServer(t)
+	manifest := server.URL + "/DASHPlaylist.mpd"
+
+	disabled := testFetcher(t, 1024*1024)
+	_, err := disabled.Fetch(Ref{manifest, KindVideo})
+	assert.NotNil(t, err)
+
+	// Both streams together exceed the limit.
+	small := testFetcher(t, 1024*1024)
+	small.VideoMaxBytes = 1200
+	_, err = small.Fetch(Ref{manifest, KindVideo})
+	assert.NotNil(t, err)
+
+	low := testFetcher(t, 1024*1024)
+	low.VideoMaxBytes = 1024 * 1024
+	low.VideoMaxHeight = 240
+	_, err = low.Fetch(Ref{manifest, KindVideo})
+	assert.NotNil(t, err)
+
+	entries, _ := os.ReadDir(small.Store.dir)
+	assert.Len(t, entries, 0)
+}
+
+func TestPostMediaVideo(t *testing.T) {
+	post := gjson.Parse(`{
+		"is_video": true,
+		"url_overridden_by_dest": "https://v.redd.it/abc",
+		"secure_media": {"reddit_video": {
+			"dash_url": "https://v.redd.it/abc/DASHPlaylist.mpd?a=1&amp;v=1&amp;f=sd",
+			"fallback_url": "https://v.redd.it/abc/DASH_720.mp4?source=fallback"
+		}}
+	}`)
+	assert.Equal(t, []Ref{{"https://v.redd.it/abc/DASHPlaylist.mpd?a=1&v=1&f=sd", KindVideo}}, PostMedia(post))
+}
@@ -0,0 +1,367 @@
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Kinds of media stored for a thread.
+const (
+	KindImage     = "image"     // Image the post links to.
+	KindGallery   = "gallery"   // Item of a Reddit gallery.
+	KindPreview   = "preview"   // Preview image generated by Reddit.
+	KindComment   = "comment"   // Image linked in a comment.
+	KindThumbnail = "thumbnail" // Thumbnail of a link post.
+	KindVideo     = "video"     // Video hosted by Reddit, referred to by its DASH manifest.
+)
+
+var DefaultTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+}
+
+var imageHosts = map[string]bool{
+	"i.redd.it":       true,
+	"preview.redd.it": true,
+	"i.imgur.com":     true,
+}
+
+var hrefPattern = regexp.MustCompile(`href="([^"]+)"`)
+
+type MediaError struct {
+	url    string
+	reason string
+}
+
+func (err *MediaError) Error() string {
+	return fmt.Sprintf("media %s: %s", err.url, err.reason)
+}
+
+// A media file referred to by an archived thread.
+type Ref struct {
+	Url  string
+	Kind string
+}
+
+// A downloaded media file.
+type Item struct {
+	Ref
+	Hash string
+	Mime string
+	Size int64
+}
+
+//
+// Content-addressed storage of media files. Files are named by the SHA-256
+// of their content, identical files are stored once.
+//
+
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Store{dir}, nil
+}
+
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func ValidHash(hash string) bool {
+	return hashPattern.MatchString(hash)
+}
+
+func (s *Store) Path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func (s *Store) Has(hash string) bool {
+	_, err := os.Stat(s.Path(hash))
+	return err == nil
+}
+
+func (s *Store) Open(hash string) (*os.File, error) {
+	if !ValidHash(hash) {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(s.Path(hash))
+}
+
+// Store the content and return its hash.
+func (s *Store) Put(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if s.Has(hash) {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path(hash)), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), s.Path(hash)); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return hash, nil
+}
+
+//
+// Downloading of media files.
+//
+
+type Fetcher struct {
+	Client    *http.Client
+	UserAgent string
+	MaxBytes  int64
+	Types     []string // Allowed MIME types.
+	Store     *Store
+
+	// Videos are not archived if VideoMaxBytes is 0. VideoMaxHeight limits the
+	// resolution of the video stream, 0 for any.
+	VideoMaxBytes  int64
+	VideoMaxHeight int
+
+	// Links in threads point anywhere, so connections to loopback, private
+	// and link-local addresses are refused unless AllowPrivate is set.
+	AllowPrivate bool
+}
+
+// Ranges refused besides those the net package classifies.
+var blockedNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"), // Carrier-grade NAT.
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func blockedIp(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checked on every connection after the host is resolved, so that neither
+// DNS names nor redirects can lead to a refused address.
+func (f *Fetcher) checkAddress(network string, address string, _ syscall.RawConn) error {
+	if f.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || blockedIp(ip) {
+		return fmt.Errorf("address not allowed: %s", host)
+	}
+	return nil
+}
+
+func NewFetcher(store *Store, maxBytes int64, timeout time.Duration) *Fetcher {
+	f := &Fetcher{
+		MaxBytes: maxBytes,
+		Types:    DefaultTypes,
+		Store:    store,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect on our behalf, past the address check.
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: timeout, Control: f.checkAddress}).DialContext
+	f.Client = &http.Client{Timeout: timeout, Transport: transport}
+	return f
+}
+
+func (f *Fetcher) allowed(mimeType string) bool {
+	for _, t := range f.Types {
+		if t == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+// Download a file of at most maxBytes. Responses of a type not accepted by
+// `allow` are rejected before reading them.
+func (f *Fetcher) get(u string, maxBytes int64, allow func(declared string) bool) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, &MediaError{u, err.Error()}
+	}
+	if f.UserAgent != "" {
+		req.Header.Set("User-Agent", f.UserAgent)
+	}
+	res, err := f.Client.Do(req)
+	if err != nil {
+		return nil, &MediaError{u, err.Error()}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &MediaError{u, res.Status}
+	}
+	if res.ContentLength > maxBytes {
+		return nil, &MediaError{u, "too large"}
+	}
+	if declared, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); declared != "" && !allow(declared) {
+		return nil, &MediaError{u, "type not allowed: " + declared}
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	if err != nil {
+		return nil, &MediaError{u, err.Error()}
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, &MediaError{u, "too large"}
+	}
+	return data, nil
+}
+
+// Download a media file into the store. Files over the size limit or of a type
+// not allowed are rejected.
+func (f *Fetcher) Fetch(ref Ref) (*Item, error) {
+	if ref.Kind == KindVideo {
+		return f.fetchVideo(ref)
+	}
+
+	data, err := f.get(ref.Url, f.MaxBytes, f.allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trust the content over the declared type.
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+	if !f.allowed(sniffed) {
+		return nil, &MediaError{ref.Url, "type not allowed: " + sniffed}
+	}
+
+	hash, err := f.Store.Put(data)
+	if err != nil {
+		return nil, &MediaError{ref.Url, err.Error()}
+	}
+	return &Item{ref, hash, sniffed, int64(len(data))}, nil
+}
+
+//
+// Finding media in API responses.
+//
+
+// Strings in API responses are HTML escaped.
+func unescapeUrl(u string) string {
+	return html.UnescapeString(u)
+}
+
+func isImageUrl(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return false
+	}
+	return imageHosts[parsed.Hostname()] || imageExtensions[strings.ToLower(path.Ext(parsed.Path))]
+}
+
+func appendRef(refs []Ref, seen map[string]bool, u string, kind string) []Ref {
+	u = unescapeUrl(u)
+	if u == "" || seen[u] {
+		return refs
+	}
+	seen[u] = true
+	return append(refs, Ref{u, kind})
+}
+
+// Media of a post: the linked image, gallery items, preview images and video.
+func PostMedia(post gjson.Result) []Ref {
+	refs := []Ref{}
+	seen := map[string]bool{}
+
+	if link := post.Get("url_overridden_by_dest").String(); isImageUrl(unescapeUrl(link)) {
+		refs = appendRef(refs, seen, link, KindImage)
+	}
+
+	// Gallery items are listed in gallery_data in order, their files in media_metadata.
+	metadata := post.Get("media_metadata").Map()
+	for _, item := range post.Get("gallery_data.items").Array() {
+		meta := metadata[item.Get("media_id").String()]
+		source := meta.Get("s.u").String()
+		if source == "" {
+			source = meta.Get("s.gif").String()
+		}
+		refs = appendRef(refs, seen, source, KindGallery)
+	}
+
+	for _, image := range post.Get("preview.images").Array() {
+		refs = appendRef(refs, seen, image.Get("source.url").String(), KindPreview)
+	}
+
+	// Reddit hosted videos, the manifest lists the available streams.
+	for _, path := range []string{"secure_media.reddit_video.dash_url", "media.reddit_video.dash_url"} {
+		if manifest := post.Get(path).String(); manifest != "" {
+			refs = appendRef(refs, seen, manifest, KindVideo)
+			break
+		}
+	}
+
+	// Self posts have keywords such as "self" or "default" in place of a thumbnail.
+	if thumbnail := post.Get("thumbnail").String(); isImageUrl(unescapeUrl(thumbnail)) {
+		refs = appendRef(refs, seen, thumbnail, KindThumbnail)
+	}
+	return refs
+}
+
+// Images linked in the HTML of a comment, and images embedded in it.
+func CommentMedia(comment gjson.Result) []Ref {
+	refs := []Ref{}
+	seen := map[string]bool{}
+
+	for _, meta := range comment.Get("media_metadata").Map() {
+		refs = appendRef(refs, seen, meta.Get("s.u").String(), KindComment)
+	}
+
+	// body_html is escaped once more than the links in it.
+	body := html.UnescapeString(comment.Get("body_html").String())
+	for _, match := range hrefPattern.FindAllStringSubmatch(body, -1) {
+		if u := unescapeUrl(match[1]); isImageUrl(u) {
+			refs = appendRef(refs, seen, u, KindComment)
+		}
+	}
+	return refs
+}
@@ -0,0 +1,174 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+)
+
+func testPng(t *testing.T, size int) []byte {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, image.NewRGBA(image.Rect(0, 0, size, size))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Server with fixture files, the same image is served at two paths.
+func testServer(t *testing.T) *httptest.Server {
+	small := testPng(t, 4)
+	large := testPng(t, 256)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(small)
+	})
+	mux.HandleFunc("/b.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(small)
+	})
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(large)
+	})
+	// Declares no length or type, must be caught while reading.
+	mux.HandleFunc("/large-chunked", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "")
+		w.(http.Flusher).Flush()
+		w.Write(large)
+	})
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>not an image</body></html>"))
+	})
+	// Claims to be an image but is not.
+	mux.HandleFunc("/fake.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("<html><body>not an image</body></html>"))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func testFetcher(t *testing.T, maxBytes int64) *Fetcher {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFetcher(store, maxBytes, 5*time.Second)
+	f.AllowPrivate = true
+	return f
+}
+
+func TestFetchDeduplicates(t *testing.T) {
+	server := testServer(t)
+	f := testFetcher(t, 1024*1024)
+
+	a, err := f.Fetch(Ref{server.URL + "/a.png", KindImage})
+	assert.Nil(t, err)
+	b, err := f.Fetch(Ref{server.URL + "/b.png", KindImage})
+	assert.Nil(t, err)
+	if assert.NotNil(t, a) && assert.NotNil(t, b) {
+		assert.Equal(t, a.Hash, b.Hash)
+		assert.Equal(t, "image/png", a.Mime)
+		assert.True(t, f.Store.Has(a.Hash))
+
+		entries, _ := os.ReadDir(f.Store.dir)
+		assert.Len(t, entries, 1)
+	}
+}
+
+func TestFetchRejects(t *testing.T) {
+	server := testServer(t)
+	f := testFetcher(t, 1024)
+
+	for _, path := range []string{"/large.png", "/large-chunked", "/page.html", "/fake.png", "/missing.png"} {
+		item, err := f.Fetch(Ref{server.URL + path, KindImage})
+		assert.Nil(t, item, path)
+		assert.NotNil(t, err, path)
+	}
+	entries, _ := os.ReadDir(f.Store.dir)
+	assert.Len(t, entries, 0)
+}
+
+func TestFetchRefusesPrivate(t *testing.T) {
+	server := testServer(t)
+	f := testFetcher(t, 1024*1024)
+	f.AllowPrivate = false
+
+	_, err := f.Fetch(Ref{server.URL + "/a.png", KindImage})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "address not allowed")
+	}
+
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "100.64.0.1", "0.0.0.0", "::1", "fd00::1", "fe80::1", "::ffff:127.0.0.1"} {
+		assert.True(t, blockedIp(net.ParseIP(ip)), ip)
+	}
+	for _, ip := range []string{"151.101.1.140", "2a04:4e42::396"} {
+		assert.False(t, blockedIp(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestFetchAllowedTypes(t *testing.T) {
+	server := testServer(t)
+	f := testFetcher(t, 1024*1024)
+	f.Types = []string{"image/jpeg"}
+
+	_, err := f.Fetch(Ref{server.URL + "/a.png", KindImage})
+	assert.NotNil(t, err)
+}
+
+func TestStoreOpen(t *testing.T) {
+	store, _ := NewStore(t.TempDir())
+	hash, err := store.Put([]byte("data"))
+	assert.Nil(t, err)
+	assert.True(t, ValidHash(hash))
+
+	file, err := store.Open(hash)
+	if assert.Nil(t, err) {
+		file.Close()
+	}
+	_, err = store.Open("../" + hash)
+	assert.NotNil(t, err)
+}
+
+func TestPostMedia(t *testing.T) {
+	post := gjson.Parse(`{
+		"url_overridden_by_dest": "https://i.redd.it/abc.jpg",
+		"thumbnail": "https://b.thumbs.redditmedia.com/t.jpg",
+		"preview": {"images": [{"source": {"url": "https://preview.redd.it/abc.jpg?width=640&amp;s=x"}}]},
+		"gallery_data": {"items": [{"media_id": "m2"}, {"media_id": "m1"}]},
+		"media_metadata": {
+			"m1": {"s": {"u": "https://preview.redd.it/m1.jpg?s=1"}},
+			"m2": {"s": {"gif": "https://i.redd.it/m2.gif"}}
+		}
+	}`)
+
+	assert.Equal(t, []Ref{
+		{"https://i.redd.it/abc.jpg", KindImage},
+		{"https://i.redd.it/m2.gif", KindGallery},
+		{"https://preview.redd.it/m1.jpg?s=1", KindGallery},
+		{"https://preview.redd.it/abc.jpg?width=640&s=x", KindPreview},
+		{"https://b.thumbs.redditmedia.com/t.jpg", KindThumbnail},
+	}, PostMedia(post))
+
+	self := gjson.Parse(`{"url_overridden_by_dest": "https://example.com/article", "thumbnail": "self"}`)
+	assert.Empty(t, PostMedia(self))
+}
+
+func TestCommentMedia(t *testing.T) {
+	comment := gjson.Parse(`{
+		"body_html": "&lt;p&gt;&lt;a href=\"https://i.imgur.com/x.png\"&gt;pic&lt;/a&gt; &lt;a href=\"https://example.com/\"&gt;site&lt;/a&gt;&lt;/p&gt;"
+	}`)
+	assert.Equal(t, []Ref{{"https://i.imgur.com/x.png", KindComment}}, CommentMedia(comment))
+}
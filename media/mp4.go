@@ -0,0 +1,516 @@
+package media
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+//
+// Combining the separate video and audio files of a DASH stream into a single
+// MP4 file. Both files are fragmented MP4 with one track each; the result is a
+// fragmented MP4 with both tracks and the fragments of both files interleaved
+// by time. Media data is copied as is.
+//
+
+type Mp4Error struct {
+	reason string
+}
+
+func (err *Mp4Error) Error() string {
+	return "mp4: " + err.reason
+}
+
+type box struct {
+	typ    string
+	offset int    // Offset of the box in the data it was read from.
+	raw    []byte // The whole box.
+	data   []byte // Payload of the box.
+}
+
+// Read consecutive boxes. The boxes refer to the given data, not to copies of it.
+func readBoxes(data []byte) ([]box, error) {
+	boxes := []box{}
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < 8 {
+			return nil, &Mp4Error{"truncated box header"}
+		}
+		size := uint64(binary.BigEndian.Uint32(data[offset:]))
+		typ := string(data[offset+4 : offset+8])
+		header := uint64(8)
+		switch size {
+		case 0: // Box extends to the end of the data.
+			size = uint64(len(data) - offset)
+		case 1:
+			if len(data)-offset < 16 {
+				return nil, &Mp4Error{"truncated box header"}
+			}
+			size = binary.BigEndian.Uint64(data[offset+8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)-offset) {
+			return nil, &Mp4Error{"invalid size of box " + typ}
+		}
+		raw := data[offset : offset+int(size)]
+		boxes = append(boxes, box{typ, offset, raw, raw[header:]})
+		offset += int(size)
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []box, typ string) (box, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return box{}, false
+}
+
+func childBox(parent box, path ...string) (box, error) {
+	for _, typ := range path {
+		children, err := readBoxes(parent.data)
+		if err != nil {
+			return box{}, err
+		}
+		child, ok := findBox(children, typ)
+		if !ok {
+			return box{}, &Mp4Error{"missing box " + typ}
+		}
+		parent = child
+	}
+	return parent, nil
+}
+
+func appendBox(out []byte, typ string, payload []byte) []byte {
+	size := uint64(len(payload)) + 8
+	header := make([]byte, 8, 16)
+	if size > math.MaxUint32 {
+		binary.BigEndian.PutUint32(header, 1)
+		header = header[:16]
+		binary.BigEndian.PutUint64(header[8:], size+8)
+	} else {
+		binary.BigEndian.PutUint32(header, uint32(size))
+	}
+	copy(header[4:8], typ)
+	out = append(out, header...)
+	return append(out, payload...)
+}
+
+// Field of a full box, version 1 boxes have 64 bit times before the field.
+func fullBoxField(b box, v0Offset int, v1Offset int, size int) ([]byte, error) {
+	if len(b.data) < 4 {
+		return nil, &Mp4Error{"truncated box " + b.typ}
+	}
+	offset := v0Offset
+	if b.data[0] == 1 {
+		offset = v1Offset
+	}
+	if len(b.data) < offset+size {
+		return nil, &Mp4Error{"truncated box " + b.typ}
+	}
+	return b.data[offset : offset+size], nil
+}
+
+// Value of a 32 or 64 bit field.
+func fieldValue(field []byte) uint64 {
+	if len(field) == 8 {
+		return binary.BigEndian.Uint64(field)
+	}
+	return uint64(binary.BigEndian.Uint32(field))
+}
+
+func putFieldValue(field []byte, value uint64) error {
+	if len(field) == 8 {
+		binary.BigEndian.PutUint64(field, value)
+		return nil
+	}
+	if value > math.MaxUint32 {
+		return &Mp4Error{"duration out of range"}
+	}
+	binary.BigEndian.PutUint32(field, uint32(value))
+	return nil
+}
+
+// Convert a duration from one timescale to another. Durations of all ones
+// stand for an unknown duration and are kept as is.
+func rescaleField(field []byte, from uint32, to uint32) error {
+	value := fieldValue(field)
+	if from == to || value == math.MaxUint32 || value == math.MaxUint64 {
+		return nil
+	}
+	return putFieldValue(field, value/uint64(from)*uint64(to)+value%uint64(from)*uint64(to)/uint64(from))
+}
+
+func fullBoxFlags(b box) uint32 {
+	return binary.BigEndian.Uint32(b.data) & 0xffffff
+}
+
+type dashFragment struct {
+	moof box
+	mdat box
+	time float64 // Decode time of the first sample in seconds.
+}
+
+// A fragmented MP4 file of a single track.
+type dashTrack struct {
+	ftyp      box
+	mvhd      box
+	timescale uint32 // Timescale of the movie, used by the durations of mvhd, tkhd, elst and mehd.
+	trak      box
+	trex      box
+	mehd      *box
+	fragments []dashFragment
+}
+
+func parseTrack(data []byte) (*dashTrack, error) {
+	top, err := readBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	t := dashTrack{}
+	var moov *box
+	for i := 0; i < len(top); i++ {
+		switch top[i].typ {
+		case "ftyp":
+			t.ftyp = top[i]
+		case "moov":
+			moov = &top[i]
+		case "moof":
+			if i+1 >= len(top) || top[i+1].typ != "mdat" {
+				return nil, &Mp4Error{"fragment without media data"}
+			}
+			t.fragments = append(t.fragments, dashFragment{moof: top[i], mdat: top[i+1]})
+			i++
+		}
+	}
+	if t.ftyp.raw == nil || moov == nil {
+		return nil, &Mp4Error{"not an mp4 file"}
+	}
+
+	moovChildren, err := readBoxes(moov.data)
+	if err != nil {
+		return nil, err
+	}
+	traks := 0
+	for _, b := range moovChildren {
+		switch b.typ {
+		case "mvhd":
+			t.mvhd = b
+		case "trak":
+			t.trak = b
+			traks++
+		case "mvex":
+			mvex, err := readBoxes(b.data)
+			if err != nil {
+				return nil, err
+			}
+			t.trex, _ = findBox(mvex, "trex")
+			if mehd, ok := findBox(mvex, "mehd"); ok {
+				t.mehd = &mehd
+			}
+		}
+	}
+	if traks != 1 {
+		return nil, &Mp4Error{"expected a single track"}
+	}
+	if t.mvhd.raw == nil || t.trex.raw == nil || len(t.fragments) == 0 {
+		return nil, &Mp4Error{"not a fragmented mp4 file"}
+	}
+	movieTimescale, err := fullBoxField(t.mvhd, 12, 20, 4)
+	if err != nil {
+		return nil, err
+	}
+	t.timescale = binary.BigEndian.Uint32(movieTimescale)
+	if t.timescale == 0 {
+		return nil, &Mp4Error{"invalid timescale"}
+	}
+
+	mdhd, err := childBox(t.trak, "mdia", "mdhd")
+	if err != nil {
+		return nil, err
+	}
+	timescaleField, err := fullBoxField(mdhd, 12, 20, 4)
+	if err != nil {
+		return nil, err
+	}
+	timescale := binary.BigEndian.Uint32(timescaleField)
+	if timescale == 0 {
+		return nil, &Mp4Error{"invalid timescale"}
+	}
+
+	for i := range t.fragments {
+		tfdt, err := childBox(t.fragments[i].moof, "traf", "tfdt")
+		if err != nil {
+			// Without decode times fragments are kept in file order.
+			t.fragments[i].time = float64(i)
+			continue
+		}
+		field, err := fullBoxField(tfdt, 4, 4, 4)
+		if err != nil {
+			return nil, err
+		}
+		decodeTime := uint64(binary.BigEndian.Uint32(field))
+		if tfdt.data[0] == 1 {
+			field, err := fullBoxField(tfdt, 4, 4, 8)
+			if err != nil {
+				return nil, err
+			}
+			decodeTime = binary.BigEndian.Uint64(field)
+		}
+		t.fragments[i].time = float64(decodeTime) / float64(timescale)
+	}
+	return &t, nil
+}
+
+func clone(data []byte) []byte {
+	return append([]byte{}, data...)
+}
+
+// Duration of the movie in the given timescale.
+func (t *dashTrack) duration(timescale uint32) (uint64, error) {
+	mvhd := t.mvhd
+	mvhd.raw = clone(mvhd.raw)
+	mvhd.data = mvhd.raw[len(mvhd.raw)-len(mvhd.data):]
+	field, err := durationField(mvhd)
+	if err != nil {
+		return 0, err
+	}
+	if err := rescaleField(field, t.timescale, timescale); err != nil {
+		return 0, err
+	}
+	return fieldValue(field), nil
+}
+
+// Duration field of a mvhd box, 64 bit in version 1 boxes.
+func durationField(mvhd box) ([]byte, error) {
+	if len(mvhd.data) > 0 && mvhd.data[0] == 1 {
+		return fullBoxField(mvhd, 24, 24, 8)
+	}
+	return fullBoxField(mvhd, 16, 16, 4)
+}
+
+// Copy of the trak box with its track ID set and the durations of its header
+// and edit list converted to the given movie timescale.
+func (t *dashTrack) trakWithId(id uint32, timescale uint32) ([]byte, error) {
+	trak := t.trak
+	trak.raw = clone(trak.raw)
+	trak.data = trak.raw[len(trak.raw)-len(trak.data):]
+	tkhd, err := childBox(trak, "tkhd")
+	if err != nil {
+		return nil, err
+	}
+	field, err := fullBoxField(tkhd, 12, 20, 4)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(field, id)
+
+	size := 4
+	if tkhd.data[0] == 1 {
+		size = 8
+	}
+	if field, err = fullBoxField(tkhd, 20, 28, size); err != nil {
+		return nil, err
+	}
+	if err := rescaleField(field, t.timescale, timescale); err != nil {
+		return nil, err
+	}
+
+	elst, err := childBox(trak, "edts", "elst")
+	if err != nil {
+		// Edit lists are optional.
+		return trak.raw, nil
+	}
+	field, err = fullBoxField(elst, 4, 4, 4)
+	if err != nil {
+		return nil, err
+	}
+	entries, size, entrySize := int(binary.BigEndian.Uint32(field)), 4, 12
+	if elst.data[0] == 1 {
+		size, entrySize = 8, 20
+	}
+	for i := 0; i < entries; i++ {
+		field, err := fullBoxField(elst, 8+i*entrySize, 8+i*entrySize, size)
+		if err != nil {
+			return nil, err
+		}
+		if err := rescaleField(field, t.timescale, timescale); err != nil {
+			return nil, err
+		}
+	}
+	return trak.raw, nil
+}
+
+func (t *dashTrack) trexWithId(id uint32) ([]byte, error) {
+	trex := t.trex
+	trex.raw = clone(trex.raw)
+	trex.data = trex.raw[len(trex.raw)-len(trex.data):]
+	field, err := fullBoxField(trex, 4, 4, 4)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(field, id)
+	return trex.raw, nil
+}
+
+// Copy of the moof box of a fragment moved by `shift` bytes, with its sequence
+// number and track ID set.
+func (f *dashFragment) moofWithId(id uint32, sequence uint32, shift int64) ([]byte, error) {
+	moof := f.moof
+	moof.raw = clone(moof.raw)
+	moof.data = moof.raw[len(moof.raw)-len(moof.data):]
+
+	mfhd, err := childBox(moof, "mfhd")
+	if err != nil {
+		return nil, err
+	}
+	field, err := fullBoxField(mfhd, 4, 4, 4)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(field, sequence)
+
+	children, err := readBoxes(moof.data)
+	if err != nil {
+		return nil, err
+	}
+	for _, traf := range children {
+		if traf.typ != "traf" {
+			continue
+		}
+		tfhd, err := childBox(traf, "tfhd")
+		if err != nil {
+			return nil, err
+		}
+		field, err := fullBoxField(tfhd, 4, 4, 4)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(field, id)
+
+		// Data offsets are relative to the moof box unless an absolute base is given.
+		if fullBoxFlags(tfhd)&0x000001 != 0 {
+			field, err := fullBoxField(tfhd, 8, 8, 8)
+			if err != nil {
+				return nil, err
+			}
+			base := int64(binary.BigEndian.Uint64(field)) + shift
+			binary.BigEndian.PutUint64(field, uint64(base))
+		}
+	}
+	return moof.raw, nil
+}
+
+// Combine the video and audio of a DASH stream. The video is returned as is if
+// there is no audio.
+func MuxDash(video []byte, audio []byte) ([]byte, error) {
+	v, err := parseTrack(video)
+	if err != nil {
+		return nil, err
+	}
+	if audio == nil {
+		return video, nil
+	}
+	a, err := parseTrack(audio)
+	if err != nil {
+		return nil, err
+	}
+	tracks := []*dashTrack{v, a}
+
+	out := clone(v.ftyp.raw)
+
+	// Movie header of the video, with the next free track ID after both tracks
+	// and the duration of the longer track. Durations of the audio are
+	// converted to the timescale of the video.
+	mvhd := v.mvhd
+	mvhd.raw = clone(mvhd.raw)
+	mvhd.data = mvhd.raw[len(mvhd.raw)-len(mvhd.data):]
+	if len(mvhd.data) < 4 {
+		return nil, &Mp4Error{"truncated box mvhd"}
+	}
+	binary.BigEndian.PutUint32(mvhd.raw[len(mvhd.raw)-4:], uint32(len(tracks)+1))
+	duration, err := durationField(mvhd)
+	if err != nil {
+		return nil, err
+	}
+	audioDuration, err := a.duration(v.timescale)
+	if err != nil {
+		return nil, err
+	}
+	if audioDuration > fieldValue(duration) {
+		if err := putFieldValue(duration, audioDuration); err != nil {
+			return nil, err
+		}
+	}
+	moov := mvhd.raw
+
+	// The fragment duration of the longer track, if either file declares one.
+	mvex := []byte{}
+	var mehd *box
+	fragmentDuration := uint64(0)
+	for _, t := range tracks {
+		if t.mehd == nil {
+			continue
+		}
+		tMehd := *t.mehd
+		tMehd.raw = clone(tMehd.raw)
+		tMehd.data = tMehd.raw[len(tMehd.raw)-len(tMehd.data):]
+		size := 4
+		if len(tMehd.data) > 0 && tMehd.data[0] == 1 {
+			size = 8
+		}
+		field, err := fullBoxField(tMehd, 4, 4, size)
+		if err != nil {
+			return nil, err
+		}
+		if err := rescaleField(field, t.timescale, v.timescale); err != nil {
+			return nil, err
+		}
+		if mehd == nil || fieldValue(field) > fragmentDuration {
+			mehd, fragmentDuration = &tMehd, fieldValue(field)
+		}
+	}
+	if mehd != nil {
+		mvex = append(mvex, mehd.raw...)
+	}
+	for i, t := range tracks {
+		trak, err := t.trakWithId(uint32(i+1), v.timescale)
+		if err != nil {
+			return nil, err
+		}
+		trex, err := t.trexWithId(uint32(i + 1))
+		if err != nil {
+			return nil, err
+		}
+		moov = append(moov, trak...)
+		mvex = append(mvex, trex...)
+	}
+	moov = appendBox(moov, "mvex", mvex)
+	out = appendBox(out, "moov", moov)
+
+	// Interleave fragments by time, video first when equal.
+	next := make([]int, len(tracks))
+	for sequence := uint32(1); ; sequence++ {
+		pick := -1
+		for i, t := range tracks {
+			if next[i] < len(t.fragments) &&
+				(pick < 0 || t.fragments[next[i]].time < tracks[pick].fragments[next[pick]].time) {
+				pick = i
+			}
+		}
+		if pick < 0 {
+			break
+		}
+		fragment := tracks[pick].fragments[next[pick]]
+		next[pick]++
+
+		moof, err := fragment.moofWithId(uint32(pick+1), sequence, int64(len(out)-fragment.moof.offset))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, moof...)
+		out = append(out, fragment.mdat.raw...)
+	}
+	return out, nil
+}
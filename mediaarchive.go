@@ -0,0 +1,224 @@
+package main
+
+import (
+	"html"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ilmari-h/bettit/media"
+	"github.com/tidwall/gjson"
+)
+
+// Media archiving is enabled by setting a directory for the files.
+var mediaStore *media.Store
+var mediaFetcher *media.Fetcher
+
+func InitMedia() {
+	if clientOptions.MediaDir == "" {
+		return
+	}
+	store, err := media.NewStore(clientOptions.MediaDir)
+	if err != nil {
+		Log("Error opening media directory", err.Error()).Fatal()
+	}
+	mediaStore = store
+	mediaFetcher = media.NewFetcher(
+		store,
+		int64(clientOptions.MediaMaxSize)*1024*1024,
+		time.Second*time.Duration(clientOptions.Timeout),
+	)
+	mediaFetcher.UserAgent = userAgent
+	mediaFetcher.VideoMaxBytes = int64(clientOptions.VideoMaxSize) * 1024 * 1024
+	mediaFetcher.VideoMaxHeight = clientOptions.VideoMaxRes
+	if len(clientOptions.MediaTypes) > 0 {
+		mediaFetcher.Types = clientOptions.MediaTypes
+	}
+}
+
+// Media referred to by the post and comments of every page of the thread.
+func (page *ThreadPage) mediaRefs() []media.Ref {
+	refs := media.PostMedia(gjson.Parse(page.Post.Raw))
+	for _, p := range page.pages() {
+		queue := append([]*CommentData{}, p.Comments...)
+		for len(queue) > 0 {
+			c := queue[0]
+			queue = queue[1:]
+			refs = append(refs, media.CommentMedia(gjson.Parse(c.Raw))...)
+			queue = append(queue, c.Replies...)
+		}
+	}
+	return refs
+}
+
+// Already downloaded media file, nil if not found.
+func queryMediaItem(ref media.Ref) *media.Item {
+	rows, qErr := dbReadOnly.Query(`SELECT hash, mime, size FROM media WHERE url = ?`, ref.Url)
+	if qErr != nil {
+		return nil
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil
+	}
+	item := media.Item{Ref: ref}
+	rows.Scan(&item.Hash, &item.Mime, &item.Size)
+	if !mediaStore.Has(item.Hash) {
+		return nil
+	}
+	return &item
+}
+
+// Download the media of the thread, at most `workers` files at a time.
+// Files that fail to download are logged and left out.
+func fetchMedia(root *ThreadPage, workers int) {
+	if mediaFetcher == nil {
+		return
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	refs := root.mediaRefs()
+	items := make([]*media.Item, len(refs))
+	seen := map[string]bool{}
+	sem := make(chan struct{}, workers)
+	wg := sync.WaitGroup{}
+	for i, ref := range refs {
+		if seen[ref.Url] {
+			continue
+		}
+		seen[ref.Url] = true
+		if existing := queryMediaItem(ref); existing != nil {
+			items[i] = existing
+			continue
+		}
+		wg.Add(1)
+		go func(i int, ref media.Ref) {
+			defer wg.Done()
+			sem <- struct{}{}
+			item, err := mediaFetcher.Fetch(ref)
+			<-sem
+			if err != nil {
+				Log("Error archiving media", err.Error()).Warn()
+				return
+			}
+			items[i] = item
+		}(i, ref)
+	}
+	wg.Wait()
+
+	for _, item := range items {
+		if item != nil {
+			root.Media = append(root.Media, *item)
+		}
+	}
+}
+
+func (dbtx *ThreadDbTx) txPostMedia(root *ThreadPage) error {
+	for i, item := range root.Media {
+		if _, err := dbtx.tx.Exec(`
+			REPLACE INTO media (url, hash, mime, size) VALUES ( ?, ?, ?, ? );
+			`, item.Url, item.Hash, item.Mime, item.Size,
+		); err != nil {
+			return &DbError{"Error storing media", err.Error()}
+		}
+		if _, err := dbtx.tx.Exec(`
+			REPLACE INTO thread_media (thread_id, url, kind, position) VALUES ( ?, ?, ?, ? );
+			`, root.Post.Id, item.Url, item.Kind, i,
+		); err != nil {
+			return &DbError{"Error storing media", err.Error()}
+		}
+	}
+	return nil
+}
+
+// Media archived for a thread, in the order they appear in the post.
+func queryThreadMedia(threadId string) ([]media.Item, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT tm.url, tm.kind, m.hash, m.mime, m.size
+		FROM thread_media tm JOIN media m ON tm.url = m.url
+		WHERE tm.thread_id = ?
+		ORDER BY tm.position`, threadId,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in media query", qErr.Error()})
+	}
+	defer rows.Close()
+	items := []media.Item{}
+	for rows.Next() {
+		item := media.Item{}
+		rows.Scan(&item.Url, &item.Kind, &item.Hash, &item.Mime, &item.Size)
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func mediaRoute(item media.Item) string {
+	return "/media/" + item.Hash
+}
+
+// Replaces links to archived media with links to the local copies. Links
+// appear in the rendered HTML escaped up to twice.
+func mediaReplacer(items []media.Item) *strings.Replacer {
+	replacements := []string{}
+	for _, item := range items {
+		escaped := html.EscapeString(item.Url)
+		replacements = append(replacements,
+			html.EscapeString(escaped), mediaRoute(item),
+			escaped, mediaRoute(item),
+			item.Url, mediaRoute(item),
+		)
+	}
+	return strings.NewReplacer(replacements...)
+}
+
+// Images shown with the post, gallery items in place of other images.
+func postImages(items []media.Item) []string {
+	byKind := map[string][]string{}
+	for _, item := range items {
+		byKind[item.Kind] = append(byKind[item.Kind], mediaRoute(item))
+	}
+	for _, kind := range []string{media.KindGallery, media.KindImage, media.KindPreview, media.KindThumbnail} {
+		if len(byKind[kind]) > 0 {
+			return byKind[kind]
+		}
+	}
+	return nil
+}
+
+// Archived video of the post, empty if there is none.
+func postVideo(items []media.Item) string {
+	for _, item := range items {
+		if item.Kind == media.KindVideo {
+			return mediaRoute(item)
+		}
+	}
+	return ""
+}
+
+func routeGetMedia(c *gin.Context) {
+	hash := c.Param("hash")
+	if mediaStore == nil || !media.ValidHash(hash) {
+		RenderErrorPage(404, c.Writer)
+		return
+	}
+
+	mimeType := ""
+	dbReadOnly.QueryRow(`SELECT mime FROM media WHERE hash = ? LIMIT 1`, hash).Scan(&mimeType)
+	file, err := mediaStore.Open(hash)
+	if err != nil || mimeType == "" {
+		RenderErrorPage(404, c.Writer)
+		return
+	}
+	defer file.Close()
+
+	// Files are named by their content and never change.
+	c.Header("Content-Type", mimeType)
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("X-Content-Type-Options", "nosniff")
+	stat, _ := file.Stat()
+	http.ServeContent(c.Writer, c.Request, "", stat.ModTime(), file)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ilmari-h/bettit/media"
+	"github.com/stretchr/testify/assert"
+)
+
+// Use a fresh media directory for the duration of the test.
+func useTestMedia(t *testing.T) {
+	store, err := media.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaStore = store
+	mediaFetcher = media.NewFetcher(store, 1024*1024, 5*time.Second)
+	mediaFetcher.AllowPrivate = true
+	t.Cleanup(func() {
+		mediaStore = nil
+		mediaFetcher = nil
+	})
+}
+
+func TestArchiveMedia(t *testing.T) {
+	useTestDatabase(t)
+	useTestMedia(t)
+
+	img := new(bytes.Buffer)
+	png.Encode(img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(img.Bytes())
+	}))
+	defer server.Close()
+
+	post := testPostJson("abc123", 1)
+	post["url_overridden_by_dest"] = server.URL + "/post.png"
+	comment := testCommentJson("c1")
+	comment["data"].(testJson)["body_html"] = `&lt;p&gt;&lt;a href="` + server.URL + `/comment.png"&gt;pic&lt;/a&gt;&lt;/p&gt;`
+
+	root := parseThreadPage(testPostPageJson(post, comment), "test", "")
+	fetchMedia(root, 2)
+	assert.Len(t, root.Media, 2)
+	assert.Nil(t, writeArchive(root, false))
+
+	arch, err := GetArchiveQuery("abc123", "", "", 0)
+	assert.Nil(t, err)
+	if !assert.NotNil(t, arch) {
+		return
+	}
+	route := mediaRoute(root.Media[0])
+	assert.Contains(t, string(arch.ThreadHTML), `<img src="`+route+`"`)
+	assert.Contains(t, string(arch.ThreadHTML), `href="`+route+`"`)
+	assert.NotContains(t, string(arch.ThreadHTML), server.URL)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/media/:hash", routeGetMedia)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, route, nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, img.Bytes(), w.Body.Bytes())
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/media/notahash", nil))
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestArchiveVideo(t *testing.T) {
+	useTestDatabase(t)
+	useTestMedia(t)
+	mediaFetcher.VideoMaxBytes = 1024 * 1024
+
+	server := httptest.NewServer(http.FileServer(http.Dir("media/testdata/dash")))
+	defer server.Close()
+
+	post := testPostJson("abc123", 0)
+	post["is_video"] = true
+	post["secure_media"] = testJson{"reddit_video": testJson{"dash_url": server.URL + "/DASHPlaylist.mpd"}}
+
+	root := parseThreadPage(testPostPageJson(post), "test", "")
+	fetchMedia(root, 2)
+	if !assert.Len(t, root.Media, 1) {
+		return
+	}
+	assert.Nil(t, writeArchive(root, false))
+
+	arch, err := GetArchiveQuery("abc123", "", "", 0)
+	assert.Nil(t, err)
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), `<video class="post-video" controls preload="metadata" src="`+mediaRoute(root.Media[0])+`"`)
+	}
+}
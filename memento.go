@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//
+// Memento (RFC 7089) support, letting web archive tools find the snapshots of
+// a thread by its address on Reddit. Each snapshot is a memento rendered from
+// the API responses stored with it.
+//
+
+// Datetime in memento addresses, like 20220415052000.
+const MEMENTO_PATH_TIME = "20060102150405"
+
+func originalUrl(sub string, threadId string) string {
+	return fmt.Sprintf("https://www.reddit.com/r/%s/comments/%s/", sub, threadId)
+}
+
+func mementoPath(threadId string, timestamp int64) string {
+	return fmt.Sprintf("/%s/at/%s", threadId, time.Unix(timestamp, 0).UTC().Format(MEMENTO_PATH_TIME))
+}
+
+func mementoTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format(http.TimeFormat)
+}
+
+// Links to the original, the TimeGate and the TimeMap of a thread.
+func mementoLinks(baseUrl string, sub string, threadId string) string {
+	original := originalUrl(sub, threadId)
+	return fmt.Sprintf(`<%s>; rel="original", <%s/timegate/%s>; rel="timegate", <%s/timemap/link/%s>; rel="timemap"; type="application/link-format"`,
+		original, baseUrl, original, baseUrl, original,
+	)
+}
+
+// The snapshot closest to the time.
+func nearestSnapshot(snaps []snapshotRow, t int64) snapshotRow {
+	nearest := snaps[0]
+	for _, snap := range snaps[1:] {
+		if abs64(snap.archiveTime-t) < abs64(nearest.archiveTime-t) {
+			nearest = snap
+		}
+	}
+	return nearest
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func snapshotComments(threadId string, comments []*CommentData) []*CommentTmpl {
+	tmpls := []*CommentTmpl{}
+	for _, c := range comments {
+		tmpl := &CommentTmpl{
+			CommentId:        c.Id,
+			ThreadId:         threadId,
+			CommentContent:   template.HTML(c.Content),
+			Author:           c.Author,
+			Time:             time.Unix(c.Timestamp, 0).Format("02 Jan 2006"),
+			Continues:        c.Continues,
+			Score:            fmt.Sprintf("%d", c.Score),
+			AuthorFlair:      c.AuthorFlair,
+			Edited:           formatEdited(c.Edited),
+			Distinguished:    c.Distinguished,
+			Stickied:         c.Stickied,
+			Gilded:           int(c.Gilded),
+			Awards:           readAwards(c.Awards),
+			State:            c.State,
+			ArchivedContent:  template.HTML(c.ArchivedContent),
+			ArchivedAuthor:   c.ArchivedAuthor,
+			score:            c.Score,
+			timestamp:        c.Timestamp,
+			controversiality: c.Controversiality,
+			rank:             c.Rank,
+		}
+		replies := c.Replies
+		// The continuation page starts from the continued comment itself.
+		if c.Continues && c.Continuation != nil {
+			tmpl.Continues = false
+			replies = nil
+			for _, top := range c.Continuation.Comments {
+				if top.Id == c.Id {
+					replies = append(replies, top.Replies...)
+				} else {
+					replies = append(replies, top)
+				}
+			}
+		}
+		tmpl.Children = snapshotComments(threadId, replies)
+		tmpls = append(tmpls, tmpl)
+	}
+	return tmpls
+}
+
+// The thread as it was in a snapshot.
+func snapshotThread(root *ThreadPage) *ThreadTmpl {
+	post := root.Post
+	return &ThreadTmpl{
+		ThreadId:          post.Id,
+		ThreadTitle:       post.Title,
+		ThreadContent:     template.HTML(post.Content),
+		ThreadContentLink: post.ContentLink,
+		Subreddit:         root.Sub,
+		Replies:           snapshotComments(post.Id, root.Comments),
+		Author:            post.Author,
+		Time:              time.Unix(post.Timestamp, 0).Format("02 Jan 2006"),
+		LinkFlair:         post.LinkFlair,
+		AuthorFlair:       post.AuthorFlair,
+		Edited:            formatEdited(post.Edited),
+		Distinguished:     post.Distinguished,
+		Stickied:          post.Stickied,
+		Locked:            post.Locked,
+		RemovedBy:         post.RemovedByCategory,
+		UpvotePercent:     int(post.UpvoteRatio*100 + 0.5),
+		Gilded:            int(post.Gilded),
+		Awards:            readAwards(post.Awards),
+		CrosspostParent:   post.CrosspostParent,
+		created:           post.Timestamp,
+		repliesNum:        int(post.RepliesNum),
+	}
+}
+
+// Render the snapshot of the thread taken at the time, nil if there is none.
+func GetSnapshotQuery(threadId string, timestamp int64, sortOrder string) (*ArchiveTmpl, error) {
+	snaps, err := querySnapshots(threadId)
+	if err != nil {
+		return nil, err
+	}
+	for _, snap := range snaps {
+		if snap.archiveTime != timestamp {
+			continue
+		}
+		root, err := loadSnapshot(snap)
+		if err != nil {
+			return nil, err
+		}
+		arch := renderArchive(snapshotThread(root), "thread", int(snap.archiveTime), "", sortOrder)
+		arch.CanonicalPath = mementoPath(threadId, snap.archiveTime)
+		return arch, nil
+	}
+	return nil, nil
+}
+
+// Headers of an archive page as a memento of the thread on Reddit.
+func setMementoHeaders(c *gin.Context, sub string, threadId string, timestamp int64) {
+	c.Header("Memento-Datetime", mementoTime(timestamp))
+	c.Header("Link", mementoLinks(requestBaseUrl(c), sub, threadId))
+}
+
+func routeGetMemento(c *gin.Context) {
+	threadId := c.Param("threadid")
+	at, err := time.Parse(MEMENTO_PATH_TIME, c.Param("datetime"))
+	if err != nil {
+		RenderErrorPage(404, c.Writer)
+		return
+	}
+	arch, err := GetSnapshotQuery(threadId, at.Unix(), c.Query("sort"))
+	if err != nil {
+		RenderErrorPage(500, c.Writer)
+		return
+	} else if arch == nil {
+		RenderErrorPage(404, c.Writer)
+		return
+	}
+	arch.BaseUrl = requestBaseUrl(c)
+	setMementoHeaders(c, arch.Subreddit, threadId, at.Unix())
+	templates.Lookup("thread.tmpl").Lookup("archive").Execute(c.Writer, arch)
+}
+
+// Snapshots of the thread at the original address, nil if it is not archived.
+func readOriginal(c *gin.Context) (string, []snapshotRow, int) {
+	original := strings.TrimPrefix(c.Param("original"), "/")
+	if c.Request.URL.RawQuery != "" {
+		original += "?" + c.Request.URL.RawQuery
+	}
+	link, urlErr := readThreadUrl(original)
+	if urlErr {
+		return "", nil, 400
+	}
+	snaps, err := querySnapshots(link.ThreadId)
+	if err != nil {
+		return "", nil, 500
+	} else if len(snaps) == 0 {
+		return "", nil, 404
+	}
+	return link.ThreadId, snaps, 200
+}
+
+// Redirect to the snapshot closest to the Accept-Datetime, the latest one
+// without it.
+func routeGetTimeGate(c *gin.Context) {
+	threadId, snaps, status := readOriginal(c)
+	if status != 200 {
+		RenderErrorPage(status, c.Writer)
+		return
+	}
+	snap := snaps[len(snaps)-1]
+	if accept := c.GetHeader("Accept-Datetime"); accept != "" {
+		t, err := http.ParseTime(accept)
+		if err != nil {
+			RenderErrorPage(400, c.Writer)
+			return
+		}
+		snap = nearestSnapshot(snaps, t.Unix())
+	}
+	c.Header("Vary", "accept-datetime")
+	c.Header("Link", mementoLinks(requestBaseUrl(c), snap.sub, threadId))
+	c.Redirect(http.StatusFound, requestBaseUrl(c)+mementoPath(threadId, snap.archiveTime))
+}
+
+// Every snapshot of the thread in link format.
+func routeGetTimeMap(c *gin.Context) {
+	threadId, snaps, status := readOriginal(c)
+	if status != 200 {
+		RenderErrorPage(status, c.Writer)
+		return
+	}
+	baseUrl := requestBaseUrl(c)
+	original := originalUrl(snaps[0].sub, threadId)
+	links := []string{
+		fmt.Sprintf(`<%s>; rel="original"`, original),
+		fmt.Sprintf(`<%s/timegate/%s>; rel="timegate"`, baseUrl, original),
+		fmt.Sprintf(`<%s/timemap/link/%s>; rel="self"; type="application/link-format"; from="%s"; until="%s"`,
+			baseUrl, original, mementoTime(snaps[0].archiveTime), mementoTime(snaps[len(snaps)-1].archiveTime),
+		),
+	}
+	for i, snap := range snaps {
+		rel := "memento"
+		if i == 0 && i == len(snaps)-1 {
+			rel = "first last memento"
+		} else if i == 0 {
+			rel = "first memento"
+		} else if i == len(snaps)-1 {
+			rel = "last memento"
+		}
+		links = append(links, fmt.Sprintf(`<%s%s>; rel="%s"; datetime="%s"`,
+			baseUrl, mementoPath(threadId, snap.archiveTime), rel, mementoTime(snap.archiveTime),
+		))
+	}
+	c.Data(http.StatusOK, "application/link-format", []byte(strings.Join(links, ",\n")+"\n"))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemento(t *testing.T) {
+	useTestDatabase(t)
+	LoadTemplates()
+	// A router of its own, without pages cached by other tests.
+	r := GettitRouter(routerOptsT)
+
+	// Two snapshots a day apart, a comment added in between.
+	data := testPageJson("abc123", testCommentJson("c1"), testContinuedJson("c3"))
+	fetch := func(sub, threadId, commentId string) ([]byte, string, error) {
+		return testPageJson(threadId, testCommentJson(commentId, testCommentJson("c4"))), "", nil
+	}
+	assert.Nil(t, writeArchive(fetchArchive("", data, "", fetch), true))
+	data = testPageJson("abc123", testCommentJson("c1"), testCommentJson("c2"), testContinuedJson("c3"))
+	assert.Nil(t, writeArchive(fetchArchive("", data, "", fetch), true))
+	var ids []int64
+	rows, _ := dbReadOnly.Query(`SELECT id FROM snapshots ORDER BY id`)
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if !assert.Len(t, ids, 2) {
+		return
+	}
+	dbReadOnly.Exec(`UPDATE snapshots SET archive_timestamp = 1650000000 WHERE id = ?`, ids[0])
+	dbReadOnly.Exec(`UPDATE snapshots SET archive_timestamp = 1650086400 WHERE id = ?`, ids[1])
+
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "bettit.example"
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	original := "https://www.reddit.com/r/test/comments/abc123/"
+
+	// The TimeGate redirects to the snapshot closest to the requested time.
+	w := get("/timegate/"+original, "Accept-Datetime", "Fri, 15 Apr 2022 06:00:00 GMT")
+	assert.Equal(t, 302, w.Code)
+	assert.Equal(t, "http://bettit.example/abc123/at/20220415052000", w.Header().Get("Location"))
+	assert.Equal(t, "accept-datetime", w.Header().Get("Vary"))
+	assert.Contains(t, w.Header().Get("Link"), `<`+original+`>; rel="original"`)
+	w = get("/timegate/"+original, "Accept-Datetime", "Sun, 17 Apr 2022 00:00:00 GMT")
+	assert.Equal(t, "http://bettit.example/abc123/at/20220416052000", w.Header().Get("Location"))
+	w = get("/timegate/https://old.reddit.com/r/test/comments/abc123/title/")
+	assert.Equal(t, "http://bettit.example/abc123/at/20220416052000", w.Header().Get("Location"))
+	assert.Equal(t, 400, get("/timegate/"+original, "Accept-Datetime", "yesterday").Code)
+	assert.Equal(t, 404, get("/timegate/https://www.reddit.com/r/test/comments/def456/").Code)
+
+	// Mementos render the thread as it was in the snapshot.
+	w = get("/abc123/at/20220415052000")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "Fri, 15 Apr 2022 05:20:00 GMT", w.Header().Get("Memento-Datetime"))
+	assert.Contains(t, w.Header().Get("Link"), `<http://bettit.example/timemap/link/`+original+`>; rel="timemap"`)
+	assert.Contains(t, w.Body.String(), "comment c1<")
+	assert.NotContains(t, w.Body.String(), "comment c2<")
+	// Continuation pages are included.
+	assert.Contains(t, w.Body.String(), "comment c4<")
+	assert.Contains(t, get("/abc123/at/20220416052000").Body.String(), "comment c2<")
+	assert.Equal(t, 404, get("/abc123/at/20220415052001").Code)
+
+	// The thread page is the latest memento.
+	w = get("/abc123")
+	assert.NotEmpty(t, w.Header().Get("Memento-Datetime"))
+	assert.Contains(t, w.Header().Get("Link"), `rel="timegate"`)
+
+	w = get("/timemap/link/" + original)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/link-format", w.Header().Get("Content-Type"))
+	links := strings.Split(strings.TrimSpace(w.Body.String()), ",\n")
+	assert.Equal(t, []string{
+		`<` + original + `>; rel="original"`,
+		`<http://bettit.example/timegate/` + original + `>; rel="timegate"`,
+		`<http://bettit.example/timemap/link/` + original + `>; rel="self"; type="application/link-format"; from="Fri, 15 Apr 2022 05:20:00 GMT"; until="Sat, 16 Apr 2022 05:20:00 GMT"`,
+		`<http://bettit.example/abc123/at/20220415052000>; rel="first memento"; datetime="Fri, 15 Apr 2022 05:20:00 GMT"`,
+		`<http://bettit.example/abc123/at/20220416052000>; rel="last memento"; datetime="Sat, 16 Apr 2022 05:20:00 GMT"`,
+	}, links)
+}
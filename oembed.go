@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+//
+// oEmbed provider for archived threads and comments, and the comment cards
+// embedded in other sites.
+//
+
+// Default size of embedded comment cards.
+const EMBED_WIDTH = 550
+const EMBED_HEIGHT = 250
+
+// Archive pages of threads and comments, /abc123 and /abc123/c/def456.
+var archivePathPattern = regexp.MustCompile(`^/([a-z0-9]{5,12})(?:/c/([a-z0-9]{1,12}))?/?$`)
+
+// Read an archive or Reddit URL of a thread or comment into their IDs.
+func readEmbedUrl(input string) (string, string, bool) {
+	if u, err := url.Parse(input); err == nil && u.Scheme != "" {
+		if match := archivePathPattern.FindStringSubmatch(u.Path); match != nil {
+			return match[1], match[2], true
+		}
+	}
+	link, urlErr := readThreadUrl(input)
+	if urlErr {
+		return "", "", false
+	}
+	return link.ThreadId, link.CommentId, true
+}
+
+// Size of the embed within the limits given by the consumer.
+func embedSize(c *gin.Context) (int, int) {
+	width, height := EMBED_WIDTH, EMBED_HEIGHT
+	if max, err := strconv.Atoi(c.Query("maxwidth")); err == nil && max > 0 && max < width {
+		width = max
+	}
+	if max, err := strconv.Atoi(c.Query("maxheight")); err == nil && max > 0 && max < height {
+		height = max
+	}
+	return width, height
+}
+
+// oEmbed of a thread is a link, of a comment a card in an iframe.
+func routeGetOEmbed(c *gin.Context) {
+	if format := c.Query("format"); format != "" && format != "json" {
+		c.String(http.StatusNotImplemented, "Only the json format is supported.")
+		return
+	}
+	threadId, commentId, ok := readEmbedUrl(c.Query("url"))
+	if !ok {
+		c.String(http.StatusNotFound, "Not an archived thread or comment.")
+		return
+	}
+	_, thread, _, err := queryThread(threadId, "")
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal error.")
+		return
+	} else if thread == nil {
+		c.String(http.StatusNotFound, "Not an archived thread or comment.")
+		return
+	}
+	baseUrl := requestBaseUrl(c)
+	embed := gin.H{
+		"version":       "1.0",
+		"type":          "link",
+		"title":         thread.ThreadTitle,
+		"author_name":   "u/" + thread.Author,
+		"author_url":    "https://www.reddit.com/user/" + thread.Author,
+		"provider_name": "Bettit",
+		"provider_url":  baseUrl + "/",
+		"cache_age":     3600,
+	}
+	if commentId != "" {
+		comment, err := queryEmbedComment(threadId, commentId)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Internal error.")
+			return
+		} else if comment == nil {
+			c.String(http.StatusNotFound, "Not an archived thread or comment.")
+			return
+		}
+		width, height := embedSize(c)
+		src := fmt.Sprintf("%s/embed/%s/%s", baseUrl, threadId, commentId)
+		embed["type"] = "rich"
+		embed["title"] = fmt.Sprintf("Comment by u/%s on %s", comment.Author, thread.ThreadTitle)
+		embed["author_name"] = "u/" + comment.Author
+		embed["author_url"] = "https://www.reddit.com/user/" + comment.Author
+		embed["width"] = width
+		embed["height"] = height
+		embed["html"] = fmt.Sprintf(
+			`<iframe src="%s" width="%d" height="%d" style="border: 1px solid #ccc; border-radius: 4px;" sandbox="allow-popups allow-popups-to-escape-sandbox" loading="lazy" title="%s"></iframe>`,
+			html.EscapeString(src), width, height, html.EscapeString(embed["title"].(string)),
+		)
+	}
+	c.JSON(http.StatusOK, embed)
+}
+
+// The comment without its replies, nil if it is not archived.
+func queryEmbedComment(threadId string, commentId string) (*CommentTmpl, error) {
+	row, err := queryCommentRow(`
+		WHERE t.thread_id = ? AND c.comment_id = ?
+		ORDER BY t.archive_timestamp DESC
+		LIMIT 1`, threadId, commentId,
+	)
+	if err != nil || row == nil {
+		return nil, err
+	}
+	comment, err := queryCommentTmpl(threadId, row.id)
+	if err != nil {
+		return nil, err
+	}
+	comment.Continues = false
+	comment.Children = nil
+	return comment, nil
+}
+
+// A card of the comment for embedding in other sites.
+func routeGetEmbed(c *gin.Context) {
+	threadId := c.Param("threadid")
+	_, thread, arcTimestamp, err := queryThread(threadId, "")
+	if err != nil {
+		RenderErrorPage(500, c.Writer)
+		return
+	} else if thread == nil {
+		RenderErrorPage(404, c.Writer)
+		return
+	}
+	comment, err := queryEmbedComment(threadId, c.Param("commentid"))
+	if err != nil {
+		RenderErrorPage(500, c.Writer)
+		return
+	} else if comment == nil {
+		RenderErrorPage(404, c.Writer)
+		return
+	}
+	thread.Replies = []*CommentTmpl{comment}
+	arch := renderArchive(thread, "embedCard", arcTimestamp, comment.CommentId, "")
+	arch.BaseUrl = requestBaseUrl(c)
+	arch.CanonicalPath = fmt.Sprintf("/%s/c/%s", threadId, comment.CommentId)
+
+	// Any site may frame the card, it runs no scripts.
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'self'; img-src * data:; media-src *; frame-ancestors *")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	templates.Lookup("thread.tmpl").Lookup("embed").Execute(c.Writer, arch)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOEmbed(t *testing.T) {
+	useTestDatabase(t)
+	LoadTemplates()
+	// A router of its own, without pages cached by other tests.
+	r := GettitRouter(routerOptsT)
+
+	assert.Nil(t, writeArchive(parseThreadPage(testPageJson("abc123", testCommentJson("c1", testCommentJson("c2"))), "test", ""), false))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "bettit.example"
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	oembed := func(target string, params string) (int, map[string]interface{}) {
+		w := get("/oembed?url=" + url.QueryEscape(target) + params)
+		embed := map[string]interface{}{}
+		json.Unmarshal(w.Body.Bytes(), &embed)
+		return w.Code, embed
+	}
+
+	code, embed := oembed("http://bettit.example/abc123/c/c1", "&maxwidth=400")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "rich", embed["type"])
+	assert.Equal(t, "1.0", embed["version"])
+	assert.Equal(t, "u/author_c1", embed["author_name"])
+	assert.Equal(t, float64(400), embed["width"])
+	assert.Equal(t, float64(EMBED_HEIGHT), embed["height"])
+	assert.Contains(t, embed["html"], `<iframe src="http://bettit.example/embed/abc123/c1" width="400"`)
+
+	// Reddit URLs of archived comments and threads.
+	code, embed = oembed("https://www.reddit.com/r/test/comments/abc123/title/c2/", "")
+	assert.Equal(t, 200, code)
+	assert.Contains(t, embed["html"], "/embed/abc123/c2")
+	code, embed = oembed("http://bettit.example/abc123", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "link", embed["type"])
+	assert.Equal(t, "Thread abc123", embed["title"])
+	assert.Nil(t, embed["html"])
+
+	code, _ = oembed("http://bettit.example/abc123/c/c9", "")
+	assert.Equal(t, 404, code)
+	code, _ = oembed("https://www.reddit.com/r/test/comments/def456/", "")
+	assert.Equal(t, 404, code)
+	code, _ = oembed("http://bettit.example/abc123", "&format=xml")
+	assert.Equal(t, 501, code)
+
+	// The card shows the comment without its replies and can be framed anywhere.
+	w := get("/embed/abc123/c1")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Security-Policy"), "frame-ancestors *")
+	assert.Empty(t, w.Header().Get("X-Frame-Options"))
+	assert.Contains(t, w.Body.String(), "comment c1<")
+	assert.NotContains(t, w.Body.String(), "comment c2<")
+	assert.Contains(t, w.Body.String(), `<base target="_blank">`)
+	assert.Equal(t, 404, get("/embed/abc123/c9").Code)
+
+	// Archive pages link to their oEmbed.
+	w = get("/abc123/c/c1")
+	assert.Contains(t, w.Body.String(), `<link rel="alternate" type="application/json+oembed" href="http://bettit.example/oembed?url=http%3a%2f%2fbettit.example%2fabc123%2fc%2fc1&format=json"`)
+}
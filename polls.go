@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+type PollData struct {
+	VotingEnd  int64 // Unix time in seconds.
+	TotalVotes int64
+	Options    []PollOption
+}
+
+type PollOption struct {
+	Id    string
+	Text  string
+	Votes sql.NullInt64 // Not set while the votes are hidden.
+}
+
+// Poll of a post, nil if the post is not a poll.
+func parsePoll(post gjson.Result) *PollData {
+	data := post.Get("poll_data")
+	if !data.IsObject() {
+		return nil
+	}
+	poll := &PollData{
+		// The API gives the end of voting in milliseconds.
+		VotingEnd:  data.Get("voting_end_timestamp").Int() / 1000,
+		TotalVotes: data.Get("total_vote_count").Int(),
+	}
+	for _, o := range data.Get("options").Array() {
+		option := PollOption{Id: o.Get("id").String(), Text: o.Get("text").String()}
+		if votes := o.Get("vote_count"); votes.Exists() && votes.Type == gjson.Number {
+			option.Votes = sql.NullInt64{Int64: votes.Int(), Valid: true}
+		}
+		poll.Options = append(poll.Options, option)
+	}
+	return poll
+}
+
+// Record the poll of the thread with the snapshot written in the same transaction.
+func (dbtx *ThreadDbTx) txPostPoll(root *ThreadPage) error {
+	poll := root.Post.Poll
+	if poll == nil {
+		return nil
+	}
+	if _, err := dbtx.tx.Exec(`
+		REPLACE INTO polls (snapshot_id, thread_id, voting_end_timestamp, total_votes)
+		VALUES ( ?, ?, ?, ? );
+		`, dbtx.snapshotId, root.Post.Id, poll.VotingEnd, poll.TotalVotes,
+	); err != nil {
+		return &DbError{"Error storing poll", err.Error()}
+	}
+	for i, option := range poll.Options {
+		if _, err := dbtx.tx.Exec(`
+			REPLACE INTO poll_options (snapshot_id, thread_id, option_id, position, text, votes)
+			VALUES ( ?, ?, ?, ?, ?, ? );
+			`, dbtx.snapshotId, root.Post.Id, option.Id, i, option.Text, option.Votes,
+		); err != nil {
+			return &DbError{"Error storing poll option", err.Error()}
+		}
+	}
+	return nil
+}
+
+type pollRow struct {
+	snapshotId  int64
+	archiveTime int64
+	votingEnd   int64
+	totalVotes  int64
+	votes       map[string]sql.NullInt64 // By option ID.
+	options     []PollOption
+}
+
+// The poll of a thread as recorded in each snapshot, oldest first.
+func queryPollHistory(threadId string) ([]*pollRow, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT p.snapshot_id, s.archive_timestamp, p.voting_end_timestamp, p.total_votes
+		FROM polls p JOIN snapshots s ON p.snapshot_id = s.id
+		WHERE p.thread_id = ?
+		ORDER BY s.archive_timestamp, p.snapshot_id`, threadId,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in poll query", qErr.Error()})
+	}
+	polls := []*pollRow{}
+	bySnapshot := map[int64]*pollRow{}
+	for rows.Next() {
+		poll := &pollRow{votes: map[string]sql.NullInt64{}}
+		rows.Scan(&poll.snapshotId, &poll.archiveTime, &poll.votingEnd, &poll.totalVotes)
+		polls = append(polls, poll)
+		bySnapshot[poll.snapshotId] = poll
+	}
+	rows.Close()
+	if len(polls) == 0 {
+		return polls, nil
+	}
+
+	rows, qErr = dbReadOnly.Query(`
+		SELECT snapshot_id, option_id, text, votes
+		FROM poll_options
+		WHERE thread_id = ?
+		ORDER BY snapshot_id, position`, threadId,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in poll option query", qErr.Error()})
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var snapshotId int64
+		option := PollOption{}
+		rows.Scan(&snapshotId, &option.Id, &option.Text, &option.Votes)
+		if poll, ok := bySnapshot[snapshotId]; ok {
+			poll.options = append(poll.options, option)
+			poll.votes[option.Id] = option.Votes
+		}
+	}
+	return polls, nil
+}
+
+func formatVotes(votes sql.NullInt64) string {
+	if !votes.Valid {
+		return "hidden"
+	}
+	return fmt.Sprint(votes.Int64)
+}
+
+// Results of the latest snapshot of the poll, with the vote counts of every
+// snapshot if there are several. Nil if the thread has no poll.
+func queryPoll(threadId string) (*PollTmpl, error) {
+	history, err := queryPollHistory(threadId)
+	if err != nil || len(history) == 0 {
+		return nil, err
+	}
+	latest := history[len(history)-1]
+
+	tmpl := &PollTmpl{
+		TotalVotes: latest.totalVotes,
+		VotingEnd:  time.Unix(latest.votingEnd, 0).Format("02 Jan 2006 15:04"),
+		Closed:     latest.votingEnd <= latest.archiveTime,
+	}
+	var max int64
+	for _, o := range latest.options {
+		if o.Votes.Int64 > max {
+			max = o.Votes.Int64
+		}
+	}
+	for _, o := range latest.options {
+		option := PollOptionTmpl{Text: o.Text, Votes: formatVotes(o.Votes)}
+		if o.Votes.Valid && latest.totalVotes > 0 {
+			option.Percent = int(o.Votes.Int64 * 100 / latest.totalVotes)
+		}
+		option.Leading = o.Votes.Valid && max > 0 && o.Votes.Int64 == max
+		tmpl.Options = append(tmpl.Options, option)
+	}
+
+	if len(history) > 1 {
+		for _, poll := range history {
+			snapshot := PollSnapshotTmpl{
+				Time:       time.Unix(poll.archiveTime, 0).Format("02 Jan 2006 15:04"),
+				TotalVotes: poll.totalVotes,
+			}
+			for _, o := range latest.options {
+				snapshot.Votes = append(snapshot.Votes, formatVotes(poll.votes[o.Id]))
+			}
+			tmpl.History = append(tmpl.History, snapshot)
+		}
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPollPost(votes ...interface{}) testJson {
+	post := testPostJson("abc123", 0)
+	options := []testJson{}
+	total := 0
+	for i, text := range []string{"Yes", "No"} {
+		option := testJson{"id": text, "text": text}
+		if votes[i] != nil {
+			option["vote_count"] = votes[i]
+			total += votes[i].(int)
+		}
+		options = append(options, option)
+	}
+	post["poll_data"] = testJson{
+		"voting_end_timestamp": 1650003600000,
+		"total_vote_count":     total,
+		"options":              options,
+	}
+	return post
+}
+
+func TestParsePoll(t *testing.T) {
+	page := parseThreadPage(testPostPageJson(testPollPost(3, nil)), "test", "")
+	if assert.NotNil(t, page.Post.Poll) {
+		assert.Equal(t, int64(1650003600), page.Post.Poll.VotingEnd)
+		assert.Len(t, page.Post.Poll.Options, 2)
+		assert.True(t, page.Post.Poll.Options[0].Votes.Valid)
+		assert.False(t, page.Post.Poll.Options[1].Votes.Valid)
+	}
+
+	assert.Nil(t, parseThreadPage(testPageJson("abc123"), "test", "").Post.Poll)
+}
+
+func TestPollHistory(t *testing.T) {
+	useTestDatabase(t)
+
+	assert.Nil(t, writeArchive(parseThreadPage(testPostPageJson(testPollPost(1, 3)), "test", ""), false))
+
+	poll, err := queryPoll("abc123")
+	assert.Nil(t, err)
+	if assert.NotNil(t, poll) {
+		assert.Equal(t, int64(4), poll.TotalVotes)
+		assert.Equal(t, PollOptionTmpl{"Yes", "1", 25, false}, poll.Options[0])
+		assert.Equal(t, PollOptionTmpl{"No", "3", 75, true}, poll.Options[1])
+		assert.True(t, poll.Closed)
+		assert.Empty(t, poll.History)
+	}
+
+	// Archived again a minute later.
+	dbReadOnly.Exec(`UPDATE snapshots SET archive_timestamp = archive_timestamp - 60`)
+	assert.Nil(t, writeArchive(parseThreadPage(testPostPageJson(testPollPost(6, 4)), "test", ""), true))
+
+	poll, _ = queryPoll("abc123")
+	if assert.NotNil(t, poll) && assert.Len(t, poll.History, 2) {
+		assert.Equal(t, PollOptionTmpl{"Yes", "6", 60, true}, poll.Options[0])
+		assert.Equal(t, []string{"1", "3"}, poll.History[0].Votes)
+		assert.Equal(t, []string{"6", "4"}, poll.History[1].Votes)
+	}
+
+	arch, _ := GetArchiveQuery("abc123", "", "", 0)
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), `<div class="poll-bar" style="width: 60%"></div>`)
+		assert.Contains(t, string(arch.ThreadHTML), `<table class="poll-history">`)
+	}
+
+	// Polls are rebuilt with the rest of the thread.
+	dbReadOnly.Exec(`DELETE FROM poll_options`)
+	snapshots, _ := queryLatestSnapshots([]string{"abc123"})
+	assert.Nil(t, reparseSnapshot(snapshots[0]))
+	poll, _ = queryPoll("abc123")
+	if assert.NotNil(t, poll) {
+		assert.Equal(t, "6", poll.Options[0].Votes)
+	}
+}
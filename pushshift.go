@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+//
+// Import of Pushshift style dumps: files of submissions and comments, one
+// JSON object per line, optionally compressed with zstd.
+//
+// Dumps are imported in two phases so that memory use is bounded by the size
+// of a single thread. The lines of every file are first staged in a database
+// of their own, and threads are then built from it one batch at a time.
+// Both phases record their progress in the staging database, so an import
+// that was interrupted continues where it stopped when run again.
+//
+
+// Lines staged, or threads written, in one transaction.
+const IMPORT_BATCH = 5000
+const IMPORT_THREAD_BATCH = 100
+
+// Longest line read from a dump.
+const IMPORT_MAX_LINE = 16 * 1024 * 1024
+
+// How often the import rate is logged.
+const IMPORT_REPORT_INTERVAL = 10 * time.Second
+
+type importer struct {
+	staging *sql.DB
+}
+
+func openImporter(stagingFile string) (*importer, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=9999999", stagingFile))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS import_files (
+			path TEXT PRIMARY KEY,
+			lines INTEGER DEFAULT 0,
+			done INTEGER DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS import_submissions (
+			thread_id TEXT PRIMARY KEY,
+			data TEXT,
+			imported INTEGER DEFAULT 0
+		);`,
+		`CREATE TABLE IF NOT EXISTS import_comments (
+			comment_id TEXT PRIMARY KEY,
+			link_id TEXT,
+			data TEXT
+		);`,
+		`CREATE INDEX IF NOT EXISTS import_comments_link_index ON import_comments(link_id);`,
+		`CREATE INDEX IF NOT EXISTS import_submissions_imported_index ON import_submissions(imported);`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &importer{db}, nil
+}
+
+func (imp *importer) close() {
+	imp.staging.Close()
+}
+
+// Counts a phase of the import and logs its rate.
+type importProgress struct {
+	phase      string
+	start      time.Time
+	lastReport time.Time
+	count      int64
+}
+
+func newImportProgress(phase string) *importProgress {
+	now := time.Now()
+	return &importProgress{phase: phase, start: now, lastReport: now}
+}
+
+func (p *importProgress) rate() float64 {
+	elapsed := time.Since(p.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.count) / elapsed
+}
+
+func (p *importProgress) add(n int64) {
+	p.count += n
+	if time.Since(p.lastReport) >= IMPORT_REPORT_INTERVAL {
+		p.lastReport = time.Now()
+		Log("Import progress", fmt.Sprintf("%s: %d (%.0f/s)", p.phase, p.count, p.rate())).Info()
+	}
+}
+
+// Open a dump for reading, decompressing files ending in .zst with the zstd
+// command. The returned function waits for the decompression to finish.
+func openDump(path string) (io.ReadCloser, func() error, error) {
+	if !strings.HasSuffix(path, ".zst") {
+		f, err := os.Open(path)
+		return f, func() error { return nil }, err
+	}
+	// Pushshift dumps are compressed with a long window.
+	cmd := exec.Command("zstd", "-dc", "--long=31", path)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, &DbError{"Error starting zstd", err.Error()}
+	}
+	return out, cmd.Wait, nil
+}
+
+// Stage the lines of a dump, skipping those staged by an earlier run.
+// Returns the number of lines staged.
+func (imp *importer) stageFile(path string, progress *importProgress) (int64, error) {
+	abs, _ := filepath.Abs(path)
+	var skip int64
+	done := false
+	imp.staging.QueryRow(`SELECT lines, done FROM import_files WHERE path = ?`, abs).Scan(&skip, &done)
+	if done {
+		Log("Dump already staged.", path).Info()
+		return 0, nil
+	}
+
+	r, wait, err := openDump(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), IMPORT_MAX_LINE)
+	var line int64
+	for line < skip && scanner.Scan() {
+		line++
+	}
+
+	tx, err := imp.staging.Begin()
+	if err != nil {
+		return 0, err
+	}
+	batch := 0
+	commit := func(finished bool) error {
+		if _, err := tx.Exec(`
+			INSERT INTO import_files (path, lines, done) VALUES ( ?, ?, ? )
+			ON CONFLICT(path) DO UPDATE SET lines = excluded.lines, done = excluded.done
+			`, abs, line, finished,
+		); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	for scanner.Scan() {
+		line++
+		data := scanner.Bytes()
+		obj := gjson.ParseBytes(data)
+		id := obj.Get("id").String()
+		switch {
+		case id == "":
+		case obj.Get("link_id").Exists():
+			linkId := strings.TrimPrefix(obj.Get("link_id").String(), "t3_")
+			_, err = tx.Exec(
+				`REPLACE INTO import_comments (comment_id, link_id, data) VALUES ( ?, ?, ? )`,
+				id, linkId, string(data),
+			)
+			// A thread imported before the comment was staged is written again.
+			if err == nil {
+				_, err = tx.Exec(`UPDATE import_submissions SET imported = 0 WHERE thread_id = ?`, linkId)
+			}
+		case obj.Get("title").Exists():
+			_, err = tx.Exec(`REPLACE INTO import_submissions (thread_id, data) VALUES ( ?, ? )`, id, string(data))
+		}
+		if err != nil {
+			tx.Rollback()
+			return line - skip, err
+		}
+		if batch++; batch == IMPORT_BATCH {
+			if err := commit(false); err != nil {
+				return line - skip, err
+			}
+			progress.add(int64(batch))
+			batch = 0
+			if tx, err = imp.staging.Begin(); err != nil {
+				return line - skip, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		tx.Rollback()
+		return line - skip, err
+	}
+	if err := wait(); err != nil {
+		tx.Rollback()
+		return line - skip, &DbError{"Error decompressing dump", err.Error()}
+	}
+	progress.add(int64(batch))
+	return line - skip, commit(true)
+}
+
+// Escaped HTML of a markdown text, as in the *_html fields of the API. The
+// text is shown as plain paragraphs, dumps do not include rendered HTML.
+func plainTextHtml(text string) string {
+	if text == "" {
+		return ""
+	}
+	body := `<div class="md">`
+	for _, p := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		if p = strings.TrimSpace(p); p != "" {
+			body += "<p>" + html.EscapeString(p) + "</p>\n"
+		}
+	}
+	return html.EscapeString(body + "</div>")
+}
+
+type dumpObject = map[string]interface{}
+
+// Fill in the fields of the API missing from dumps.
+func completeDumpObject(obj dumpObject, textField string) {
+	if _, ok := obj["created"]; !ok {
+		obj["created"] = obj["created_utc"]
+	}
+	if _, ok := obj[textField+"_html"]; !ok {
+		text, _ := obj[textField].(string)
+		obj[textField+"_html"] = plainTextHtml(text)
+	}
+}
+
+// Build a thread page in the form returned by the API from a staged
+// submission and its comments.
+func (imp *importer) buildThread(threadId string, data string) ([]byte, int, error) {
+	post := dumpObject{}
+	if err := json.Unmarshal([]byte(data), &post); err != nil {
+		return nil, 0, err
+	}
+	completeDumpObject(post, "selftext")
+	if _, ok := post["url_overridden_by_dest"]; !ok && post["is_self"] == false {
+		post["url_overridden_by_dest"] = post["url"]
+	}
+
+	rows, err := imp.staging.Query(`SELECT data FROM import_comments WHERE link_id = ? ORDER BY rowid`, threadId)
+	if err != nil {
+		return nil, 0, err
+	}
+	comments := []dumpObject{}
+	byId := map[string]dumpObject{}
+	for rows.Next() {
+		raw := ""
+		rows.Scan(&raw)
+		c := dumpObject{}
+		if json.Unmarshal([]byte(raw), &c) != nil {
+			continue
+		}
+		completeDumpObject(c, "body")
+		comments = append(comments, c)
+		if id, ok := c["id"].(string); ok {
+			byId[id] = c
+		}
+	}
+	rows.Close()
+
+	// Comments whose parent is not in the dump are shown at the top level.
+	children := map[string][]interface{}{}
+	topLevel := []interface{}{}
+	for _, c := range comments {
+		parentId, _ := c["parent_id"].(string)
+		wrapped := dumpObject{"kind": "t1", "data": c}
+		if parent := strings.TrimPrefix(parentId, "t1_"); strings.HasPrefix(parentId, "t1_") && byId[parent] != nil {
+			children[parent] = append(children[parent], wrapped)
+		} else {
+			topLevel = append(topLevel, wrapped)
+		}
+	}
+	for id, c := range byId {
+		if replies, ok := children[id]; ok {
+			c["replies"] = dumpObject{"kind": "Listing", "data": dumpObject{"children": replies}}
+		} else {
+			c["replies"] = ""
+		}
+	}
+
+	page, err := json.Marshal([]interface{}{
+		dumpObject{"kind": "Listing", "data": dumpObject{"children": []interface{}{dumpObject{"kind": "t3", "data": post}}}},
+		dumpObject{"kind": "Listing", "data": dumpObject{"children": topLevel}},
+	})
+	return page, len(comments), err
+}
+
+// Write the threads of staged submissions that are not imported yet. Threads
+// that cannot be built are logged and left to be retried by the next run.
+// Returns the number of threads written and the number that failed.
+func (imp *importer) importThreads(progress *importProgress, comments *importProgress) (int64, int64, error) {
+	var imported, failed int64
+	var after int64 // Row ID of the last submission read, failed ones stay unimported.
+	for {
+		rows, err := imp.staging.Query(`
+			SELECT rowid, thread_id, data FROM import_submissions
+			WHERE imported = 0 AND rowid > ? ORDER BY rowid LIMIT ?`, after, IMPORT_THREAD_BATCH,
+		)
+		if err != nil {
+			return imported, failed, err
+		}
+		batch := map[string]string{}
+		for rows.Next() {
+			threadId, data := "", ""
+			rows.Scan(&after, &threadId, &data)
+			batch[threadId] = data
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			return imported, failed, nil
+		}
+
+		tx, txErr := NewTransaction(true)
+		if txErr != nil {
+			return imported, failed, txErr
+		}
+		written := []string{}
+		for threadId, data := range batch {
+			raw, commentsNum, err := imp.buildThread(threadId, data)
+			if err != nil {
+				Log("Error building imported thread", fmt.Sprintf("ID %s: %s", threadId, err.Error())).Error()
+				failed++
+				continue
+			}
+			page := parseThreadPage(raw, "", "")
+			page.FetchTime = gjson.GetBytes(raw, "0.data.children.0.data.retrieved_on").Int()
+			if page.FetchTime == 0 {
+				page.FetchTime = time.Now().Unix()
+			}
+			tx.timestamp = page.FetchTime
+			if err := tx.txPostArchive(page); err != nil {
+				tx.rollback()
+				return imported, failed, err
+			}
+			comments.add(int64(commentsNum))
+			written = append(written, threadId)
+		}
+		tx.done()
+
+		// A batch written again after an interruption here replaces its
+		// threads, with an extra snapshot.
+		for _, threadId := range written {
+			if _, err := imp.staging.Exec(`UPDATE import_submissions SET imported = 1 WHERE thread_id = ?`, threadId); err != nil {
+				return imported, failed, err
+			}
+		}
+		imported += int64(len(written))
+		progress.add(int64(len(written)))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSubmissionsDump = `{"id":"abc123","title":"Imported thread","selftext":"First paragraph.\n\nSecond <b>paragraph</b>.","author":"op","subreddit":"test","created_utc":1400000000,"num_comments":3,"retrieved_on":1400100000,"is_self":true}
+{"id":"def456","title":"Link thread","selftext":"","author":"op","subreddit":"test","created_utc":"1400000100","num_comments":0,"is_self":false,"url":"https://example.com/"}
+`
+
+const testCommentsDump = `{"id":"c1","link_id":"t3_abc123","parent_id":"t3_abc123","body":"top comment","author":"a","created_utc":1400000010,"score":5}
+{"id":"c2","link_id":"t3_abc123","parent_id":"t1_c1","body":"reply","author":"b","created_utc":1400000020,"score":2}
+{"id":"c3","link_id":"t3_abc123","parent_id":"t1_gone","body":"orphan","author":"c","created_utc":1400000030,"score":1}
+{"id":"c4","link_id":"t3_zzz999","parent_id":"t3_zzz999","body":"no submission","author":"d","created_utc":1400000040,"score":1}
+`
+
+func testImport(t *testing.T, staging string, dumps ...string) {
+	imp, err := openImporter(staging)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer imp.close()
+	for _, dump := range dumps {
+		_, err := imp.stageFile(dump, newImportProgress("lines"))
+		assert.Nil(t, err)
+	}
+	_, failed, err := imp.importThreads(newImportProgress("threads"), newImportProgress("comments"))
+	assert.Nil(t, err)
+	assert.Zero(t, failed)
+}
+
+func TestImport(t *testing.T) {
+	useTestDatabase(t)
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "staging.db")
+	submissions := filepath.Join(dir, "RS.ndjson")
+	comments := filepath.Join(dir, "RC.ndjson")
+	os.WriteFile(submissions, []byte(testSubmissionsDump), 0644)
+
+	// Comments added to a dump after it was staged are staged on the next run.
+	lines := strings.SplitAfter(testCommentsDump, "\n")
+	os.WriteFile(comments, []byte(strings.Join(lines[:2], "")), 0644)
+	testImport(t, staging, submissions, comments)
+	os.WriteFile(comments, []byte(testCommentsDump), 0644)
+	imp, _ := openImporter(staging)
+	imp.staging.Exec(`UPDATE import_files SET done = 0`)
+	imp.close()
+	testImport(t, staging, submissions, comments)
+
+	states := testCommentStates(t, "abc123")
+	assert.Len(t, states, 3)
+	arch, _ := GetArchiveQuery("abc123", "", "", 0)
+	if assert.NotNil(t, arch) {
+		page := string(arch.ThreadHTML)
+		assert.Contains(t, page, "<p>First paragraph.</p>")
+		assert.Contains(t, page, "Second &lt;b&gt;paragraph&lt;/b&gt;.")
+		assert.Contains(t, page, "orphan")
+		assert.Less(t, strings.Index(page, `id="c1"`), strings.Index(page, `id="c2"`))
+	}
+	link, _ := GetArchiveQuery("def456", "", "", 0)
+	if assert.NotNil(t, link) {
+		assert.Contains(t, string(link.ThreadHTML), "https://example.com/")
+	}
+	assert.False(t, threadArchived("zzz999"))
+
+	// Imported threads are not written again.
+	testImport(t, staging, submissions, comments)
+	snapshots := 0
+	dbReadOnly.QueryRow(`SELECT COUNT(*) FROM snapshots WHERE thread_id = "abc123"`).Scan(&snapshots)
+	assert.Equal(t, 2, snapshots)
+}
+
+func TestImportFailed(t *testing.T) {
+	useTestDatabase(t)
+	dir := t.TempDir()
+	imp, err := openImporter(filepath.Join(dir, "staging.db"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer imp.close()
+	submissions := filepath.Join(dir, "RS.ndjson")
+	os.WriteFile(submissions, []byte(testSubmissionsDump), 0644)
+	imp.stageFile(submissions, newImportProgress("lines"))
+	imp.staging.Exec(`UPDATE import_submissions SET data = '{"id":' WHERE thread_id = "abc123"`)
+
+	// A thread that cannot be built is reported and stays staged for the next run.
+	imported, failed, err := imp.importThreads(newImportProgress("threads"), newImportProgress("comments"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), imported)
+	assert.Equal(t, int64(1), failed)
+	assert.False(t, threadArchived("abc123"))
+	assert.True(t, threadArchived("def456"))
+
+	imp.staging.Exec(`UPDATE import_submissions SET data = ? WHERE thread_id = "abc123"`, strings.SplitAfter(testSubmissionsDump, "\n")[0])
+	imported, failed, err = imp.importThreads(newImportProgress("threads"), newImportProgress("comments"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), imported)
+	assert.Zero(t, failed)
+	assert.True(t, threadArchived("abc123"))
+}
+
+func TestImportZstd(t *testing.T) {
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("zstd not installed")
+	}
+	useTestDatabase(t)
+	dir := t.TempDir()
+	dump := filepath.Join(dir, "RS.ndjson")
+	os.WriteFile(dump, []byte(testSubmissionsDump), 0644)
+	if out, err := exec.Command("zstd", "-q", "--rm", dump).CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+	testImport(t, filepath.Join(dir, "staging.db"), dump+".zst")
+	assert.True(t, threadArchived("abc123"))
+	assert.True(t, threadArchived("def456"))
+}
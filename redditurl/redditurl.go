@@ -0,0 +1,155 @@
+package redditurl
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var idPattern = regexp.MustCompile(`^[a-z0-9]{1,12}$`)
+var bareIdPattern = regexp.MustCompile(`^[a-z0-9]{5,12}$`)
+var subPattern = regexp.MustCompile(`^[A-Za-z0-9_]{2,21}$`)
+var sharePattern = regexp.MustCompile(`^[A-Za-z0-9]{1,16}$`)
+
+// Hosts serving the regular reddit.com path layout.
+var redditHosts = map[string]bool{
+	"reddit.com":     true,
+	"www.reddit.com": true,
+	"old.reddit.com": true,
+	"new.reddit.com": true,
+	"np.reddit.com":  true,
+	"i.reddit.com":   true,
+	"m.reddit.com":   true,
+	"amp.reddit.com": true,
+}
+
+// Thread (and optionally a comment in it) referred to by a URL.
+type Link struct {
+	Sub       string // Empty if the URL does not name the subreddit.
+	ThreadId  string
+	CommentId string
+	ShareId   string // Share links have no thread ID until resolved, see ShareUrl.
+}
+
+type ParseError struct {
+	input  string
+	reason string
+}
+
+func (err *ParseError) Error() string {
+	return fmt.Sprintf("invalid reddit url %q: %s", err.input, err.reason)
+}
+
+// Share links (/r/<sub>/s/<id>) only resolve to a thread by following the
+// redirect reddit.com responds with.
+func (l Link) IsShare() bool {
+	return l.ShareId != ""
+}
+
+func (l Link) ShareUrl() string {
+	return fmt.Sprintf("https://www.reddit.com/r/%s/s/%s", l.Sub, l.ShareId)
+}
+
+// Parse any of the forms a reddit thread or comment can be linked with:
+//
+//	https://www.reddit.com/r/<sub>/comments/<id>/<slug>/
+//	https://old.reddit.com/r/<sub>/comments/<id>/<slug>/<comment>/
+//	https://reddit.com/r/<sub>/comments/<id>/comment/<comment>/
+//	https://www.reddit.com/comments/<id>
+//	https://www.reddit.com/user/<name>/comments/<id>/<slug>/
+//	https://redd.it/<id>
+//	https://www.reddit.com/r/<sub>/s/<share-id>
+//	<id> or t3_<id>
+//
+// The scheme may be left out and any np., i., m. etc. subdomain is accepted.
+func Parse(input string) (Link, error) {
+	input = strings.TrimSpace(input)
+	if input == "" {
+		return Link{}, &ParseError{input, "empty input"}
+	}
+
+	// Bare thread ID.
+	if id := strings.TrimPrefix(strings.ToLower(input), "t3_"); bareIdPattern.MatchString(id) {
+		return Link{ThreadId: id}, nil
+	}
+
+	if !strings.Contains(input, "://") {
+		input = "https://" + input
+	}
+	u, err := url.Parse(input)
+	if err != nil {
+		return Link{}, &ParseError{input, err.Error()}
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return Link{}, &ParseError{input, "unsupported scheme"}
+	}
+
+	host := strings.ToLower(u.Hostname())
+	parts := []string{}
+	for _, p := range strings.Split(u.Path, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+
+	if host == "redd.it" || host == "www.redd.it" {
+		if len(parts) != 1 {
+			return Link{}, &ParseError{input, "expected redd.it/<id>"}
+		}
+		return newLink("", parts[0], "", input)
+	}
+	if !redditHosts[host] {
+		return Link{}, &ParseError{input, "not a reddit host"}
+	}
+
+	sub := ""
+	switch {
+	case len(parts) >= 2 && strings.EqualFold(parts[0], "r"):
+		sub = parts[1]
+		if !subPattern.MatchString(sub) {
+			return Link{}, &ParseError{input, "invalid subreddit"}
+		}
+		parts = parts[2:]
+	case len(parts) >= 2 && (strings.EqualFold(parts[0], "u") || strings.EqualFold(parts[0], "user")):
+		// Posts to user profiles have the same layout under /user/<name>.
+		parts = parts[2:]
+	}
+
+	if len(parts) == 2 && parts[0] == "s" && sub != "" {
+		if !sharePattern.MatchString(parts[1]) {
+			return Link{}, &ParseError{input, "invalid share link"}
+		}
+		return Link{Sub: sub, ShareId: parts[1]}, nil
+	}
+
+	if len(parts) < 2 || parts[0] != "comments" {
+		return Link{}, &ParseError{input, "not a link to a thread"}
+	}
+	threadId := parts[1]
+
+	// The segment after the ID is a slug, followed by the comment ID in
+	// permalinks. Newer permalinks use /comment/<id> in place of the slug.
+	commentId := ""
+	rest := parts[2:]
+	if len(rest) >= 2 {
+		commentId = rest[1]
+	}
+	if len(rest) > 2 {
+		return Link{}, &ParseError{input, "unexpected path"}
+	}
+
+	return newLink(sub, threadId, commentId, input)
+}
+
+func newLink(sub, threadId, commentId, input string) (Link, error) {
+	threadId = strings.TrimPrefix(strings.ToLower(threadId), "t3_")
+	if !idPattern.MatchString(threadId) {
+		return Link{}, &ParseError{input, "invalid thread ID"}
+	}
+	commentId = strings.TrimPrefix(strings.ToLower(commentId), "t1_")
+	if commentId != "" && !idPattern.MatchString(commentId) {
+		return Link{}, &ParseError{input, "invalid comment ID"}
+	}
+	return Link{Sub: sub, ThreadId: threadId, CommentId: commentId}, nil
+}
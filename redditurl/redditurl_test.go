@@ -0,0 +1,74 @@
+package redditurl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Link
+	}{
+		{"https://www.reddit.com/r/test/comments/agi5zf/test/", Link{Sub: "test", ThreadId: "agi5zf"}},
+		{"https://www.reddit.com/r/test/comments/agi5zf", Link{Sub: "test", ThreadId: "agi5zf"}},
+		{"https://reddit.com/r/AskReddit/comments/1abcdef/some_title/", Link{Sub: "AskReddit", ThreadId: "1abcdef"}},
+		{"http://old.reddit.com/r/golang/comments/1abcdef/title/", Link{Sub: "golang", ThreadId: "1abcdef"}},
+		{"https://np.reddit.com/r/golang/comments/1abcdef/title/", Link{Sub: "golang", ThreadId: "1abcdef"}},
+		{"https://i.reddit.com/r/golang/comments/1abcdef/title/", Link{Sub: "golang", ThreadId: "1abcdef"}},
+		{"https://m.reddit.com/r/golang/comments/1abcdef/", Link{Sub: "golang", ThreadId: "1abcdef"}},
+		{"www.reddit.com/r/golang/comments/1abcdef/title", Link{Sub: "golang", ThreadId: "1abcdef"}},
+		{"reddit.com/r/golang/comments/1abcdef/title?utm_source=share#top", Link{Sub: "golang", ThreadId: "1abcdef"}},
+		{"https://www.reddit.com/comments/1abcdef", Link{ThreadId: "1abcdef"}},
+		{"https://www.reddit.com/comments/1abcdef/title/", Link{ThreadId: "1abcdef"}},
+		{"https://www.reddit.com/user/someone/comments/1abcdef/title/", Link{ThreadId: "1abcdef"}},
+		{"https://redd.it/1abcdef", Link{ThreadId: "1abcdef"}},
+		{"redd.it/agi5zf", Link{ThreadId: "agi5zf"}},
+		{"https://www.reddit.com/r/golang/comments/1abcdef/title/kx9z2ab/", Link{Sub: "golang", ThreadId: "1abcdef", CommentId: "kx9z2ab"}},
+		{"https://www.reddit.com/r/golang/comments/1abcdef/title/kx9z2ab/?context=3", Link{Sub: "golang", ThreadId: "1abcdef", CommentId: "kx9z2ab"}},
+		{"https://www.reddit.com/r/golang/comments/1abcdef/comment/kx9z2ab/", Link{Sub: "golang", ThreadId: "1abcdef", CommentId: "kx9z2ab"}},
+		{"https://old.reddit.com/comments/1abcdef/title/kx9z2ab", Link{ThreadId: "1abcdef", CommentId: "kx9z2ab"}},
+		{"https://www.reddit.com/r/golang/s/AbCdEf1234", Link{Sub: "golang", ShareId: "AbCdEf1234"}},
+		{"1abcdef", Link{ThreadId: "1abcdef"}},
+		{"t3_1abcdef", Link{ThreadId: "1abcdef"}},
+		{"  AGI5ZF ", Link{ThreadId: "agi5zf"}},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := Parse(test.input)
+			assert.Nil(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"abc",
+		"https://www.reddit.com/r/test/",
+		"https://www.reddit.com/r/test/comments/",
+		"https://www.reddit.com/r/test/comments/ab-cd/",
+		"https://www.reddit.com/r/t/comments/agi5zf/",
+		"https://www.reddit.com/r/test/comments/agi5zf/title/comment/extra/",
+		"https://www.reddit.com/s/AbCdEf1234",
+		"https://example.com/r/test/comments/agi5zf/",
+		"ftp://www.reddit.com/r/test/comments/agi5zf/",
+		"https://redd.it/",
+		"https://redd.it/agi5zf/extra",
+		"not a url at all",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			_, err := Parse(input)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestShareUrl(t *testing.T) {
+	link, _ := Parse("https://www.reddit.com/r/golang/s/AbCdEf1234")
+	assert.True(t, link.IsShare())
+	assert.Equal(t, "https://www.reddit.com/r/golang/s/AbCdEf1234", link.ShareUrl())
+}
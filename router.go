@@ -4,13 +4,12 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ilmari-h/bettit/ratelimiter"
+	"github.com/ilmari-h/bettit/redditurl"
 
 	"github.com/chenyahui/gin-cache"
 	"github.com/chenyahui/gin-cache/persist"
@@ -40,6 +39,7 @@ func (err *RouterError) Code() int {
 }
 
 var archivePostCache map[string]int64 // Post ID to timestamp
+var pageCache *persist.MemoryStore    // Pages cached by the router, see cachePage.
 
 type RouterOptions struct {
 	GetCacheTime       int
@@ -47,18 +47,25 @@ type RouterOptions struct {
 	PostCacheTime      int
 	PostRateLimitD     int
 	PostRateLimitN     int
+	PageComments       int
+	PageDepth          int
+	AdminToken         string // Admin API is disabled if empty.
+	BaseUrl            string // Address of the site in canonical links, the address requested if empty.
+	Robots             string // Contents of robots.txt, a default allowing archive pages if empty.
 }
 
 var routerOptions RouterOptions
 
-func getThread(req *http.Request) ([]byte, *RouterError) {
+// Request a page of a thread. Returns the body of the response and its status
+// line and headers.
+func getThread(req *http.Request) ([]byte, string, *RouterError) {
 
 	client := http.Client{
 		Timeout: time.Second * time.Duration(clientOptions.Timeout),
 	}
 	res, err := client.Do(req)
 	if err != nil {
-		return nil, &RouterError{code: http.StatusBadRequest, message: err.Error()}
+		return nil, "", &RouterError{code: http.StatusBadRequest, message: err.Error()}
 	}
 
 	if res.Body != nil {
@@ -70,15 +77,15 @@ func getThread(req *http.Request) ([]byte, *RouterError) {
 			fmt.Sprintf("Bad response to request at: %s", req.URL.Path),
 			fmt.Sprintf("Status: %s", res.Status),
 		).Error()
-		return nil, &RouterError{code: res.StatusCode, message: "Recieved unsuccessful response from Reddit API."}
+		return nil, "", &RouterError{code: res.StatusCode, message: "Recieved unsuccessful response from Reddit API."}
 	}
 
 	body, readErr := ioutil.ReadAll(res.Body)
 	if readErr != nil {
-		return nil, &RouterError{code: http.StatusBadRequest, message: err.Error()}
+		return nil, "", &RouterError{code: http.StatusBadRequest, message: err.Error()}
 	}
 
-	return body, nil
+	return body, responseHeader(res), nil
 }
 
 func routeGetIndex(c *gin.Context) {
@@ -108,18 +115,35 @@ func routeSubThreads(c *gin.Context) {
 	if qPage, err := strconv.Atoi(c.Query("page")); err == nil {
 		page = qPage
 	}
-	if status := RenderSubThreads(page, c.Writer, sub); status != 200 {
+	removals := c.Query("filter") == "removals"
+	if status := RenderSubThreads(page, c.Writer, sub, removals); status != 200 {
 		RenderErrorPage(status, c.Writer)
 	}
 }
 
-func NewThreadRequest(sub string, threadId string, commentId string) (*http.Request, error) {
+// API endpoint of a thread, or of the comment thread starting from commentId if it is not empty.
+func threadRequestUrl(sub string, threadId string, commentId string) string {
 
-	requestUrl := fmt.Sprintf("https://oauth.reddit.com/r/%s/comments/%s?sort=confidence.json", sub, threadId)
+	// The subreddit is not required by the API, links like redd.it/<id> don't include it.
+	prefix := "https://oauth.reddit.com"
+	if sub != "" {
+		prefix = fmt.Sprintf("https://oauth.reddit.com/r/%s", sub)
+	}
+	// Comments are requested in "best" order, which is kept as their rank.
 	if commentId != "" {
-		requestUrl = fmt.Sprintf("https://oauth.reddit.com/r/%s/comments/%s/comment/%s?sort=confidence.json", sub, threadId, commentId)
+		return fmt.Sprintf("%s/comments/%s/comment/%s?sort=confidence", prefix, threadId, commentId)
 	}
+	return fmt.Sprintf("%s/comments/%s?sort=confidence", prefix, threadId)
+}
+
+func NewThreadRequest(sub string, threadId string, commentId string) (*http.Request, error) {
+
+	requestUrl := threadRequestUrl(sub, threadId, commentId)
 	req, err := http.NewRequest(http.MethodGet, requestUrl, nil)
+	if err != nil {
+		Log("Error forming API request.", err.Error()).Error()
+		return nil, &RouterError{code: http.StatusBadRequest, message: ""}
+	}
 	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("Authorization", "bearer "+apiToken)
 
@@ -129,96 +153,252 @@ func NewThreadRequest(sub string, threadId string, commentId string) (*http.Requ
 		return nil, &RouterError{code: http.StatusBadRequest, message: ""}
 	}
 
+	return req, nil
+}
+
+// Share links redirect to the thread they were created for.
+func resolveShareLink(link redditurl.Link) (redditurl.Link, error) {
+	client := http.Client{
+		Timeout: time.Second * time.Duration(clientOptions.Timeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, link.ShareUrl(), nil)
+	req.Header.Set("User-Agent", userAgent)
+
+	res, err := client.Do(req)
 	if err != nil {
-		Log("Error forming API request.", err.Error()).Error()
-		return nil, &RouterError{code: http.StatusBadRequest, message: ""}
+		return link, err
 	}
-	return req, nil
+	res.Body.Close()
+
+	location := res.Header.Get("Location")
+	if location == "" {
+		return link, &RouterError{code: http.StatusBadRequest, message: "Share link did not redirect"}
+	}
+	resolved, pErr := redditurl.Parse(location)
+	if pErr != nil {
+		return link, pErr
+	}
+	if resolved.IsShare() {
+		return link, &RouterError{code: http.StatusBadRequest, message: "Share link redirected to another share link"}
+	}
+	return resolved, nil
 }
 
-func readThreadUrl(turl *url.URL) (struct {
-	Sub string
-	Id  string
-}, bool) {
-	urlParts := strings.Split(turl.Path, "/")
-	if len(urlParts) < 5 {
-		return struct {
-			Sub string
-			Id  string
-		}{"", ""}, true
+// Read the thread (and comment) an archive request refers to.
+// Accepts every form handled by redditurl.Parse.
+func readThreadUrl(input string) (redditurl.Link, bool) {
+	link, err := redditurl.Parse(input)
+	if err != nil {
+		Log("Invalid thread url", err.Error()).Debug()
+		return link, true
+	}
+	if link.IsShare() {
+		if link, err = resolveShareLink(link); err != nil {
+			Log("Error resolving share link", err.Error()).Error()
+			return link, true
+		}
 	}
-	idIsValid :=
-		regexp.MustCompile(`^[a-zA-Z0-9]*$`).MatchString(urlParts[4]) && // Alphanumeric ID
-			len(urlParts[4]) <= 6 && // Correct length
-			urlParts[1] == "r" && // check format
-			urlParts[3] == "comments" // check format
+	return link, false
+}
 
-	return struct {
-		Sub string
-		Id  string
-	}{urlParts[2], urlParts[4]}, !idIsValid
+// Request the thread from the API to be archived. Webhooks are notified if
+// the request fails.
+func requestThread(link redditurl.Link) ([]byte, string, *RouterError) {
+	req, err := NewThreadRequest(link.Sub, link.ThreadId, "")
+	if err != nil {
+		return nil, "", &RouterError{code: http.StatusBadRequest, message: "Invalid thread"}
+	}
+	data, header, tErr := getThread(req)
+	if tErr != nil {
+		emitEvent(fetchFailedEvent(link.Sub, link.ThreadId, tErr))
+		return nil, "", tErr
+	}
+	return data, header, nil
 }
 
 func routePostArchive(c *gin.Context) {
 	input := c.PostForm("archivef")
 
 	// Parse an API request based on input
-	url, _ := url.Parse(input)
-	urlParts, urlErr := readThreadUrl(url)
+	link, urlErr := readThreadUrl(input)
 
 	if urlErr {
 		RenderErrorPage(400, c.Writer)
 		return
 	}
 
-	if ts, exists := archivePostCache[urlParts.Id]; exists && int64(routerOptions.PostCacheTime) > time.Now().Unix()-ts {
-		RenderAlreadyExists(urlParts.Id, c.Writer)
-		return
+	// Permalinks to comments take the user straight to the comment.
+	route := link.ThreadId
+	if link.CommentId != "" {
+		route = fmt.Sprintf("%s/c/%s", link.ThreadId, link.CommentId)
 	}
 
-	req, err := NewThreadRequest(urlParts.Sub, urlParts.Id, "")
-	if err != nil {
-		RenderErrorPage(400, c.Writer)
+	if ts, exists := archivePostCache[link.ThreadId]; exists && int64(routerOptions.PostCacheTime) > time.Now().Unix()-ts {
+		RenderAlreadyExists(route, c.Writer)
 		return
 	}
 
-	threadBytes, tErr := getThread(req)
+	threadBytes, header, tErr := requestThread(link)
 	if tErr != nil {
 		RenderErrorPage(tErr.code, c.Writer)
 		return
 	}
 
-	if dbError := archiveThread(urlParts.Sub, threadBytes); dbError != nil {
-		RenderAlreadyExists(urlParts.Id, c.Writer)
+	if dbError := archiveThread(link.Sub, threadBytes, header); dbError != nil {
+		RenderAlreadyExists(route, c.Writer)
 	} else {
-		archivePostCache[urlParts.Id] = time.Now().Unix()
-		RenderRedirectPage(urlParts.Id, c.Writer)
+		archivePostCache[link.ThreadId] = time.Now().Unix()
+		RenderRedirectPage(route, c.Writer)
 	}
 }
 
 func routeGetPage(c *gin.Context) {
 	threadId := c.Param("threadid")
-	if status := RenderThreadPage(threadId, c.Writer); status != 200 {
+	if strings.HasSuffix(threadId, ".warc.gz") {
+		routeGetWarc(c, strings.TrimSuffix(threadId, ".warc.gz"))
+		return
+	}
+	if exportId, format, ok := readExportPath(threadId); ok {
+		routeGetExport(c, exportId, format)
+		return
+	}
+	if c.Query("download") == "1" {
+		routeGetDownload(c, strings.Split(threadId, "-")[0])
+		return
+	}
+	page := 0
+	if qPage, err := strconv.Atoi(c.Query("page")); err == nil {
+		page = qPage
+	}
+	if status := RenderThreadPage(threadId, c.Query("sort"), page, requestBaseUrl(c), c.Writer); status != 200 {
 		RenderErrorPage(status, c.Writer)
 	}
 }
 
+// Download of the whole thread in another format, such as /abc123.md.
+func routeGetExport(c *gin.Context, threadId string, format string) {
+	thread, err := queryExport(threadId, c.Query("sort"))
+	if err != nil {
+		RenderErrorPage(500, c.Writer)
+		return
+	} else if thread == nil {
+		RenderErrorPage(404, c.Writer)
+		return
+	}
+	c.Header("Content-Type", exportFormats[format].mime)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, threadId, format))
+	if err := exportFormats[format].write(c.Writer, thread); err != nil {
+		Log("Error exporting thread", err.Error()).Error()
+	}
+}
+
+// Download of the whole thread as one HTML file that works offline.
+func routeGetDownload(c *gin.Context, threadId string) {
+	download, err := GetDownloadQuery(threadId, c.Query("sort"))
+	if err != nil {
+		RenderErrorPage(500, c.Writer)
+		return
+	} else if download == nil {
+		RenderErrorPage(404, c.Writer)
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.html"`, threadId))
+	if err := writeDownload(c.Writer, download); err != nil {
+		Log("Error rendering download", err.Error()).Error()
+	}
+}
+
+// Address of the site, such as https://example.com. The configured one if
+// set, otherwise the one the request was made to.
+func requestBaseUrl(c *gin.Context) string {
+	if routerOptions.BaseUrl != "" {
+		return strings.TrimRight(routerOptions.BaseUrl, "/")
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// Download of the thread as a WARC file, such as /abc123.warc.gz.
+func routeGetWarc(c *gin.Context, threadId string) {
+	if snaps, err := queryLatestSnapshots([]string{threadId}); err != nil {
+		RenderErrorPage(500, c.Writer)
+		return
+	} else if len(snaps) == 0 {
+		RenderErrorPage(404, c.Writer)
+		return
+	}
+	c.Header("Content-Type", "application/warc")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.warc.gz"`, threadId))
+	if err := writeWarc(c.Writer, []string{threadId}, requestBaseUrl(c)); err != nil {
+		Log("Error exporting WARC", err.Error()).Error()
+	}
+}
+
+func routeGetComment(c *gin.Context) {
+	context := 0
+	if qContext, err := strconv.Atoi(c.Query("context")); err == nil && qContext > 0 {
+		context = qContext
+	}
+	if status := RenderCommentPage(c.Param("threadid"), c.Param("commentid"), context, c.Query("sort"), requestBaseUrl(c), c.Writer); status != 200 {
+		RenderErrorPage(status, c.Writer)
+	}
+}
+
+// Cache of pages by the address of the site and the request URI. Links in the
+// pages use the address the request was made to when no base URL is set, so a
+// page requested with another Host header is cached separately.
+func cachePage(store persist.CacheStore, expire time.Duration) gin.HandlerFunc {
+	return cache.Cache(store, expire, cache.WithCacheStrategyByRequest(func(c *gin.Context) (bool, cache.Strategy) {
+		return true, cache.Strategy{CacheKey: requestBaseUrl(c) + c.Request.RequestURI}
+	}))
+}
+
+// Drop every cached page. Taken down threads are linked from listings as well
+// as from their own pages, and takedowns are rare enough to not keep track of
+// which pages refer to a thread.
+func purgePageCache() {
+	if pageCache != nil {
+		pageCache.Cache.Purge()
+	}
+}
+
 func GettitRouter(opts RouterOptions) *gin.Engine {
 
 	routerOptions = opts
 	archivePostCache = make(map[string]int64)
 	memCache := persist.NewMemoryStore(time.Second * time.Duration(routerOptions.GetCacheExpiration))
+	pageCache = memCache
 	getCacheTime := time.Second * time.Duration(routerOptions.GetCacheTime)
 
 	r := gin.Default()
-	r.GET("/", cache.CacheByRequestURI(memCache, getCacheTime), routeGetIndex)
-	r.GET("/about", cache.CacheByRequestURI(memCache, getCacheTime), routeGetAbout)
-	r.GET("/subs", cache.CacheByRequestURI(memCache, getCacheTime), routeSubsList)
-	r.GET("/subs/:subId", cache.CacheByRequestURI(memCache, getCacheTime), routeSubThreads)
+	r.GET("/", cachePage(memCache, getCacheTime), routeGetIndex)
+	r.GET("/about", cachePage(memCache, getCacheTime), routeGetAbout)
+	r.GET("/subs", cachePage(memCache, getCacheTime), routeSubsList)
+	r.GET("/subs/:subId", cachePage(memCache, getCacheTime), routeSubThreads)
+	// Feeds are not cached, they answer conditional requests.
+	r.GET("/subs/:subId/feed.atom", routeGetFeed)
+	r.GET("/feed.atom", routeGetFeed)
+	r.GET("/feed.rss", routeGetFeed)
+	r.GET("/sitemap.xml", routeGetSitemap)
+	r.GET("/robots.txt", routeGetRobots)
 	r.GET("/health", func(c *gin.Context) {
 		c.String(http.StatusOK, "API is live.")
 	})
-	r.GET("/:threadid", cache.CacheByRequestURI(memCache, getCacheTime), routeGetPage)
+	r.GET("/media/:hash", routeGetMedia)
+	r.GET("/:threadid", cachePage(memCache, getCacheTime), routeGetPage)
+	r.GET("/:threadid/c/:commentid", cachePage(memCache, getCacheTime), routeGetComment)
+	r.GET("/:threadid/at/:datetime", cachePage(memCache, getCacheTime), routeGetMemento)
+	r.GET("/oembed", routeGetOEmbed)
+	r.GET("/embed/:threadid/:commentid", cachePage(memCache, getCacheTime), routeGetEmbed)
+	r.GET("/timegate/*original", routeGetTimeGate)
+	r.GET("/timemap/link/*original", routeGetTimeMap)
 
 	limitRateByIP := ratelimiter.NewRateLimiter(
 		time.Second*time.Duration(routerOptions.PostRateLimitD),
@@ -232,5 +412,8 @@ func GettitRouter(opts RouterOptions) *gin.Engine {
 	)
 
 	r.POST("/archive", limitRateByIP.LimitRate(), routePostArchive)
+	if routerOptions.AdminToken != "" {
+		adminRoutes(r, routerOptions.AdminToken)
+	}
 	return r
 }
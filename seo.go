@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+//
+// Sitemaps, robots.txt and metadata of archive pages for search engines and
+// link previews.
+//
+
+// Threads listed in one sitemap.
+const SITEMAP_URLS = 10000
+
+// Length of page descriptions.
+const SEO_DESCRIPTION = 200
+
+// Description of an archive page: the start of the post, or a summary of the
+// thread if the post has no text.
+func pageDescription(thrTmpl *ThreadTmpl) string {
+	text := strings.Join(strings.Fields(htmlToText(html.UnescapeString(string(thrTmpl.ThreadContent)))), " ")
+	if len([]rune(text)) > SEO_DESCRIPTION {
+		text = string([]rune(text)[:SEO_DESCRIPTION]) + "…"
+	}
+	if text == "" {
+		text = fmt.Sprintf("Archive of a thread in r/%s by u/%s with %d comments.",
+			thrTmpl.Subreddit, thrTmpl.Author, thrTmpl.repliesNum,
+		)
+	}
+	return text
+}
+
+func (arch *ArchiveTmpl) CanonicalUrl() string {
+	return arch.BaseUrl + arch.CanonicalPath
+}
+
+func (arch *ArchiveTmpl) ImageUrl() string {
+	if arch.Image == "" {
+		return ""
+	}
+	return arch.BaseUrl + arch.Image
+}
+
+// Structured data of the thread as a schema.org DiscussionForumPosting.
+func (arch *ArchiveTmpl) JsonLd() template.JS {
+	posting := map[string]interface{}{
+		"@context":         "https://schema.org",
+		"@type":            "DiscussionForumPosting",
+		"headline":         arch.ThreadTitle,
+		"url":              arch.CanonicalUrl(),
+		"mainEntityOfPage": arch.CanonicalUrl(),
+		"text":             arch.Description,
+		"datePublished":    time.Unix(arch.created, 0).UTC().Format(time.RFC3339),
+		"dateModified":     time.Unix(arch.archived, 0).UTC().Format(time.RFC3339),
+		"commentCount":     arch.repliesNum,
+		"isBasedOn":        fmt.Sprintf("https://www.reddit.com/r/%s/comments/%s/", arch.Subreddit, arch.ThreadId),
+		"author": map[string]string{
+			"@type": "Person",
+			"name":  "u/" + arch.Author,
+			"url":   "https://www.reddit.com/user/" + arch.Author,
+		},
+	}
+	if image := arch.ImageUrl(); image != "" {
+		posting["image"] = image
+	}
+	// Marshalling escapes <, > and &, the result is safe in a script element.
+	data, err := json.Marshal(posting)
+	if err != nil {
+		return ""
+	}
+	return template.JS(data)
+}
+
+type sitemapUrl struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapUrlSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	Urls    []sitemapUrl `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapUrl `xml:"sitemap"`
+}
+
+func sitemapTime(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format(time.RFC3339)
+}
+
+// Archived threads on a page of the sitemap, in the order they were first archived.
+func querySitemapPage(page int) ([]sitemapUrl, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT thread_id, archive_timestamp
+		FROM threads
+		WHERE continuing_reply = ""
+		ORDER BY id
+		LIMIT ?, ?`, page*SITEMAP_URLS, SITEMAP_URLS,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in sitemap query", qErr.Error()})
+	}
+	defer rows.Close()
+	urls := []sitemapUrl{}
+	for rows.Next() {
+		threadId := ""
+		var archived int64
+		rows.Scan(&threadId, &archived)
+		urls = append(urls, sitemapUrl{Loc: "/" + threadId, LastMod: sitemapTime(archived)})
+	}
+	return urls, nil
+}
+
+// Sitemaps of every page of archived threads, with the latest archive time on each.
+func querySitemapIndex() ([]sitemapUrl, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT page, MAX(archive_timestamp) FROM (
+			SELECT (ROW_NUMBER() OVER (ORDER BY id) - 1) / ? AS page, archive_timestamp
+			FROM threads
+			WHERE continuing_reply = ""
+		)
+		GROUP BY page
+		ORDER BY page`, SITEMAP_URLS,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in sitemap query", qErr.Error()})
+	}
+	defer rows.Close()
+	sitemaps := []sitemapUrl{}
+	for rows.Next() {
+		var page, archived int64
+		rows.Scan(&page, &archived)
+		sitemaps = append(sitemaps, sitemapUrl{
+			Loc:     fmt.Sprintf("/sitemap.xml?page=%d", page),
+			LastMod: sitemapTime(archived),
+		})
+	}
+	return sitemaps, nil
+}
+
+// The sitemap index, or with the page parameter a sitemap of archive pages.
+func routeGetSitemap(c *gin.Context) {
+	baseUrl := requestBaseUrl(c)
+	var doc interface{}
+	if qPage := c.Query("page"); qPage != "" {
+		page, err := strconv.Atoi(qPage)
+		if err != nil || page < 0 {
+			RenderErrorPage(404, c.Writer)
+			return
+		}
+		urls, err := querySitemapPage(page)
+		if err != nil {
+			RenderErrorPage(500, c.Writer)
+			return
+		} else if len(urls) == 0 {
+			RenderErrorPage(404, c.Writer)
+			return
+		}
+		for i := range urls {
+			urls[i].Loc = baseUrl + urls[i].Loc
+		}
+		doc = sitemapUrlSet{Urls: urls}
+	} else {
+		sitemaps, err := querySitemapIndex()
+		if err != nil {
+			RenderErrorPage(500, c.Writer)
+			return
+		}
+		for i := range sitemaps {
+			sitemaps[i].Loc = baseUrl + sitemaps[i].Loc
+		}
+		doc = sitemapIndex{Sitemaps: sitemaps}
+	}
+	data, err := xml.Marshal(doc)
+	if err != nil {
+		RenderErrorPage(500, c.Writer)
+		return
+	}
+	c.Data(http.StatusOK, "application/xml; charset=utf-8", append([]byte(xml.Header), data...))
+}
+
+func routeGetRobots(c *gin.Context) {
+	robots := routerOptions.Robots
+	if robots == "" {
+		robots = fmt.Sprintf("User-agent: *\nDisallow: /api/\nDisallow: /archive\n\nSitemap: %s/sitemap.xml\n",
+			requestBaseUrl(c),
+		)
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(robots))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSitemap(t *testing.T) {
+	useTestDatabase(t)
+	LoadTemplates()
+
+	post := testPostJson("abc123", 1)
+	post["selftext_html"] = "&lt;div class=\"md\"&gt;&lt;p&gt;Post &amp;lt;text&amp;gt;&lt;/p&gt;&lt;/div&gt;"
+	assert.Nil(t, writeArchive(parseThreadPage(testPostPageJson(post, testCommentJson("c1")), "test", ""), false))
+	assert.Nil(t, writeArchive(parseThreadPage(testPageJson("def456"), "test", ""), false))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "bettit.example"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/sitemap.xml")
+	assert.Equal(t, 200, w.Code)
+	index := sitemapIndex{}
+	assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &index))
+	if assert.Len(t, index.Sitemaps, 1) {
+		assert.Equal(t, "http://bettit.example/sitemap.xml?page=0", index.Sitemaps[0].Loc)
+		assert.NotEmpty(t, index.Sitemaps[0].LastMod)
+	}
+
+	w = get("/sitemap.xml?page=0")
+	assert.Equal(t, 200, w.Code)
+	urls := sitemapUrlSet{}
+	assert.Nil(t, xml.Unmarshal(w.Body.Bytes(), &urls))
+	if assert.Len(t, urls.Urls, 2) {
+		assert.Equal(t, "http://bettit.example/abc123", urls.Urls[0].Loc)
+	}
+	assert.Equal(t, 404, get("/sitemap.xml?page=1").Code)
+
+	w = get("/robots.txt")
+	assert.Contains(t, w.Body.String(), "Sitemap: http://bettit.example/sitemap.xml\n")
+	routerOptions.Robots = "User-agent: *\nDisallow: /\n"
+	defer func() { routerOptions.Robots = "" }()
+	assert.Equal(t, "User-agent: *\nDisallow: /\n", get("/robots.txt").Body.String())
+
+	// Metadata of archive pages.
+	w = get("/abc123")
+	assert.Equal(t, 200, w.Code)
+	page := w.Body.String()
+	assert.Contains(t, page, `<link rel="canonical" href="http://bettit.example/abc123">`)
+	assert.Contains(t, page, `<meta name="description" content="Post &lt;text&gt;">`)
+	assert.Contains(t, page, `<meta property="og:title" content="Thread abc123">`)
+	assert.Contains(t, page, `<meta name="twitter:card" content="summary">`)
+	match := regexp.MustCompile(`<script type="application/ld\+json">(.*)</script>`).FindStringSubmatch(page)
+	if assert.Len(t, match, 2) {
+		posting := map[string]interface{}{}
+		assert.Nil(t, json.Unmarshal([]byte(match[1]), &posting))
+		assert.Equal(t, "DiscussionForumPosting", posting["@type"])
+		assert.Equal(t, "Thread abc123", posting["headline"])
+		assert.Equal(t, "Post <text>", posting["text"])
+		assert.Equal(t, "http://bettit.example/abc123", posting["url"])
+		assert.Equal(t, "2022-04-15T05:20:00Z", posting["datePublished"])
+	}
+
+	w = get("/abc123/c/c1")
+	assert.Contains(t, w.Body.String(), `<link rel="canonical" href="http://bettit.example/abc123/c/c1">`)
+
+	// Pages requested with another Host header are not served to others.
+	req := httptest.NewRequest("GET", "/def456", nil)
+	req.Host = "evil.example"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	w = get("/def456")
+	assert.Contains(t, w.Body.String(), `<link rel="canonical" href="http://bettit.example/def456">`)
+	assert.NotContains(t, w.Body.String(), "evil.example")
+}
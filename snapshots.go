@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+func compressRaw(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressRaw(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// Record a snapshot of the thread with the responses of every page in it.
+func (dbtx *ThreadDbTx) txPostSnapshot(root *ThreadPage) error {
+	res, err := dbtx.tx.Exec(`
+		INSERT INTO snapshots (thread_id, sub, replies_num, archive_timestamp)
+		VALUES ( ?, ?, ?, ? );
+		`, root.Post.Id, root.Sub, root.Post.RepliesNum, dbtx.timestamp,
+	)
+	if err != nil {
+		return &DbError{"Error creating snapshot", err.Error()}
+	}
+	snapshotId, _ := res.LastInsertId()
+	dbtx.snapshotId = snapshotId
+
+	for _, page := range root.pages() {
+		compressed, zErr := compressRaw(page.Raw)
+		if zErr != nil {
+			return &DbError{"Error compressing page", zErr.Error()}
+		}
+		if _, err := dbtx.tx.Exec(`
+			INSERT INTO raw_pages (snapshot_id, continuing_reply, request_url, fetch_timestamp, response_headers, data)
+			VALUES ( ?, ?, ?, ?, ?, ? );
+			`, snapshotId, page.FromReply, page.RequestUrl, page.FetchTime, page.Response, compressed,
+		); err != nil {
+			return &DbError{"Error storing page", err.Error()}
+		}
+	}
+	return nil
+}
+
+// Remove every stored page and comment of a thread. Snapshots are kept.
+func (dbtx *ThreadDbTx) txDeleteThread(threadId string) error {
+	if _, err := dbtx.tx.Exec(`
+		DELETE FROM comments WHERE thread_key IN (SELECT id FROM threads WHERE thread_id = ?)
+		`, threadId,
+	); err != nil {
+		return &DbError{"Error deleting comments", err.Error()}
+	}
+	if _, err := dbtx.tx.Exec(`DELETE FROM threads WHERE thread_id = ?`, threadId); err != nil {
+		return &DbError{"Error deleting thread", err.Error()}
+	}
+	return nil
+}
+
+type snapshotRow struct {
+	id          int64
+	threadId    string
+	sub         string
+	repliesNum  int64
+	archiveTime int64
+}
+
+// Latest snapshot of each of the given threads, or of every thread if none are given.
+func queryLatestSnapshots(threadIds []string) ([]snapshotRow, error) {
+	where := ""
+	args := []interface{}{}
+	if len(threadIds) > 0 {
+		where = fmt.Sprintf("WHERE thread_id IN (?%s)", strings.Repeat(", ?", len(threadIds)-1))
+		for _, id := range threadIds {
+			args = append(args, id)
+		}
+	}
+	rows, qErr := dbReadOnly.Query(`
+		SELECT id, thread_id, sub, replies_num, MAX(archive_timestamp)
+		FROM snapshots
+		`+where+`
+		GROUP BY thread_id
+		ORDER BY thread_id`, args...,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in snapshot query", qErr.Error()})
+	}
+	defer rows.Close()
+	snapshots := []snapshotRow{}
+	for rows.Next() {
+		snap := snapshotRow{}
+		rows.Scan(&snap.id, &snap.threadId, &snap.sub, &snap.repliesNum, &snap.archiveTime)
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, nil
+}
+
+// Every snapshot of a thread, oldest first.
+func querySnapshots(threadId string) ([]snapshotRow, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT id, thread_id, sub, replies_num, archive_timestamp
+		FROM snapshots
+		WHERE thread_id = ?
+		ORDER BY archive_timestamp, id`, threadId,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in snapshot query", qErr.Error()})
+	}
+	defer rows.Close()
+	snapshots := []snapshotRow{}
+	for rows.Next() {
+		snap := snapshotRow{}
+		rows.Scan(&snap.id, &snap.threadId, &snap.sub, &snap.repliesNum, &snap.archiveTime)
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, nil
+}
+
+type rawPageRow struct {
+	continuingReply string
+	requestUrl      string
+	fetchTime       int64
+	data            []byte // Decompressed.
+}
+
+// Stored responses of a snapshot by the comment their page continues from.
+func queryRawPages(snapshotId int64) (map[string]rawPageRow, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT continuing_reply, request_url, fetch_timestamp, data
+		FROM raw_pages
+		WHERE snapshot_id = ?
+		ORDER BY id`, snapshotId,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in raw page query", qErr.Error()})
+	}
+	defer rows.Close()
+	pages := map[string]rawPageRow{}
+	for rows.Next() {
+		page := rawPageRow{}
+		compressed := []byte{}
+		rows.Scan(&page.continuingReply, &page.requestUrl, &page.fetchTime, &compressed)
+		data, zErr := decompressRaw(compressed)
+		if zErr != nil {
+			return nil, LogE(&DbError{"Error decompressing page", zErr.Error()})
+		}
+		page.data = data
+		pages[page.continuingReply] = page
+	}
+	return pages, nil
+}
+
+// Fetches continuation pages from the responses stored with a snapshot.
+func storedPageFetcher(pages map[string]rawPageRow) pageFetcher {
+	return func(sub string, threadId string, commentId string) ([]byte, string, error) {
+		if page, ok := pages[commentId]; ok {
+			return page.data, "", nil
+		}
+		return nil, "", &DbError{"Page not stored", fmt.Sprintf("%s-%s", threadId, commentId)}
+	}
+}
+
+// Build the tree of pages of a snapshot from its stored responses.
+func loadSnapshot(snap snapshotRow) (*ThreadPage, error) {
+	pages, err := queryRawPages(snap.id)
+	if err != nil {
+		return nil, err
+	}
+	rootRaw, ok := pages[""]
+	if !ok {
+		return nil, &DbError{"Snapshot has no stored pages", snap.threadId}
+	}
+	root := parseThreadPage(rootRaw.data, snap.sub, "")
+	root.RequestUrl = rootRaw.requestUrl
+	root.FetchTime = rootRaw.fetchTime
+	resolveContinuations(root, storedPageFetcher(pages), 1)
+	for _, page := range root.pages() {
+		page.RequestUrl = pages[page.FromReply].requestUrl
+		page.FetchTime = pages[page.FromReply].fetchTime
+	}
+	return root, nil
+}
+
+// Rebuild the thread and comment rows of a thread from a snapshot.
+func reparseSnapshot(snap snapshotRow) error {
+	root, err := loadSnapshot(snap)
+	if err != nil {
+		return err
+	}
+
+	tx, txErr := NewTransaction(true)
+	if txErr != nil {
+		return LogE(&DbError{"Error starting transaction", txErr.Error()})
+	}
+	tx.timestamp = snap.archiveTime
+	tx.snapshotId = snap.id
+	if err := tx.txReplaceThread(root); err != nil {
+		tx.rollback()
+		return err
+	}
+	if err := tx.txPostLinks(root); err != nil {
+		tx.rollback()
+		return err
+	}
+	if err := tx.txPostPoll(root); err != nil {
+		tx.rollback()
+		return err
+	}
+	tx.done()
+	return nil
+}
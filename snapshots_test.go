@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReparseSnapshot(t *testing.T) {
+	useTestDatabase(t)
+
+	data := testPageJson("abc123", testCommentJson("c1"), testContinuedJson("c2"))
+	root := fetchArchive("", data, "", func(sub, threadId, commentId string) ([]byte, string, error) {
+		return testPageJson(threadId, testCommentJson(commentId, testCommentJson("c3"))), "", nil
+	})
+	assert.Nil(t, writeArchive(root, false))
+
+	snapshots, err := queryLatestSnapshots([]string{"abc123"})
+	assert.Nil(t, err)
+	if !assert.Len(t, snapshots, 1) {
+		return
+	}
+
+	// Responses are stored as returned.
+	pages, err := queryRawPages(snapshots[0].id)
+	assert.Nil(t, err)
+	assert.Len(t, pages, 2)
+	assert.Equal(t, data, pages[""].data)
+	assert.Equal(t, "https://oauth.reddit.com/r/test/comments/abc123/comment/c2?sort=confidence", pages["c2"].requestUrl)
+
+	// Lose the parsed rows, then rebuild them.
+	dbReadOnly.Exec(`DELETE FROM comments`)
+	dbReadOnly.Exec(`UPDATE threads SET title = 'broken'`)
+
+	assert.Nil(t, reparseSnapshot(snapshots[0]))
+
+	arch, _ := GetArchiveQuery("abc123", "", "", 0)
+	if assert.NotNil(t, arch) {
+		assert.Equal(t, "Thread abc123", arch.ThreadTitle)
+		assert.Contains(t, string(arch.ThreadHTML), "comment c1<")
+	}
+	cont, _ := GetArchiveQuery("abc123", "c2", "", 0)
+	if assert.NotNil(t, cont) {
+		assert.Contains(t, string(cont.ThreadHTML), "comment c3<")
+	}
+
+	threads := 0
+	dbReadOnly.QueryRow(`SELECT COUNT(*) FROM threads WHERE thread_id = 'abc123'`).Scan(&threads)
+	assert.Equal(t, 2, threads)
+}
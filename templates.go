@@ -1,16 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 const ITEMS_ON_PAGE = 100
 
+// Maximum number of parents shown for a linked comment.
+const MAX_COMMENT_CONTEXT = 8
+
 //
 // Types used in templates.
 //
@@ -21,8 +26,20 @@ type IndexTmpl struct {
 }
 
 type SubThreadsTmpl struct {
-	page    int
-	Threads []ArchiveLinkTmpl // urls
+	page     int
+	Threads  []ArchiveLinkTmpl // urls
+	Sub      string
+	Removals bool        // Only threads with removals are listed.
+	Follow   *FollowTmpl // Nil if the subreddit is not followed.
+}
+
+type FollowTmpl struct {
+	Listings   string
+	Rules      []string
+	Interval   string
+	LastRun    string
+	LastStatus string
+	Archived   int64
 }
 
 type ArchiveLinkTmpl struct {
@@ -44,6 +61,41 @@ type ArchiveTmpl struct {
 	ReplyId     string
 	Subreddit   string
 	ThreadHTML  template.HTML
+	Sort        string
+	SortOrders  []string
+	Page        int
+	PageCount   int
+
+	// Metadata for search engines and link previews.
+	BaseUrl       string // Address of the site, for absolute links.
+	CanonicalPath string
+	Description   string
+	Image         string // Path of the first archived image of the post.
+	Author        string
+	created       int64
+	archived      int64
+	repliesNum    int
+}
+
+// Archive page downloaded as a single file.
+type DownloadTmpl struct {
+	*ArchiveTmpl
+	Styles template.CSS
+}
+
+func (arch *ArchiveTmpl) PageNumber() int {
+	return arch.Page + 1
+}
+
+func (arch *ArchiveTmpl) PrevPage() int {
+	return arch.Page - 1
+}
+
+func (arch *ArchiveTmpl) NextPage() int {
+	if arch.Page+1 < arch.PageCount {
+		return arch.Page + 1
+	}
+	return -1
 }
 
 type RedirectTmpl struct {
@@ -51,6 +103,7 @@ type RedirectTmpl struct {
 }
 
 type ThreadTmpl struct {
+	ThreadId          string
 	ThreadTitle       string
 	ThreadContent     template.HTML
 	ThreadContentLink string
@@ -58,17 +111,119 @@ type ThreadTmpl struct {
 	Replies           []*CommentTmpl
 	Author            string
 	Time              string
+	LinkFlair         string
+	AuthorFlair       string
+	Edited            string
+	Distinguished     string
+	Stickied          bool
+	Locked            bool
+	RemovedBy         string
+	UpvotePercent     int
+	Gilded            int
+	Awards            []AwardTmpl
+	CrosspostParent   string
+	Images            []string // Archived images of the post.
+	Video             string   // Archived video of the post.
+	Poll              *PollTmpl
+	LinksTo           []ThreadLinkTmpl // Threads the post is a crosspost of or links to.
+	LinkedFrom        []ThreadLinkTmpl // Archived threads crossposting or linking the post.
+	created           int64
+	repliesNum        int
+}
+
+type ThreadLinkTmpl struct {
+	ThreadId  string
+	Subreddit string
+	Title     string // Empty if the thread is not archived.
+	Kind      string
+	Archived  bool
+	Url       string // The archived copy if there is one, otherwise the thread on Reddit.
+}
+
+type PollTmpl struct {
+	Options    []PollOptionTmpl
+	TotalVotes int64
+	VotingEnd  string
+	Closed     bool               // Voting had ended when the thread was archived.
+	History    []PollSnapshotTmpl // Votes in each snapshot, if the thread has been archived several times.
+}
+
+type PollOptionTmpl struct {
+	Text    string
+	Votes   string
+	Percent int
+	Leading bool
+}
+
+type PollSnapshotTmpl struct {
+	Time       string
+	TotalVotes int64
+	Votes      []string // In the order of the options.
+}
+
+type AwardTmpl struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
 }
 
 type CommentTmpl struct {
-	CommentId      string
-	ThreadId       string
-	CommentContent template.HTML
-	Children       []*CommentTmpl
-	Author         string
-	Time           string
-	Continues      bool
-	Score          string
+	CommentId       string
+	ThreadId        string
+	CommentContent  template.HTML
+	Children        []*CommentTmpl
+	Author          string
+	Time            string
+	Continues       bool
+	Continued       bool // The continuation page is merged into the children.
+	Score           string
+	Highlighted     bool
+	MoreReplies     int // Replies left out of the page.
+	AuthorFlair     string
+	Edited          string
+	Distinguished   string
+	Stickied        bool
+	Gilded          int
+	Awards          []AwardTmpl
+	State           string
+	ArchivedContent template.HTML // Earlier content of a deleted or removed comment.
+	ArchivedAuthor  string
+
+	rowId int
+
+	// Keys for sorting comments.
+	score            int64
+	timestamp        int64
+	controversiality int64
+	rank             int64
+}
+
+// Description of the state of a comment that is not live on Reddit.
+func (comment *CommentTmpl) StateLabel() string {
+	switch comment.State {
+	case COMMENT_DELETED:
+		return "deleted by author"
+	case COMMENT_REMOVED:
+		return "removed by moderators"
+	case COMMENT_MISSING:
+		return "no longer on Reddit"
+	}
+	return ""
+}
+
+// Edit time of a post or comment, empty if it was never edited.
+func formatEdited(edited int64) string {
+	if edited == 0 {
+		return ""
+	}
+	return time.Unix(edited, 0).Format("02 Jan 2006 15:04")
+}
+
+func readAwards(awards string) []AwardTmpl {
+	list := []AwardTmpl{}
+	if awards != "" {
+		json.Unmarshal([]byte(awards), &list)
+	}
+	return list
 }
 
 type TemplateError struct {
@@ -142,12 +297,12 @@ func RenderSubsList(page int, w gin.ResponseWriter) int {
 	return 200
 }
 
-func RenderSubThreads(page int, w gin.ResponseWriter, sub string) int {
-	if err, sTmpl := querySubArchives(page, ITEMS_ON_PAGE, sub); err != nil {
+func RenderSubThreads(page int, w gin.ResponseWriter, sub string, removals bool) int {
+	if err, sTmpl := querySubArchives(page, ITEMS_ON_PAGE, sub, removals); err != nil {
 		return 500
 	} else {
 		tp := templates.Lookup("index.tmpl").Lookup("subthreads")
-		tp.Execute(w, &SubThreadsTmpl{page, sTmpl})
+		tp.Execute(w, &SubThreadsTmpl{page, sTmpl, sub, removals, queryFollowStatus(sub)})
 	}
 	return 200
 }
@@ -196,8 +351,26 @@ func RenderAboutPage(w io.Writer) int {
 	return 200
 }
 
-func RenderThreadPage(fileId string, w gin.ResponseWriter) int {
+func RenderCommentPage(threadId string, commentId string, context int, sortOrder string, baseUrl string, w gin.ResponseWriter) int {
+	if context > MAX_COMMENT_CONTEXT {
+		context = MAX_COMMENT_CONTEXT
+	}
+	if arch, err := GetCommentQuery(threadId, commentId, context, sortOrder); err != nil {
+		Log("Error getting archived comment.", err.Error()).Error()
+		return 500
+	} else if arch == nil {
+		return 404
+	} else {
+		arch.BaseUrl = baseUrl
+		t := templates.Lookup("thread.tmpl").Lookup("archive")
+		t.Execute(w, arch)
+		return 200
+	}
+}
 
+// Thread ID and the reply a continuing page starts from in the ID of an
+// archive page, such as abc123-c1.
+func splitFileId(fileId string) (string, string) {
 	fnameParts := strings.Split(fileId, "-")
 	threadId := fnameParts[0]
 	continuingReply := ""
@@ -206,13 +379,25 @@ func RenderThreadPage(fileId string, w gin.ResponseWriter) int {
 	if len(fnameParts) > 1 {
 		continuingReply = fnameParts[1]
 	}
+	return threadId, continuingReply
+}
+
+func RenderThreadPage(fileId string, sortOrder string, page int, baseUrl string, w gin.ResponseWriter) int {
 
-	if arch, err := GetArchiveQuery(threadId, continuingReply); err != nil {
+	threadId, continuingReply := splitFileId(fileId)
+
+	if arch, err := GetArchiveQuery(threadId, continuingReply, sortOrder, page); err != nil {
 		Log("Error getting archive.", err.Error())
 		return 500
 	} else if arch == nil {
 		return 404
 	} else {
+		arch.BaseUrl = baseUrl
+		// The thread page is the memento of the latest snapshot.
+		if continuingReply == "" {
+			w.Header().Set("Memento-Datetime", mementoTime(arch.archived))
+			w.Header().Set("Link", mementoLinks(baseUrl, arch.Subreddit, threadId))
+		}
 		t := templates.Lookup("thread.tmpl").Lookup("archive")
 		t.Execute(w, arch)
 		return 200
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// States of an archived comment.
+const (
+	COMMENT_LIVE    = "live"
+	COMMENT_DELETED = "deleted" // Deleted by its author.
+	COMMENT_REMOVED = "removed" // Removed by moderators or Reddit.
+	COMMENT_MISSING = "missing" // Gone from the thread when it was archived again.
+)
+
+func commentState(data gjson.Result) string {
+	switch data.Get("body").String() {
+	case "[deleted]":
+		return COMMENT_DELETED
+	case "[removed]", "[ Removed by Reddit ]":
+		return COMMENT_REMOVED
+	}
+	return COMMENT_LIVE
+}
+
+// A comment as stored by an earlier archive of the thread.
+type storedComment struct {
+	commentId       string
+	parentId        string // Comment ID of the parent, empty for top level comments.
+	page            string // Comment the page the comment is on continues from.
+	content         string
+	author          string
+	timestamp       int64
+	score           int64
+	state           string
+	archivedContent string
+	archivedAuthor  string
+	raw             string
+}
+
+// Comments currently stored for the thread, parents before their replies.
+// Comments that only mark where a page continues are left out.
+func (dbtx *ThreadDbTx) txStoredComments(threadId string) ([]*storedComment, error) {
+	rows, err := dbtx.tx.Query(`
+		SELECT c.comment_id, IFNULL(p.comment_id, ''), t.continuing_reply, c.content, c.author,
+		c.timestamp, c.score, c.state, c.archived_content, c.archived_author, c.data
+		FROM comments c
+		JOIN threads t ON c.thread_key = t.id
+		LEFT JOIN comments p ON p.id = c.parent_id
+		WHERE t.thread_id = ? AND c.continues = 0
+		ORDER BY c.id`, threadId,
+	)
+	if err != nil {
+		return nil, &DbError{"Error reading stored comments", err.Error()}
+	}
+	defer rows.Close()
+	stored := []*storedComment{}
+	for rows.Next() {
+		c := &storedComment{}
+		rows.Scan(
+			&c.commentId, &c.parentId, &c.page, &c.content, &c.author,
+			&c.timestamp, &c.score, &c.state, &c.archivedContent, &c.archivedAuthor, &c.raw,
+		)
+		stored = append(stored, c)
+	}
+	return stored, nil
+}
+
+// Every comment of the page and of its continuation pages.
+func (page *ThreadPage) allComments() []*CommentData {
+	comments := []*CommentData{}
+	for _, p := range page.pages() {
+		queue := append([]*CommentData{}, p.Comments...)
+		for len(queue) > 0 {
+			c := queue[0]
+			queue = queue[1:]
+			comments = append(comments, c)
+			queue = append(queue, c.Replies...)
+		}
+	}
+	return comments
+}
+
+// Comments whose replies were not all fetched: those listed in stubs of more
+// comments, and those continuing on a page that failed to load. Stored
+// replies of these may still be on Reddit.
+func (page *ThreadPage) unfetchedComments() map[string]bool {
+	unfetched := map[string]bool{}
+	for _, p := range page.pages() {
+		for _, id := range p.More {
+			unfetched[id] = true
+		}
+	}
+	for _, c := range page.allComments() {
+		for _, id := range c.More {
+			unfetched[id] = true
+		}
+		if c.Continues && c.Continuation == nil {
+			unfetched[c.Id] = true
+		}
+	}
+	return unfetched
+}
+
+// ID of the parent comment of a stored comment, or the ID of the thread for
+// top level comments. Comments of continuation pages hang off the comment the
+// page continues from unless the API response names the parent.
+func (c *storedComment) parent(threadId string) string {
+	if parent := gjson.Get(c.raw, "parent_id").String(); strings.HasPrefix(parent, "t1_") {
+		return strings.TrimPrefix(parent, "t1_")
+	} else if parent != "" {
+		return threadId
+	}
+	if c.parentId != "" {
+		return c.parentId
+	}
+	if c.page != "" && c.page != c.commentId {
+		return c.page
+	}
+	return threadId
+}
+
+// Keep the text of comments deleted or removed since they were last archived.
+func keepRemovedText(root *ThreadPage, stored []*storedComment) {
+	if clientOptions.HideRemoved {
+		return
+	}
+	byId := map[string]*storedComment{}
+	for _, c := range stored {
+		byId[c.commentId] = c
+	}
+	for _, c := range root.allComments() {
+		previous, ok := byId[c.Id]
+		if c.State == COMMENT_LIVE || !ok {
+			continue
+		}
+		if previous.state == COMMENT_LIVE {
+			c.ArchivedContent = previous.content
+			c.ArchivedAuthor = previous.author
+		} else {
+			c.ArchivedContent = previous.archivedContent
+			c.ArchivedAuthor = previous.archivedAuthor
+		}
+	}
+}
+
+// Store comments of an earlier archive that are gone from the thread, under
+// the same parent if it is still there. Comments under a stub or a page that
+// was not fetched are kept as they were, as they may still be on Reddit.
+func (dbtx *ThreadDbTx) txPostMissing(root *ThreadPage, stored []*storedComment) error {
+	present := map[string]bool{}
+	for _, c := range root.allComments() {
+		present[c.Id] = true
+	}
+	unfetched := root.unfetchedComments()
+	parents := map[string]string{}
+	for _, c := range stored {
+		parents[c.commentId] = c.parent(root.Post.Id)
+	}
+	notFetched := func(id string) bool {
+		// Bounded by the number of comments in case the parents form a loop.
+		for i := 0; id != "" && i <= len(stored); i++ {
+			if unfetched[id] {
+				return true
+			}
+			id = parents[id]
+		}
+		return false
+	}
+
+	threadKeys := map[string]int64{}
+	rows, err := dbtx.tx.Query(`SELECT id, continuing_reply FROM threads WHERE thread_id = ?`, root.Post.Id)
+	if err != nil {
+		return &DbError{"Error reading thread pages", err.Error()}
+	}
+	for rows.Next() {
+		var key int64
+		page := ""
+		rows.Scan(&key, &page)
+		threadKeys[page] = key
+	}
+	rows.Close()
+
+	// Row IDs of the comments written, to find the parents of missing comments.
+	rowIds := map[string]int64{}
+	rows, err = dbtx.tx.Query(`
+		SELECT c.id, c.comment_id FROM comments c JOIN threads t ON c.thread_key = t.id
+		WHERE t.thread_id = ? AND c.continues = 0`, root.Post.Id,
+	)
+	if err != nil {
+		return &DbError{"Error reading stored comments", err.Error()}
+	}
+	for rows.Next() {
+		var rowId int64
+		commentId := ""
+		rows.Scan(&rowId, &commentId)
+		rowIds[commentId] = rowId
+	}
+	rows.Close()
+
+	for _, c := range stored {
+		keep := notFetched(c.commentId)
+		threadKey, pageWritten := threadKeys[c.page]
+		if present[c.commentId] && (pageWritten || !keep) {
+			continue
+		}
+		if !pageWritten && keep {
+			key, err := dbtx.txKeepPage(root.Post.Id, c.page)
+			if err != nil {
+				return err
+			}
+			threadKeys[c.page], threadKey = key, key
+		} else if !pageWritten {
+			threadKey = threadKeys[""]
+		}
+		parentStr := "NULL"
+		if parentRow, ok := rowIds[c.parentId]; ok && c.parentId != "" {
+			parentStr = fmt.Sprintf("%d", parentRow)
+		}
+
+		state, content, author := c.state, c.content, c.author
+		archivedContent, archivedAuthor := c.archivedContent, c.archivedAuthor
+		if !keep {
+			// Comments removed before they went missing are stored with their earlier text.
+			state, archivedContent, archivedAuthor = COMMENT_MISSING, "", ""
+			if c.state == COMMENT_DELETED || c.state == COMMENT_REMOVED {
+				content, author = c.archivedContent, c.archivedAuthor
+			}
+			if clientOptions.HideRemoved {
+				content = ""
+			}
+		}
+		res, err := dbtx.tx.Exec(`
+			INSERT INTO comments (
+				comment_id, content, author, thread_key, parent_id, timestamp, continues, score, state,
+				archived_content, archived_author, data
+			)
+			VALUES ( ?, ?, ?, ?, ?, ?, 0, ?, ?, ?, ?, ? );
+			`, c.commentId, content, author, threadKey, parentStr, c.timestamp, c.score, state,
+			archivedContent, archivedAuthor, c.raw,
+		)
+		if err != nil {
+			return &DbError{"Error storing missing comment", err.Error()}
+		}
+		rowIds[c.commentId], _ = res.LastInsertId()
+	}
+	return nil
+}
+
+// Store the row of a continuation page that could not be fetched again, from
+// the row of the top level page, to hold the comments kept from it.
+func (dbtx *ThreadDbTx) txKeepPage(threadId string, page string) (int64, error) {
+	res, err := dbtx.tx.Exec(`
+		INSERT INTO threads (
+			thread_id, continuing_reply, replies_num, sub, title, content, content_link, author,
+			timestamp, archive_timestamp, link_flair, author_flair, edited, distinguished, stickied,
+			locked, removed_by_category, upvote_ratio, gilded, awards, crosspost_parent, data
+		)
+		SELECT
+			thread_id, ?, replies_num, sub, title, content, content_link, author,
+			timestamp, archive_timestamp, link_flair, author_flair, edited, distinguished, stickied,
+			locked, removed_by_category, upvote_ratio, gilded, awards, crosspost_parent, data
+		FROM threads WHERE thread_id = ? AND continuing_reply = ""`, page, threadId,
+	)
+	if err != nil {
+		return 0, &DbError{"Error storing kept page", err.Error()}
+	}
+	return res.LastInsertId()
+}
+
+// Replace the stored rows of the thread, keeping comments that were deleted,
+// removed or are gone from it since it was last archived.
+func (dbtx *ThreadDbTx) txReplaceThread(root *ThreadPage) error {
+	stored, err := dbtx.txStoredComments(root.Post.Id)
+	if err != nil {
+		return err
+	}
+	keepRemovedText(root, stored)
+	if err := dbtx.txDeleteThread(root.Post.Id); err != nil {
+		return err
+	}
+	if err := dbtx.txPostThread(root); err != nil {
+		return err
+	}
+	return dbtx.txPostMissing(root, stored)
+}
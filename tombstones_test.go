@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRemovedJson(id string, body string, replies ...testJson) testJson {
+	c := testCommentJson(id, replies...)
+	data := c["data"].(testJson)
+	data["author"] = "[deleted]"
+	data["body"] = body
+	data["body_html"] = "<p>" + body + "</p>"
+	return c
+}
+
+func testCommentStates(t *testing.T, threadId string) map[string]string {
+	rows, err := dbReadOnly.Query(`
+		SELECT c.comment_id, c.state FROM comments c JOIN threads t ON c.thread_key = t.id
+		WHERE t.thread_id = ? AND c.continues = 0`, threadId,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	states := map[string]string{}
+	for rows.Next() {
+		id, state := "", ""
+		rows.Scan(&id, &state)
+		if _, ok := states[id]; ok {
+			t.Errorf("comment %s stored twice", id)
+		}
+		states[id] = state
+	}
+	return states
+}
+
+func TestTombstones(t *testing.T) {
+	useTestDatabase(t)
+
+	archive := func(comments ...testJson) {
+		assert.Nil(t, writeArchive(parseThreadPage(testPageJson("abc123", comments...), "test", ""), true))
+	}
+	archive(
+		testCommentJson("c1", testCommentJson("c2")),
+		testCommentJson("c3", testCommentJson("c5")),
+		testCommentJson("c4"),
+	)
+	archive(
+		testRemovedJson("c1", "[removed]", testCommentJson("c2")),
+		testRemovedJson("c4", "[deleted]"),
+	)
+	assert.Equal(t, map[string]string{
+		"c1": COMMENT_REMOVED,
+		"c2": COMMENT_LIVE,
+		"c3": COMMENT_MISSING,
+		"c4": COMMENT_DELETED,
+		"c5": COMMENT_MISSING,
+	}, testCommentStates(t, "abc123"))
+
+	arch, _ := GetArchiveQuery("abc123", "", "", 0)
+	if assert.NotNil(t, arch) {
+		page := string(arch.ThreadHTML)
+		assert.Contains(t, page, "removed by moderators")
+		assert.Contains(t, page, "Archived before it was removed, posted by u/author_c1:")
+		assert.Contains(t, page, "comment c1<")
+		assert.Contains(t, page, "deleted by author")
+		assert.Contains(t, page, "no longer on Reddit")
+		assert.Contains(t, page, "comment c3<")
+
+		// Missing replies stay under their parent.
+		assert.Less(t, strings.Index(page, `id="c3"`), strings.Index(page, `id="c5"`))
+	}
+
+	// Kept through later archives.
+	archive(testRemovedJson("c1", "[removed]"))
+	states := testCommentStates(t, "abc123")
+	assert.Equal(t, COMMENT_MISSING, states["c2"])
+	assert.Equal(t, COMMENT_MISSING, states["c3"])
+	arch, _ = GetArchiveQuery("abc123", "", "", 0)
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), "comment c1<")
+	}
+
+	err, removals := querySubArchives(0, 10, "test", true)
+	assert.Nil(t, err)
+	assert.Len(t, removals, 1)
+}
+
+// Comments behind stubs of more comments or on pages that failed to load are
+// not marked as missing.
+func TestTombstonesUnfetched(t *testing.T) {
+	useTestDatabase(t)
+
+	more := func(ids ...string) testJson {
+		return testJson{"kind": "more", "data": testJson{"count": len(ids), "children": ids}}
+	}
+	continued := testPageJson("abc123", testCommentJson("c1", testCommentJson("c2", testCommentJson("c3"))))
+	fetchErr := errors.New("request failed")
+	archive := func(fetchFails bool, comments ...testJson) {
+		fetch := func(sub string, threadId string, commentId string) ([]byte, string, error) {
+			if fetchFails {
+				return nil, "", fetchErr
+			}
+			return continued, "", nil
+		}
+		page := fetchArchive("test", testPageJson("abc123", comments...), "", fetch)
+		assert.Nil(t, writeArchive(page, true))
+	}
+	archive(false,
+		testContinuedJson("c1"),
+		testCommentJson("c4", testCommentJson("c6"), testCommentJson("c7", testCommentJson("c9"))),
+		testCommentJson("c5"),
+		testCommentJson("c8"),
+	)
+	archive(true,
+		testContinuedJson("c1"),
+		testCommentJson("c4", testCommentJson("c6"), more("c7")),
+		more("c5"),
+	)
+	assert.Equal(t, map[string]string{
+		"c1": COMMENT_LIVE,
+		"c2": COMMENT_LIVE,
+		"c3": COMMENT_LIVE,
+		"c4": COMMENT_LIVE,
+		"c5": COMMENT_LIVE,
+		"c6": COMMENT_LIVE,
+		"c7": COMMENT_LIVE,
+		"c8": COMMENT_MISSING,
+		"c9": COMMENT_LIVE,
+	}, testCommentStates(t, "abc123"))
+
+	// The page that failed to load is still served with its replies in place.
+	arch, _ := GetArchiveQuery("abc123", "c1", "", 0)
+	if assert.NotNil(t, arch) {
+		page := string(arch.ThreadHTML)
+		assert.Contains(t, page, "comment c2<")
+		assert.Less(t, strings.Index(page, `id="c2"`), strings.Index(page, `id="c3"`))
+		assert.NotContains(t, page, "no longer on Reddit")
+	}
+	arch, _ = GetArchiveQuery("abc123", "", "", 0)
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), "comment c7<")
+		assert.NotContains(t, string(arch.ThreadHTML), "comment c2<")
+	}
+}
+
+func TestTombstonesHidden(t *testing.T) {
+	useTestDatabase(t)
+	clientOptions.HideRemoved = true
+	defer func() { clientOptions.HideRemoved = false }()
+
+	assert.Nil(t, writeArchive(parseThreadPage(testPageJson("abc123", testCommentJson("c1"), testCommentJson("c2")), "test", ""), false))
+	assert.Nil(t, writeArchive(parseThreadPage(testPageJson("abc123", testRemovedJson("c1", "[removed]")), "test", ""), true))
+
+	arch, _ := GetArchiveQuery("abc123", "", "", 0)
+	if assert.NotNil(t, arch) {
+		assert.Contains(t, string(arch.ThreadHTML), "removed by moderators")
+		assert.Contains(t, string(arch.ThreadHTML), "no longer on Reddit")
+		assert.NotContains(t, string(arch.ThreadHTML), "comment c1<")
+		assert.NotContains(t, string(arch.ThreadHTML), "comment c2<")
+	}
+
+	assert.Nil(t, writeArchive(parseThreadPage(testPageJson("def456", testCommentJson("c3")), "test", ""), false))
+	_, all := querySubArchives(0, 10, "test", false)
+	_, removals := querySubArchives(0, 10, "test", true)
+	assert.Len(t, all, 2)
+	assert.Len(t, removals, 1)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//
+// WARC files of archived threads, for web archive tools such as pywb. A file
+// holds the API responses stored with each snapshot of a thread and the
+// archive page rendered from them.
+//
+
+// Status line and headers of an API response, stored with the page of the
+// response to be written to WARC files.
+func responseHeader(res *http.Response) string {
+	header := res.Header.Clone()
+	// The body is stored decoded, and cookies are not archived.
+	for _, h := range []string{"Content-Length", "Content-Encoding", "Transfer-Encoding", "Set-Cookie"} {
+		header.Del(h)
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s %s\r\n", res.Proto, res.Status)
+	header.Write(buf)
+	return buf.String()
+}
+
+func warcRecordId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func warcDigest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func warcDate(timestamp int64) string {
+	return time.Unix(timestamp, 0).UTC().Format("2006-01-02T15:04:05Z")
+}
+
+type warcRecord struct {
+	headers [][2]string // In order, without the length and digest.
+	block   []byte
+	payload []byte // Payload of HTTP records, for the payload digest.
+}
+
+// Write the record as a gzip member of its own, as in .warc.gz files.
+func (r *warcRecord) write(w io.Writer) error {
+	buf := new(bytes.Buffer)
+	buf.WriteString("WARC/1.1\r\n")
+	for _, h := range r.headers {
+		fmt.Fprintf(buf, "%s: %s\r\n", h[0], h[1])
+	}
+	fmt.Fprintf(buf, "WARC-Block-Digest: %s\r\n", warcDigest(r.block))
+	if r.payload != nil {
+		fmt.Fprintf(buf, "WARC-Payload-Digest: %s\r\n", warcDigest(r.payload))
+	}
+	fmt.Fprintf(buf, "Content-Length: %d\r\n\r\n", len(r.block))
+	buf.Write(r.block)
+	buf.WriteString("\r\n\r\n")
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+type warcPage struct {
+	requestUrl string
+	fetchTime  int64
+	response   string
+	data       []byte
+}
+
+// Stored responses of every snapshot of the thread, oldest first. Pages not
+// requested from the API, such as imported ones, are left out.
+func queryWarcPages(threadId string) ([]warcPage, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT p.request_url, p.fetch_timestamp, p.response_headers, p.data
+		FROM raw_pages p JOIN snapshots s ON p.snapshot_id = s.id
+		WHERE s.thread_id = ? AND p.request_url != ""
+		ORDER BY p.id`, threadId,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in raw page query", qErr.Error()})
+	}
+	defer rows.Close()
+	pages := []warcPage{}
+	for rows.Next() {
+		page := warcPage{}
+		compressed := []byte{}
+		rows.Scan(&page.requestUrl, &page.fetchTime, &page.response, &compressed)
+		data, zErr := decompressRaw(compressed)
+		if zErr != nil {
+			return nil, LogE(&DbError{"Error decompressing page", zErr.Error()})
+		}
+		page.data = data
+		pages = append(pages, page)
+	}
+	return pages, nil
+}
+
+// Request and response records of a stored API response. Responses stored
+// before their headers were kept get a minimal header.
+func warcExchange(page warcPage) []*warcRecord {
+	target, err := url.Parse(page.requestUrl)
+	if err != nil {
+		return nil
+	}
+	date := warcDate(page.fetchTime)
+	requestId, responseId := warcRecordId(), warcRecordId()
+
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\n\r\n", target.RequestURI(), target.Host, userAgent)
+	header := page.response
+	if header == "" {
+		header = "HTTP/1.1 200 OK\r\nContent-Type: application/json; charset=UTF-8\r\n"
+	}
+	response := []byte(fmt.Sprintf("%sContent-Length: %d\r\n\r\n", header, len(page.data)))
+	response = append(response, page.data...)
+
+	return []*warcRecord{
+		{
+			headers: [][2]string{
+				{"WARC-Type", "response"},
+				{"WARC-Record-ID", responseId},
+				{"WARC-Date", date},
+				{"WARC-Target-URI", page.requestUrl},
+				{"Content-Type", "application/http;msgtype=response"},
+			},
+			block:   response,
+			payload: page.data,
+		},
+		{
+			headers: [][2]string{
+				{"WARC-Type", "request"},
+				{"WARC-Record-ID", requestId},
+				{"WARC-Date", date},
+				{"WARC-Target-URI", page.requestUrl},
+				{"WARC-Concurrent-To", responseId},
+				{"Content-Type", "application/http;msgtype=request"},
+			},
+			block: []byte(request),
+		},
+	}
+}
+
+// Write a WARC file of the threads. Archive pages are recorded under baseUrl,
+// the address the server is reached at.
+func writeWarc(w io.Writer, threadIds []string, baseUrl string) error {
+	filename := "bettit.warc.gz"
+	if len(threadIds) == 1 {
+		filename = threadIds[0] + ".warc.gz"
+	}
+	info := fmt.Sprintf(
+		"software: Bettit %s\r\nformat: WARC File Format 1.1\r\nconformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n",
+		APPVER,
+	)
+	now := time.Now().Unix()
+	infoRecord := &warcRecord{
+		headers: [][2]string{
+			{"WARC-Type", "warcinfo"},
+			{"WARC-Record-ID", warcRecordId()},
+			{"WARC-Date", warcDate(now)},
+			{"WARC-Filename", filename},
+			{"Content-Type", "application/warc-fields"},
+		},
+		block: []byte(info),
+	}
+	if err := infoRecord.write(w); err != nil {
+		return err
+	}
+
+	for _, threadId := range threadIds {
+		pages, err := queryWarcPages(threadId)
+		if err != nil {
+			return err
+		}
+		for _, page := range pages {
+			for _, record := range warcExchange(page) {
+				if err := record.write(w); err != nil {
+					return err
+				}
+			}
+		}
+
+		arch, err := GetArchiveQuery(threadId, "", "", 0)
+		if err != nil {
+			return err
+		} else if arch == nil {
+			continue
+		}
+		arch.BaseUrl = strings.TrimRight(baseUrl, "/")
+		page := new(bytes.Buffer)
+		if err := templates.Lookup("thread.tmpl").Lookup("archive").Execute(page, arch); err != nil {
+			return err
+		}
+		var archiveTime int64
+		dbReadOnly.QueryRow(`
+			SELECT archive_timestamp FROM threads WHERE thread_id = ? AND continuing_reply = ""
+			`, threadId,
+		).Scan(&archiveTime)
+		resource := &warcRecord{
+			headers: [][2]string{
+				{"WARC-Type", "resource"},
+				{"WARC-Record-ID", warcRecordId()},
+				{"WARC-Date", warcDate(archiveTime)},
+				{"WARC-Target-URI", strings.TrimRight(baseUrl, "/") + "/" + threadId},
+				{"Content-Type", "text/html; charset=utf-8"},
+			},
+			block: page.Bytes(),
+		}
+		if err := resource.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
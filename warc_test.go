@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type testWarcRecord struct {
+	header textproto.MIMEHeader
+	block  []byte
+}
+
+// Parse a WARC file back into its records.
+func readTestWarc(t *testing.T, data []byte) []testWarcRecord {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	r := bufio.NewReader(zr)
+	records := []testWarcRecord{}
+	for {
+		version, err := r.ReadString('\n')
+		if err == io.EOF {
+			return records
+		}
+		assert.Equal(t, "WARC/1.1\r\n", version)
+		header, err := textproto.NewReader(r).ReadMIMEHeader()
+		if !assert.Nil(t, err) {
+			return nil
+		}
+		length, _ := strconv.Atoi(header.Get("Content-Length"))
+		block := make([]byte, length)
+		_, err = io.ReadFull(r, block)
+		assert.Nil(t, err)
+		end := make([]byte, 4)
+		io.ReadFull(r, end)
+		assert.Equal(t, "\r\n\r\n", string(end))
+		records = append(records, testWarcRecord{header, block})
+	}
+}
+
+func TestWarc(t *testing.T) {
+	useTestDatabase(t)
+	LoadTemplates()
+
+	// Headers are captured from the response to the request of the page.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("X-Ratelimit-Remaining", "99")
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL+"/r/test/comments/abc123", nil)
+	_, header, tErr := getThread(req)
+	assert.Nil(t, tErr)
+
+	root := parseThreadPage(testPageJson("abc123", testCommentJson("c1")), "test", "")
+	root.RequestUrl = server.URL + "/r/test/comments/abc123"
+	root.FetchTime = 1650000000
+	root.Response = header
+	assert.Nil(t, writeArchive(root, false))
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, writeWarc(buf, []string{"abc123"}, "http://localhost:8080/"))
+	records := readTestWarc(t, buf.Bytes())
+	if !assert.Len(t, records, 4) {
+		return
+	}
+	types := []string{}
+	for _, rec := range records {
+		types = append(types, rec.header.Get("WARC-Type"))
+		assert.Equal(t, warcDigest(rec.block), rec.header.Get("WARC-Block-Digest"))
+		assert.True(t, strings.HasPrefix(rec.header.Get("WARC-Record-ID"), "<urn:uuid:"))
+	}
+	assert.Equal(t, []string{"warcinfo", "response", "request", "resource"}, types)
+	assert.Contains(t, string(records[0].block), "software: Bettit "+APPVER+"\r\n")
+
+	response := records[1]
+	assert.Equal(t, "2022-04-15T05:20:00Z", response.header.Get("WARC-Date"))
+	assert.Equal(t, root.RequestUrl, response.header.Get("WARC-Target-URI"))
+	httpRes, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response.block)), nil)
+	if assert.Nil(t, err) {
+		body, _ := io.ReadAll(httpRes.Body)
+		assert.Equal(t, root.Raw, body)
+		assert.Equal(t, warcDigest(body), response.header.Get("WARC-Payload-Digest"))
+		assert.Equal(t, "99", httpRes.Header.Get("X-Ratelimit-Remaining"))
+		assert.Equal(t, "", httpRes.Header.Get("Set-Cookie"))
+	}
+
+	request := records[2]
+	assert.Equal(t, response.header.Get("WARC-Record-ID"), request.header.Get("WARC-Concurrent-To"))
+	httpReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(request.block)))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "/r/test/comments/abc123", httpReq.URL.Path)
+		assert.Equal(t, "", httpReq.Header.Get("Authorization"))
+	}
+
+	assert.Equal(t, "http://localhost:8080/abc123", records[3].header.Get("WARC-Target-URI"))
+	assert.Contains(t, string(records[3].block), "comment c1")
+	// Links in the recorded page are under the address it is recorded at.
+	assert.Contains(t, string(records[3].block), `<link rel="canonical" href="http://localhost:8080/abc123">`)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/:threadid", routeGetPage)
+	w := httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/abc123.warc.gz", nil)
+	req.Host = "bettit.example"
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, `attachment; filename="abc123.warc.gz"`, w.Header().Get("Content-Disposition"))
+	records = readTestWarc(t, w.Body.Bytes())
+	if assert.Len(t, records, 4) {
+		assert.Equal(t, "http://bettit.example/abc123", records[3].header.Get("WARC-Target-URI"))
+		assert.Contains(t, string(records[3].block), `<meta property="og:url" content="http://bettit.example/abc123">`)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/def456.warc.gz", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+// The command renders archive pages without templates loaded beforehand.
+func TestExportWarcCommand(t *testing.T) {
+	useTestDatabase(t)
+	assert.Nil(t, writeArchive(parseThreadPage(testPageJson("abc123", testCommentJson("c1")), "test", ""), false))
+	loaded := templates
+	templates = nil
+	defer func() { templates = loaded }()
+
+	output := filepath.Join(t.TempDir(), "out.warc.gz")
+	assert.Equal(t, 0, cmdExportWarc([]string{"export-warc", "--output", output, "--base-url", "https://bettit.example", "abc123"}))
+	data, err := os.ReadFile(output)
+	assert.Nil(t, err)
+	records := readTestWarc(t, data)
+	// No request was made for the thread, so only the page is recorded.
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "https://bettit.example/abc123", records[1].header.Get("WARC-Target-URI"))
+		assert.Contains(t, string(records[1].block), "comment c1")
+	}
+	assert.Equal(t, 1, cmdExportWarc([]string{"export-warc", "--output", output, "def456"}))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Shortest interval threads on the watchlist are archived at, to save the API budget.
+const MIN_WATCH_INTERVAL = 5 * time.Minute
+
+// How often the watchlist is checked for threads due to be archived.
+const WATCH_TICK = time.Minute
+
+// Source of the current time, replaced in tests.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// A thread archived again at an interval until the entry expires.
+type WatchEntry struct {
+	ThreadId   string `json:"thread_id"`
+	Sub        string `json:"sub"`
+	Interval   int64  `json:"interval"` // Seconds.
+	Expires    int64  `json:"expires"`
+	NextRun    int64  `json:"next_run"`
+	LastRun    int64  `json:"last_run"`
+	LastStatus string `json:"last_status"`
+	Snapshots  int64  `json:"snapshots"` // Snapshots created by the watchlist.
+}
+
+// Statuses of the last run of a watchlist entry.
+const (
+	WATCH_ARCHIVED  = "archived"
+	WATCH_UNCHANGED = "unchanged"
+	WATCH_FAILED    = "failed"
+)
+
+// Add a thread to the watchlist, or update its interval and expiry if it is
+// already on it. The thread is archived on the next check.
+func addWatch(threadId string, sub string, interval time.Duration, duration time.Duration, now time.Time) error {
+	if interval < MIN_WATCH_INTERVAL {
+		return &DbError{"Invalid watch interval", fmt.Sprintf("Interval must be at least %s", MIN_WATCH_INTERVAL)}
+	}
+	if duration <= 0 {
+		return &DbError{"Invalid watch duration", "Duration must be positive"}
+	}
+	if _, err := execTransaction(`
+		INSERT INTO watchlist (thread_id, sub, interval, expires, next_run)
+		VALUES ( ?, ?, ?, ?, ? )
+		ON CONFLICT(thread_id) DO UPDATE SET
+			interval = excluded.interval, expires = excluded.expires, next_run = excluded.next_run
+		`, threadId, sub, int64(interval.Seconds()), now.Add(duration).Unix(), now.Unix(),
+	); err != nil {
+		return LogE(&DbError{"Error adding to watchlist", err.Error()})
+	}
+	return nil
+}
+
+// Remove a thread from the watchlist, returns false if it was not on it.
+func removeWatch(threadId string) (bool, error) {
+	res, err := execTransaction(`DELETE FROM watchlist WHERE thread_id = ?`, threadId)
+	if err != nil {
+		return false, LogE(&DbError{"Error removing from watchlist", err.Error()})
+	}
+	removed, _ := res.RowsAffected()
+	return removed > 0, nil
+}
+
+func queryWatchlist() ([]WatchEntry, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT thread_id, sub, interval, expires, next_run, last_run, last_status, snapshots
+		FROM watchlist
+		ORDER BY next_run`,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in watchlist query", qErr.Error()})
+	}
+	defer rows.Close()
+	entries := []WatchEntry{}
+	for rows.Next() {
+		e := WatchEntry{}
+		rows.Scan(&e.ThreadId, &e.Sub, &e.Interval, &e.Expires, &e.NextRun, &e.LastRun, &e.LastStatus, &e.Snapshots)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Whether the post differs from its latest archive, or is not archived at all.
+func threadChanged(post *PostData) bool {
+	repliesNum := int64(-1)
+	title, content := "", ""
+	dbReadOnly.QueryRow(`
+		SELECT replies_num, title, content FROM threads
+		WHERE thread_id = ? AND continuing_reply = ""
+		`, post.Id,
+	).Scan(&repliesNum, &title, &content)
+	return repliesNum != post.RepliesNum || title != post.Title || content != post.Content
+}
+
+type watcher struct {
+	clock clock
+	fetch pageFetcher
+}
+
+// Archive the thread of the entry again if it has changed.
+func (w *watcher) refresh(entry WatchEntry) (string, error) {
+	data, header, err := w.fetch(entry.Sub, entry.ThreadId, "")
+	if err != nil {
+		emitEvent(fetchFailedEvent(entry.Sub, entry.ThreadId, err))
+		return WATCH_FAILED, err
+	}
+	post := parseThreadPage(data, entry.Sub, "").Post
+	if post.Id == "" {
+		return WATCH_FAILED, &DbError{"Invalid response", entry.ThreadId}
+	}
+	if !threadChanged(&post) {
+		return WATCH_UNCHANGED, nil
+	}
+	if err := writeArchive(fetchArchive(entry.Sub, data, header, w.fetch), true); err != nil {
+		return WATCH_FAILED, err
+	}
+	return WATCH_ARCHIVED, nil
+}
+
+// Drop expired entries and archive the threads that are due. Returns the
+// number of threads checked.
+func (w *watcher) runDue() int {
+	now := w.clock.Now().Unix()
+	if res, err := execTransaction(`DELETE FROM watchlist WHERE expires <= ?`, now); err != nil {
+		Log("Error removing expired watchlist entries", err.Error()).Error()
+	} else if expired, _ := res.RowsAffected(); expired > 0 {
+		Log("Removed expired watchlist entries.", fmt.Sprintf("%d entries", expired)).Info()
+	}
+
+	entries, err := queryWatchlist()
+	if err != nil {
+		return 0
+	}
+	checked := 0
+	for _, entry := range entries {
+		if entry.NextRun > now {
+			continue
+		}
+		status, err := w.refresh(entry)
+		if err != nil {
+			Log("Error archiving watched thread", fmt.Sprintf("ID %s: %s", entry.ThreadId, err.Error())).Error()
+		}
+		created := 0
+		if status == WATCH_ARCHIVED {
+			created = 1
+		}
+		if _, err := execTransaction(`
+			UPDATE watchlist SET next_run = ?, last_run = ?, last_status = ?, snapshots = snapshots + ?
+			WHERE thread_id = ?
+			`, now+entry.Interval, now, status, created, entry.ThreadId,
+		); err != nil {
+			Log("Error updating watchlist", err.Error()).Error()
+		}
+		checked++
+	}
+	return checked
+}
+
+func (w *watcher) run(tick time.Duration) {
+	for {
+		w.runDue()
+		time.Sleep(tick)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func testWatchEntry(t *testing.T, threadId string) *WatchEntry {
+	entries, err := queryWatchlist()
+	assert.Nil(t, err)
+	for _, e := range entries {
+		if e.ThreadId == threadId {
+			return &e
+		}
+	}
+	return nil
+}
+
+func TestWatchlist(t *testing.T) {
+	useTestDatabase(t)
+	clock := &fakeClock{time.Unix(1650000000, 0)}
+
+	comments := []testJson{testCommentJson("c1")}
+	fetched := 0
+	w := &watcher{clock, func(sub, threadId, commentId string) ([]byte, string, error) {
+		fetched++
+		return testPageJson(threadId, comments...), "", nil
+	}}
+
+	assert.NotNil(t, addWatch("abc123", "test", time.Minute, time.Hour, clock.Now()))
+	assert.Nil(t, addWatch("abc123", "test", 30*time.Minute, 2*time.Hour, clock.Now()))
+
+	// Archived on the first check, then only once the interval has passed.
+	assert.Equal(t, 1, w.runDue())
+	assert.Equal(t, WATCH_ARCHIVED, testWatchEntry(t, "abc123").LastStatus)
+	clock.advance(10 * time.Minute)
+	assert.Equal(t, 0, w.runDue())
+	assert.Equal(t, 1, fetched)
+
+	// No snapshot while the thread is unchanged.
+	clock.advance(20 * time.Minute)
+	assert.Equal(t, 1, w.runDue())
+	entry := testWatchEntry(t, "abc123")
+	assert.Equal(t, WATCH_UNCHANGED, entry.LastStatus)
+	assert.Equal(t, int64(1), entry.Snapshots)
+
+	comments = append(comments, testCommentJson("c2"))
+	clock.advance(30 * time.Minute)
+	assert.Equal(t, 1, w.runDue())
+	entry = testWatchEntry(t, "abc123")
+	assert.Equal(t, WATCH_ARCHIVED, entry.LastStatus)
+	assert.Equal(t, int64(2), entry.Snapshots)
+	assert.Equal(t, clock.Now().Add(30*time.Minute).Unix(), entry.NextRun)
+	snapshots := 0
+	dbReadOnly.QueryRow(`SELECT COUNT(*) FROM snapshots WHERE thread_id = ?`, "abc123").Scan(&snapshots)
+	assert.Equal(t, 2, snapshots)
+
+	// Removed once expired.
+	clock.advance(time.Hour)
+	assert.Equal(t, 0, w.runDue())
+	assert.Nil(t, testWatchEntry(t, "abc123"))
+}
+
+func TestAdminWatchlist(t *testing.T) {
+	useTestDatabase(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	adminRoutes(r, "secret")
+
+	request := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, 401, request("GET", "/api/admin/watchlist", "", "").Code)
+	assert.Equal(t, 401, request("GET", "/api/admin/watchlist", "wrong", "").Code)
+
+	assert.Equal(t, 400, request("POST", "/api/admin/watchlist", "secret", `{"thread": "abc123", "interval": "1m"}`).Code)
+	assert.Equal(t, 201, request("POST", "/api/admin/watchlist", "secret",
+		`{"thread": "https://www.reddit.com/r/test/comments/abc123/title/", "interval": "30m", "duration": "48h"}`,
+	).Code)
+
+	res := request("GET", "/api/admin/watchlist", "secret", "")
+	assert.Equal(t, 200, res.Code)
+	assert.Contains(t, res.Body.String(), `"thread_id":"abc123","sub":"test","interval":1800`)
+
+	assert.Equal(t, 204, request("DELETE", "/api/admin/watchlist/abc123", "secret", "").Code)
+	assert.Equal(t, 404, request("DELETE", "/api/admin/watchlist/abc123", "secret", "").Code)
+	assert.Equal(t, "[]", request("GET", "/api/admin/watchlist", "secret", "").Body.String())
+}
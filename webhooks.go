@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ilmari-h/bettit/media"
+)
+
+//
+// Webhooks notified of archive events. Events are queued in the database and
+// delivered by a sender that retries failed deliveries with a growing delay,
+// until they are given up on and left for admins to inspect or retry.
+//
+
+// Events webhooks can subscribe to.
+const (
+	EVENT_ARCHIVED = "thread.archived"
+	EVENT_UPDATED  = "snapshot.updated"
+	EVENT_FAILED   = "archive.failed"
+	EVENT_TAKEDOWN = "thread.takedown"
+)
+
+var webhookEvents = []string{EVENT_ARCHIVED, EVENT_UPDATED, EVENT_FAILED, EVENT_TAKEDOWN}
+
+// Deliveries failing this many times are marked dead.
+const WEBHOOK_MAX_ATTEMPTS = 8
+
+// Delay before retrying a failed delivery, doubled after every attempt.
+const WEBHOOK_BACKOFF = 30 * time.Second
+const WEBHOOK_MAX_BACKOFF = 6 * time.Hour
+
+// How often the queue is checked for deliveries that are due.
+const WEBHOOK_TICK = 10 * time.Second
+
+const WEBHOOK_TIMEOUT = 10 * time.Second
+
+// Header with the HMAC-SHA256 of the payload, keyed with the webhook secret.
+const WEBHOOK_SIGNATURE_HEADER = "X-Bettit-Signature"
+
+type Webhook struct {
+	Id      int64    `json:"id"`
+	Url     string   `json:"url"`
+	Events  []string `json:"events"` // "*" subscribes to every event.
+	Created int64    `json:"created"`
+	secret  string
+}
+
+// Payload of a delivery.
+type WebhookEvent struct {
+	Event    string `json:"event"`
+	Time     int64  `json:"time"`
+	ThreadId string `json:"thread_id"`
+	Sub      string `json:"sub,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Url      string `json:"url,omitempty"` // Archive page, if the base URL of the server is set.
+	Error    string `json:"error,omitempty"`
+}
+
+type WebhookDelivery struct {
+	Id          int64           `json:"id"`
+	WebhookId   int64           `json:"webhook_id"`
+	Event       string          `json:"event"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int64           `json:"attempts"`
+	NextAttempt int64           `json:"next_attempt"`
+	LastError   string          `json:"last_error"`
+	Created     int64           `json:"created"`
+}
+
+func (w *Webhook) subscribed(event string) bool {
+	for _, e := range w.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func webhookSignature(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newWebhookSecret() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Add a webhook, returns its ID. A secret is generated if none is given.
+func addWebhook(hookUrl string, events []string, secret string, now time.Time) (int64, string, error) {
+	if u, err := url.Parse(hookUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, "", &DbError{"Invalid webhook URL", hookUrl}
+	}
+	if len(events) == 0 {
+		events = []string{"*"}
+	}
+	for _, e := range events {
+		known := e == "*"
+		for _, k := range webhookEvents {
+			known = known || e == k
+		}
+		if !known {
+			return 0, "", &DbError{"Invalid webhook event", e}
+		}
+	}
+	if secret == "" {
+		secret = newWebhookSecret()
+	}
+	res, err := execTransaction(`
+		INSERT INTO webhooks (url, secret, events, created) VALUES ( ?, ?, ?, ? )
+		`, hookUrl, secret, strings.Join(events, ","), now.Unix(),
+	)
+	if err != nil {
+		return 0, "", LogE(&DbError{"Error adding webhook", err.Error()})
+	}
+	id, _ := res.LastInsertId()
+	return id, secret, nil
+}
+
+// Remove a webhook and its queued deliveries, returns false if it did not exist.
+func removeWebhook(id int64) (bool, error) {
+	tx, err := NewTransaction(false)
+	if err != nil {
+		return false, LogE(&DbError{"Error starting transaction", err.Error()})
+	}
+	if _, err := tx.tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		tx.rollback()
+		return false, LogE(&DbError{"Error removing webhook deliveries", err.Error()})
+	}
+	res, err := tx.tx.Exec(`DELETE FROM webhooks WHERE id = ?`, id)
+	if err != nil {
+		tx.rollback()
+		return false, LogE(&DbError{"Error removing webhook", err.Error()})
+	}
+	tx.done()
+	removed, _ := res.RowsAffected()
+	return removed > 0, nil
+}
+
+func queryWebhooks() ([]Webhook, error) {
+	rows, qErr := dbReadOnly.Query(`SELECT id, url, secret, events, created FROM webhooks ORDER BY id`)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in webhook query", qErr.Error()})
+	}
+	defer rows.Close()
+	hooks := []Webhook{}
+	for rows.Next() {
+		h := Webhook{}
+		events := ""
+		rows.Scan(&h.Id, &h.Url, &h.secret, &events, &h.Created)
+		h.Events = strings.Split(events, ",")
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// Queue a delivery of the event to every webhook subscribed to it.
+func emitEvent(event WebhookEvent) {
+	hooks, err := queryWebhooks()
+	if err != nil || len(hooks) == 0 {
+		return
+	}
+	if event.Url == "" && routerOptions.BaseUrl != "" {
+		event.Url = strings.TrimRight(routerOptions.BaseUrl, "/") + "/" + event.ThreadId
+	}
+	payload, _ := json.Marshal(event)
+
+	tx, txErr := NewTransaction(false)
+	if txErr != nil {
+		Log("Error starting transaction", txErr.Error()).Error()
+		return
+	}
+	for _, h := range hooks {
+		if !h.subscribed(event.Event) {
+			continue
+		}
+		if _, err := tx.tx.Exec(`
+			INSERT INTO webhook_deliveries (webhook_id, event, payload, next_attempt, created)
+			VALUES ( ?, ?, ?, ?, ? )
+			`, h.Id, event.Event, string(payload), event.Time, event.Time,
+		); err != nil {
+			tx.rollback()
+			Log("Error queueing webhook delivery", err.Error()).Error()
+			return
+		}
+	}
+	tx.done()
+}
+
+// Event about an archived thread page.
+func pageEvent(name string, page *ThreadPage, err error) WebhookEvent {
+	event := WebhookEvent{
+		Event:    name,
+		Time:     time.Now().Unix(),
+		ThreadId: page.Post.Id,
+		Sub:      page.Sub,
+		Title:    page.Post.Title,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// Event about a thread that could not be requested from the API.
+func fetchFailedEvent(sub string, threadId string, err error) WebhookEvent {
+	return WebhookEvent{
+		Event:    EVENT_FAILED,
+		Time:     time.Now().Unix(),
+		ThreadId: threadId,
+		Sub:      sub,
+		Error:    err.Error(),
+	}
+}
+
+// Deliveries that have been given up on.
+func queryDeadDeliveries() ([]WebhookDelivery, error) {
+	rows, qErr := dbReadOnly.Query(`
+		SELECT id, webhook_id, event, payload, attempts, next_attempt, last_error, created
+		FROM webhook_deliveries
+		WHERE dead
+		ORDER BY id`,
+	)
+	if qErr != nil {
+		return nil, LogE(&DbError{"Error in webhook delivery query", qErr.Error()})
+	}
+	defer rows.Close()
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d := WebhookDelivery{}
+		payload := ""
+		rows.Scan(&d.Id, &d.WebhookId, &d.Event, &payload, &d.Attempts, &d.NextAttempt, &d.LastError, &d.Created)
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// Queue a dead delivery again, returns false if there is no such dead delivery.
+func retryDelivery(id int64, now time.Time) (bool, error) {
+	res, err := execTransaction(`
+		UPDATE webhook_deliveries SET dead = 0, attempts = 0, next_attempt = ?
+		WHERE id = ? AND dead
+		`, now.Unix(), id,
+	)
+	if err != nil {
+		return false, LogE(&DbError{"Error retrying webhook delivery", err.Error()})
+	}
+	retried, _ := res.RowsAffected()
+	return retried > 0, nil
+}
+
+// Delay before the next attempt after the given number of failed attempts.
+func webhookBackoff(attempts int64) time.Duration {
+	backoff := WEBHOOK_BACKOFF
+	for i := int64(1); i < attempts && backoff < WEBHOOK_MAX_BACKOFF; i++ {
+		backoff *= 2
+	}
+	if backoff > WEBHOOK_MAX_BACKOFF {
+		return WEBHOOK_MAX_BACKOFF
+	}
+	return backoff
+}
+
+type webhookSender struct {
+	clock  clock
+	client *http.Client
+}
+
+func newWebhookSender(clock clock) *webhookSender {
+	return &webhookSender{clock, &http.Client{Timeout: WEBHOOK_TIMEOUT}}
+}
+
+func (s *webhookSender) deliver(hook Webhook, id int64, event string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, hook.Url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Bettit-Event", event)
+	req.Header.Set("X-Bettit-Delivery", fmt.Sprint(id))
+	req.Header.Set(WEBHOOK_SIGNATURE_HEADER, webhookSignature(hook.secret, payload))
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("response status %s", res.Status)
+	}
+	return nil
+}
+
+type pendingDelivery struct {
+	id       int64
+	hookId   int64
+	event    string
+	payload  string
+	attempts int64
+}
+
+// Send the deliveries that are due. Delivered ones are removed from the
+// queue and failed ones scheduled again. Returns the number delivered.
+func (s *webhookSender) runDue() int {
+	now := s.clock.Now()
+	hooks, err := queryWebhooks()
+	if err != nil {
+		return 0
+	}
+	byId := map[int64]Webhook{}
+	for _, h := range hooks {
+		byId[h.Id] = h
+	}
+
+	rows, qErr := dbReadOnly.Query(`
+		SELECT id, webhook_id, event, payload, attempts FROM webhook_deliveries
+		WHERE NOT dead AND next_attempt <= ?
+		ORDER BY id`, now.Unix(),
+	)
+	if qErr != nil {
+		Log("Error in webhook delivery query", qErr.Error()).Error()
+		return 0
+	}
+	due := []pendingDelivery{}
+	for rows.Next() {
+		d := pendingDelivery{}
+		rows.Scan(&d.id, &d.hookId, &d.event, &d.payload, &d.attempts)
+		due = append(due, d)
+	}
+	rows.Close()
+
+	delivered := 0
+	for _, d := range due {
+		hook, ok := byId[d.hookId]
+		if !ok {
+			continue
+		}
+		if err := s.deliver(hook, d.id, d.event, []byte(d.payload)); err == nil {
+			if _, err := execTransaction(`DELETE FROM webhook_deliveries WHERE id = ?`, d.id); err != nil {
+				Log("Error removing webhook delivery", err.Error()).Error()
+			}
+			delivered++
+		} else {
+			attempts := d.attempts + 1
+			dead := attempts >= WEBHOOK_MAX_ATTEMPTS
+			if dead {
+				Log("Giving up on webhook delivery", fmt.Sprintf("ID %d to %s: %s", d.id, hook.Url, err.Error())).Error()
+			}
+			if _, uErr := execTransaction(`
+				UPDATE webhook_deliveries SET attempts = ?, next_attempt = ?, last_error = ?, dead = ?
+				WHERE id = ?
+				`, attempts, now.Add(webhookBackoff(attempts)).Unix(), err.Error(), dead, d.id,
+			); uErr != nil {
+				Log("Error updating webhook delivery", uErr.Error()).Error()
+			}
+		}
+	}
+	return delivered
+}
+
+func (s *webhookSender) run(tick time.Duration) {
+	for {
+		s.runDue()
+		time.Sleep(tick)
+	}
+}
+
+// Remove the thread and everything stored of it, and notify webhooks of the
+// takedown. Returns false if the thread was not archived.
+func takedownThread(threadId string) (bool, error) {
+	event := WebhookEvent{Event: EVENT_TAKEDOWN, Time: time.Now().Unix(), ThreadId: threadId}
+	found := dbReadOnly.QueryRow(`
+		SELECT sub, title FROM threads WHERE thread_id = ? AND continuing_reply = ""
+		`, threadId,
+	).Scan(&event.Sub, &event.Title) == nil
+	if !found {
+		return false, nil
+	}
+
+	tx, err := NewTransaction(false)
+	if err != nil {
+		return false, LogE(&DbError{"Error starting transaction", err.Error()})
+	}
+	if err := tx.txDeleteThread(threadId); err != nil {
+		tx.rollback()
+		return false, LogE(&DbError{"Error taking down thread", err.Error()})
+	}
+	hashes, err := tx.txThreadMediaHashes(threadId)
+	if err != nil {
+		tx.rollback()
+		return false, LogE(&DbError{"Error taking down thread", err.Error()})
+	}
+	for _, query := range []string{
+		`DELETE FROM raw_pages WHERE snapshot_id IN (SELECT id FROM snapshots WHERE thread_id = ?)`,
+		`DELETE FROM snapshots WHERE thread_id = ?`,
+		// Media no other thread refers to.
+		`DELETE FROM media WHERE url IN (SELECT url FROM thread_media WHERE thread_id = ?1)
+			AND url NOT IN (SELECT url FROM thread_media WHERE thread_id != ?1)`,
+		`DELETE FROM thread_media WHERE thread_id = ?`,
+		`DELETE FROM thread_links WHERE thread_id = ?`,
+		`DELETE FROM polls WHERE thread_id = ?`,
+		`DELETE FROM poll_options WHERE thread_id = ?`,
+		`DELETE FROM watchlist WHERE thread_id = ?`,
+	} {
+		if _, err := tx.tx.Exec(query, threadId); err != nil {
+			tx.rollback()
+			return false, LogE(&DbError{"Error taking down thread", err.Error()})
+		}
+	}
+	tx.done()
+
+	// Files are shared by URLs with the same content, so only those of hashes
+	// no longer in the table are removed.
+	if mediaStore != nil {
+		for _, hash := range hashes {
+			shared := 0
+			dbReadOnly.QueryRow(`SELECT COUNT(*) FROM media WHERE hash = ?`, hash).Scan(&shared)
+			if shared == 0 && media.ValidHash(hash) && mediaStore.Has(hash) {
+				if err := os.Remove(mediaStore.Path(hash)); err != nil {
+					Log("Error removing media file", err.Error()).Error()
+				}
+			}
+		}
+	}
+	purgePageCache()
+	Log("Took down thread.", fmt.Sprintf("ID %s", threadId)).Info()
+	emitEvent(event)
+	return true, nil
+}
+
+// Hashes of the media archived with the thread.
+func (dbtx *ThreadDbTx) txThreadMediaHashes(threadId string) ([]string, error) {
+	rows, err := dbtx.tx.Query(`
+		SELECT DISTINCT m.hash FROM media m JOIN thread_media tm ON tm.url = m.url
+		WHERE tm.thread_id = ?`, threadId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := []string{}
+	for rows.Next() {
+		hash := ""
+		rows.Scan(&hash)
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
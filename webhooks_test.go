@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type testDelivery struct {
+	event     string
+	signature string
+	payload   WebhookEvent
+	body      []byte
+}
+
+// Receiver of webhook deliveries, failing them with the status set by failWith.
+type testReceiver struct {
+	*httptest.Server
+	mu         sync.Mutex
+	deliveries []testDelivery
+	fail       int
+}
+
+func newTestReceiver(t *testing.T) *testReceiver {
+	recv := &testReceiver{}
+	recv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		recv.mu.Lock()
+		defer recv.mu.Unlock()
+		if recv.fail != 0 {
+			w.WriteHeader(recv.fail)
+			return
+		}
+		d := testDelivery{event: r.Header.Get("X-Bettit-Event"), signature: r.Header.Get(WEBHOOK_SIGNATURE_HEADER), body: body}
+		json.Unmarshal(body, &d.payload)
+		recv.deliveries = append(recv.deliveries, d)
+	}))
+	t.Cleanup(recv.Close)
+	return recv
+}
+
+func (recv *testReceiver) failWith(status int) {
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	recv.fail = status
+}
+
+func (recv *testReceiver) take() []testDelivery {
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	d := recv.deliveries
+	recv.deliveries = nil
+	return d
+}
+
+func TestWebhooks(t *testing.T) {
+	useTestDatabase(t)
+	recv := newTestReceiver(t)
+	// Events are queued at the time they happen.
+	clock := &fakeClock{time.Now()}
+	sender := newWebhookSender(clock)
+
+	_, _, err := addWebhook("ftp://example.com", nil, "", clock.Now())
+	assert.NotNil(t, err)
+	_, _, err = addWebhook(recv.URL, []string{"thread.unknown"}, "", clock.Now())
+	assert.NotNil(t, err)
+	_, _, err = addWebhook(recv.URL, []string{EVENT_ARCHIVED, EVENT_UPDATED, EVENT_TAKEDOWN}, "key", clock.Now())
+	assert.Nil(t, err)
+
+	// Archiving and archiving again are delivered signed with the secret.
+	assert.Nil(t, writeArchive(parseThreadPage(testPageJson("abc123"), "test", ""), false))
+	assert.Nil(t, writeArchive(parseThreadPage(testPageJson("abc123", testCommentJson("c1")), "test", ""), true))
+	assert.Equal(t, 2, sender.runDue())
+	deliveries := recv.take()
+	if assert.Len(t, deliveries, 2) {
+		assert.Equal(t, EVENT_ARCHIVED, deliveries[0].event)
+		assert.Equal(t, EVENT_ARCHIVED, deliveries[0].payload.Event)
+		assert.Equal(t, "abc123", deliveries[0].payload.ThreadId)
+		assert.Equal(t, "test", deliveries[0].payload.Sub)
+		assert.Equal(t, webhookSignature("key", deliveries[0].body), deliveries[0].signature)
+		assert.Equal(t, EVENT_UPDATED, deliveries[1].event)
+	}
+	assert.Equal(t, 0, sender.runDue())
+
+	// Unsubscribed events are not queued.
+	emitEvent(fetchFailedEvent("test", "abc123", fmt.Errorf("failed")))
+	assert.Equal(t, 0, sender.runDue())
+
+	// Failed deliveries are retried with a growing delay, then marked dead.
+	recv.failWith(500)
+	_, err = takedownThread("abc123")
+	assert.Nil(t, err)
+	assert.False(t, threadArchived("abc123"))
+	assert.Equal(t, 0, sender.runDue())
+	for attempt := int64(1); attempt < WEBHOOK_MAX_ATTEMPTS; attempt++ {
+		clock.advance(webhookBackoff(attempt) - time.Second)
+		assert.Equal(t, 0, sender.runDue())
+		dead, _ := queryDeadDeliveries()
+		assert.Empty(t, dead)
+		clock.advance(time.Second)
+		assert.Equal(t, 0, sender.runDue())
+	}
+	dead, err := queryDeadDeliveries()
+	assert.Nil(t, err)
+	if !assert.Len(t, dead, 1) {
+		return
+	}
+	assert.Equal(t, EVENT_TAKEDOWN, dead[0].Event)
+	assert.Equal(t, int64(WEBHOOK_MAX_ATTEMPTS), dead[0].Attempts)
+	assert.Contains(t, dead[0].LastError, "500")
+	clock.advance(WEBHOOK_MAX_BACKOFF)
+	assert.Equal(t, 0, sender.runDue())
+
+	// Dead deliveries are sent again once retried.
+	recv.failWith(0)
+	retried, err := retryDelivery(dead[0].Id, clock.Now())
+	assert.Nil(t, err)
+	assert.True(t, retried)
+	assert.Equal(t, 1, sender.runDue())
+	if deliveries := recv.take(); assert.Len(t, deliveries, 1) {
+		assert.Equal(t, EVENT_TAKEDOWN, deliveries[0].payload.Event)
+		assert.Equal(t, "abc123", deliveries[0].payload.ThreadId)
+	}
+	dead, _ = queryDeadDeliveries()
+	assert.Empty(t, dead)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, WEBHOOK_BACKOFF, webhookBackoff(1))
+	assert.Equal(t, 4*WEBHOOK_BACKOFF, webhookBackoff(3))
+	assert.Equal(t, WEBHOOK_MAX_BACKOFF, webhookBackoff(20))
+}
+
+func TestAdminWebhooks(t *testing.T) {
+	useTestDatabase(t)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	adminRoutes(r, "secret")
+
+	request := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, 400, request("POST", "/api/admin/webhooks", `{"url": "not a url"}`).Code)
+	res := request("POST", "/api/admin/webhooks", `{"url": "https://example.com/hook"}`)
+	assert.Equal(t, 201, res.Code)
+	created := struct {
+		Id     int64  `json:"id"`
+		Secret string `json:"secret"`
+	}{}
+	json.Unmarshal(res.Body.Bytes(), &created)
+	assert.NotEmpty(t, created.Secret)
+
+	res = request("GET", "/api/admin/webhooks", "")
+	assert.Equal(t, 200, res.Code)
+	assert.Contains(t, res.Body.String(), `"url":"https://example.com/hook","events":["*"]`)
+	assert.NotContains(t, res.Body.String(), created.Secret)
+
+	assert.Nil(t, writeArchive(parseThreadPage(testPageJson("abc123"), "test", ""), false))
+	_, err := execTransaction(`UPDATE webhook_deliveries SET dead = 1`)
+	assert.Nil(t, err)
+	dead, _ := queryDeadDeliveries()
+	if assert.Len(t, dead, 1) {
+		assert.Contains(t, request("GET", "/api/admin/webhooks/dead", "").Body.String(), `"event":"thread.archived"`)
+		path := fmt.Sprintf("/api/admin/webhooks/dead/%d/retry", dead[0].Id)
+		assert.Equal(t, 204, request("POST", path, "").Code)
+		assert.Equal(t, 404, request("POST", path, "").Code)
+	}
+	assert.Equal(t, "[]", request("GET", "/api/admin/webhooks/dead", "").Body.String())
+
+	// Cached pages of the thread are not served after it is taken down.
+	pages := GettitRouter(routerOptsT)
+	getPage := func() int {
+		w := httptest.NewRecorder()
+		pages.ServeHTTP(w, httptest.NewRequest("GET", "/abc123", nil))
+		return w.Code
+	}
+	assert.Equal(t, 200, getPage())
+	assert.Equal(t, 204, request("DELETE", "/api/admin/threads/abc123", "").Code)
+	assert.Equal(t, 404, request("DELETE", "/api/admin/threads/abc123", "").Code)
+	assert.Equal(t, 404, getPage())
+
+	path := fmt.Sprintf("/api/admin/webhooks/%d", created.Id)
+	assert.Equal(t, 204, request("DELETE", path, "").Code)
+	assert.Equal(t, 404, request("DELETE", path, "").Code)
+	assert.Equal(t, "[]", request("GET", "/api/admin/webhooks", "").Body.String())
+}